@@ -0,0 +1,79 @@
+package sisyphus
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+)
+
+// Decision records the classification of a mail, for later review and
+// retraining.
+type Decision struct {
+	Time    time.Time
+	Maildir Maildir
+	Folder  string
+	Key     string
+	// Probability is the probability of the mail being junk. It is NaN if
+	// none of the mail's words have been learned.
+	Probability float64
+	Junk        bool
+	// Rule is the sender rule that decided on the mail instead of its
+	// words, if any.
+	Rule string
+	// Error tells why a junk mail could not be moved to the Junk folder,
+	// if it could not.
+	Error string
+}
+
+// MarshalJSON implements json.Marshaler. A NaN probability, which JSON cannot
+// represent, is written as null.
+func (d Decision) MarshalJSON() ([]byte, error) {
+	var prob *float64
+	if !math.IsNaN(d.Probability) {
+		prob = &d.Probability
+	}
+
+	return json.Marshal(struct {
+		Time        time.Time `json:"time"`
+		Maildir     string    `json:"maildir"`
+		Folder      string    `json:"folder,omitempty"`
+		Key         string    `json:"key"`
+		Probability *float64  `json:"probability"`
+		Junk        bool      `json:"junk"`
+		Rule        string    `json:"rule,omitempty"`
+		Error       string    `json:"error,omitempty"`
+	}{
+		Time:        d.Time,
+		Maildir:     string(d.Maildir),
+		Folder:      d.Folder,
+		Key:         d.Key,
+		Probability: prob,
+		Junk:        d.Junk,
+		Rule:        d.Rule,
+		Error:       d.Error,
+	})
+}
+
+// RecordDecision appends a decision as a line of JSON to the file at path,
+// which is created if necessary.
+func RecordDecision(path string, d Decision) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// a single write keeps concurrent records from interleaving
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
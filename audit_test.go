@@ -0,0 +1,66 @@
+package sisyphus_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit", func() {
+	Context("Record classification decisions", func() {
+		AfterEach(func() {
+			err = os.Remove("test/audit.jsonl")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Append decisions as lines of JSON", func() {
+			err = RecordDecision("test/audit.jsonl", Decision{
+				Time:        time.Date(2018, 2, 27, 20, 12, 17, 0, time.UTC),
+				Maildir:     "test/Maildir",
+				Key:         "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Probability: 0.75,
+				Junk:        true,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = RecordDecision("test/audit.jsonl", Decision{
+				Time:        time.Date(2018, 2, 27, 20, 12, 18, 0, time.UTC),
+				Maildir:     "test/Maildir",
+				Folder:      ".Lists",
+				Key:         "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+				Probability: math.NaN(),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			raw, err := ioutil.ReadFile("test/audit.jsonl")
+			Ω(err).ShouldNot(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+			Ω(lines).Should(HaveLen(2))
+
+			var d map[string]interface{}
+			err = json.Unmarshal([]byte(lines[0]), &d)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(d["time"]).Should(Equal("2018-02-27T20:12:17Z"))
+			Ω(d["maildir"]).Should(Equal("test/Maildir"))
+			Ω(d).ShouldNot(HaveKey("folder"))
+			Ω(d["key"]).Should(Equal("1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730"))
+			Ω(d["probability"]).Should(Equal(0.75))
+			Ω(d["junk"]).Should(BeTrue())
+
+			d = nil
+			err = json.Unmarshal([]byte(lines[1]), &d)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(d["folder"]).Should(Equal(".Lists"))
+			Ω(d["probability"]).Should(BeNil())
+			Ω(d["junk"]).Should(BeFalse())
+		})
+	})
+})
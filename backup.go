@@ -0,0 +1,507 @@
+package sisyphus
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrChecksum is returned when a backup does not match its checksum, e.g.
+// because it has been truncated.
+var ErrChecksum = errors.New("backup does not match its checksum")
+
+// ErrBackupPath is returned when the backup of a maildir would be written
+// within a cur, new or tmp directory of it or its folders, where it would be
+// mistaken for a mail.
+var ErrBackupPath = errors.New("backup must not be written within cur, new or tmp of its maildir or its folders")
+
+// CompressBackups tells whether backups are written compressed with gzip, see
+// BackupPath. Backups are read either way, see LatestBackup.
+var CompressBackups bool
+
+// BackupKeep is the number of timestamped backups kept of each database along
+// with its latest backup, so that it can be rolled back further; older ones
+// are pruned by Backup. There are none if zero.
+var BackupKeep int
+
+// backupStamp is the layout of the time a timestamped backup has been written
+// at, which is appended to the path of the latest backup. Its times sort like
+// their strings.
+const backupStamp = "20060102T150405.000Z"
+
+// buckets are the paths of all buckets a database of sisyphus consists of
+var buckets = [][]string{
+	{"Statistics"},
+	{"Wordlists", "Good"},
+	{"Wordlists", "Junk"},
+	{"Unlearned", "Good"},
+	{"Unlearned", "Junk"},
+	{"Learned"},
+}
+
+// ChecksumPath returns the path of the file holding the SHA-256 checksum of
+// the maildir's backup, in the format of sha256sum
+func (d Maildir) ChecksumPath() string {
+	return d.BackupPath() + ".sha256"
+}
+
+// Backups returns the paths of the timestamped backups of the maildir's
+// database, compressed or not, the oldest first, see BackupKeep. Their
+// checksums are held by the same paths with the suffix ".sha256".
+func (d Maildir) Backups() (paths []string, err error) {
+	matches, err := filepath.Glob(d.backupBase() + ".*")
+	if err != nil {
+		return paths, err
+	}
+	for _, path := range matches {
+		stamp := strings.TrimPrefix(path, d.backupBase()+".")
+		_, err := time.Parse(backupStamp, strings.TrimSuffix(stamp, ".gz"))
+		if err == nil {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// Backup writes a copy of the database of a maildir to its backup path, along
+// with the backup's checksum, and verifies the result with VerifyBackup. The
+// copy is compressed if CompressBackups is set. The previous backup is only
+// replaced once the new one has been verified. If BackupKeep is set, the
+// backup is also kept under a timestamp, and the oldest timestamped backups
+// are pruned.
+func Backup(db *bolt.DB, m Maildir) (err error) {
+
+	if m.HoldsMail(m.BackupPath()) {
+		return ErrBackupPath
+	}
+	if BackupDir != "" {
+		err = os.MkdirAll(BackupDir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the backup is written next to the previous one, which is kept until
+	// the new one has been verified
+	tmp := m.BackupPath() + ".new"
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + ".sha256")
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	// the checksum is the one of the file, compressed or not
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if CompressBackups {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(out)
+		return err
+	})
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = writeChecksum(tmp+".sha256", m.BackupPath(), h.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	err = verifyBackupFile(tmp)
+	if err != nil {
+		return err
+	}
+
+	// the checksum is moved last, verifyBackupFile accepts it where it has
+	// been written if Backup is interrupted in between
+	err = os.Rename(tmp, m.BackupPath())
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp+".sha256", m.ChecksumPath())
+	if err == nil {
+		err = syncDir(filepath.Dir(m.BackupPath()))
+	}
+	if err != nil || BackupKeep <= 0 {
+		return err
+	}
+
+	return rotateBackup(m, h.Sum(nil), time.Now())
+}
+
+// syncDir commits the entries of the directory dir, e.g. files renamed into
+// it, to stable storage. Directories cannot be synced on Windows, where this
+// does nothing.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+// writeChecksum writes the SHA-256 checksum sum of the backup at path to the
+// file checksum, in the format of sha256sum
+func writeChecksum(checksum, path string, sum []byte) error {
+	line := fmt.Sprintf("%x  %s\n", sum, filepath.Base(path))
+
+	return ioutil.WriteFile(checksum, []byte(line), 0600)
+}
+
+// rotateBackup keeps a copy of the latest backup of a maildir, whose checksum
+// is sum, under the time t, and prunes the timestamped backups beyond the
+// newest BackupKeep ones
+func rotateBackup(m Maildir, sum []byte, t time.Time) error {
+	path := m.backupBase() + "." + t.UTC().Format(backupStamp)
+	if CompressBackups {
+		path += ".gz"
+	}
+	err := copyFile(m.BackupPath(), path)
+	if err == nil {
+		err = writeChecksum(path+".sha256", path, sum)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	paths, err := m.Backups()
+	if err != nil {
+		return err
+	}
+	for len(paths) > BackupKeep {
+		for _, p := range []string{paths[0], paths[0] + ".sha256"} {
+			err = os.Remove(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		paths = paths[1:]
+	}
+
+	return nil
+}
+
+// VerifyBackup checks that the latest backup of a maildir, see LatestBackup,
+// matches its checksum, can be opened as a database, is free of
+// inconsistencies and contains all buckets of sisyphus, i.e. that the backup
+// can be restored.
+func VerifyBackup(m Maildir) (err error) {
+	return verifyBackupFile(m.LatestBackup())
+}
+
+// verifyBackupFile verifies the backup at path like VerifyBackup, against the
+// checksum held by the same path with the suffix ".sha256"
+func verifyBackupFile(path string) (err error) {
+
+	want, err := readChecksum(path + ".sha256")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		// Backup has been interrupted after moving the backup into
+		// place, but before its checksum
+		pending, err := readChecksum(path + ".new.sha256")
+		if err != nil || !bytes.Equal(h.Sum(nil), pending) {
+			return ErrChecksum
+		}
+	}
+
+	db, err := openBackupFile(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return Check(db)
+}
+
+// readChecksum returns the SHA-256 checksum held by the file at path, in the
+// format of sha256sum
+func readChecksum(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return nil, ErrChecksum
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return nil, ErrChecksum
+	}
+
+	return sum, nil
+}
+
+// compressed reports whether the file at path is compressed with gzip
+func compressed(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	start := make([]byte, len(gzipMagic))
+	_, err = io.ReadFull(f, start)
+
+	return err == nil && bytes.Equal(start, gzipMagic)
+}
+
+// openBackupFile opens the database at path read-only. It returns ErrLocked if
+// another process has opened the database for writing. A compressed backup is
+// decompressed to a temporary file first, which is removed as soon as it has
+// been opened, and stays readable until the database is closed.
+func openBackupFile(path string) (*bolt.DB, error) {
+	if compressed(path) {
+		tmp, err := decompress(path)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp)
+		path = tmp
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:  lockTimeout,
+		ReadOnly: true,
+	})
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	}
+
+	return db, err
+}
+
+// decompress decompresses the backup at path to a new temporary file and
+// returns its path
+func decompress(path string) (string, error) {
+	tmp, err := ioutil.TempFile("", "sisyphus-backup")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	err = copyBackup(path, tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// copyBackup copies the backup at src to dst like copyFile, decompressing it
+// if required
+func copyBackup(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r := bufio.NewReader(in)
+	start, _ := r.Peek(len(gzipMagic))
+	if !bytes.Equal(start, gzipMagic) {
+		return copyFile(src, dst)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, gz)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Check verifies that a database is free of inconsistencies and contains all
+// buckets of sisyphus. It only reads the database, so it may be open
+// read-only.
+func Check(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		// drain all errors, the check only ends once they have been read
+		var err error
+		for e := range tx.Check() {
+			if err == nil {
+				err = e
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, path := range buckets {
+			if bucket(tx, path...) == nil {
+				return fmt.Errorf("database lacks bucket %s", strings.Join(path, "/"))
+			}
+		}
+
+		return nil
+	})
+}
+
+// RestoreBackup replaces the database of a maildir with its latest backup, see
+// LatestBackup, after the backup has been verified with VerifyBackup. The current database is kept as
+// sisyphus.db.pre-restore, even if it cannot be read anymore. It returns
+// ErrLocked if the database is in use.
+func RestoreBackup(m Maildir) (err error) {
+	return RestoreBackupFile(m, m.LatestBackup())
+}
+
+// RestoreBackupFile replaces the database of a maildir with the backup at
+// path, e.g. one of its timestamped backups, see Backups, like RestoreBackup.
+// A compressed backup is decompressed. The backup is verified against the
+// checksum held by the same path with the suffix ".sha256".
+func RestoreBackupFile(m Maildir, backup string) (err error) {
+
+	err = verifyBackupFile(backup)
+	if err != nil {
+		return err
+	}
+
+	path := m.DatabasePath()
+	_, err = os.Stat(path)
+	if err == nil {
+		// hold the database while it is replaced, so nobody else opens it
+		var db *bolt.DB
+		db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: lockTimeout})
+		if err == bolt.ErrTimeout {
+			return ErrLocked
+		}
+		if err == nil {
+			defer db.Close()
+			err = db.View(func(tx *bolt.Tx) error {
+				return tx.CopyFile(path+".pre-restore", 0600)
+			})
+		} else {
+			// a corrupt database cannot be opened by anybody else
+			// either, so it is kept as it is
+			err = copyFile(path, path+".pre-restore")
+		}
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp := path + ".restore"
+	err = copyBackup(backup, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"dir":    string(m),
+		"backup": backup,
+	}).Info("Database restored from backup")
+
+	return nil
+}
+
+// copyFile copies the file at src to dst, which is replaced if it exists
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,433 @@
+package sisyphus_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backup", func() {
+	Context("Back up a database", func() {
+
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+
+			for _, path := range []string{
+				"test/Maildir/sisyphus.db",
+				"test/Maildir/sisyphus.db.backup",
+				"test/Maildir/sisyphus.db.backup.sha256",
+			} {
+				err = os.Remove(path)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		})
+
+		It("Read a database in use from its backup, and the database itself otherwise", func() {
+			ro, err := LoadReadOnlyDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ro["test/Maildir"].Path()).Should(Equal("test/Maildir/sisyphus.db.backup"))
+			_, jTotal, _, _ := Info(ro["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(1)))
+			CloseDatabases(ro)
+
+			// any number of readers may share the database
+			CloseDatabases(dbs)
+			first, err := LoadReadOnlyDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(first)
+			second, err := LoadReadOnlyDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(second)
+
+			for _, db := range []*bolt.DB{first["test/Maildir"], second["test/Maildir"]} {
+				Ω(db.Path()).Should(Equal("test/Maildir/sisyphus.db"))
+				Ω(db.IsReadOnly()).Should(BeTrue())
+				_, jTotal, _, _ = Info(db)
+				Ω(jTotal).Should(Equal(uint64(1)))
+			}
+		})
+
+		It("Write a checksum along with the backup and verify it", func() {
+			sum, err := ioutil.ReadFile("test/Maildir/sisyphus.db.backup.sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(sum)).Should(MatchRegexp(`^[0-9a-f]{64}  sisyphus\.db\.backup\n$`))
+
+			err = VerifyBackup("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			backups, err := LoadBackupDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(backups)
+
+			gTotal, jTotal, _, _ := Info(backups["test/Maildir"])
+			Ω(gTotal).Should(BeZero())
+			Ω(jTotal).Should(Equal(uint64(1)))
+		})
+
+		It("Detect a truncated backup", func() {
+			info, err := os.Stat("test/Maildir/sisyphus.db.backup")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = os.Truncate("test/Maildir/sisyphus.db.backup", info.Size()/2)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = VerifyBackup("test/Maildir")
+			Ω(err).Should(Equal(ErrChecksum))
+		})
+
+		It("Verify a backup whose checksum has not been moved into place", func() {
+			previous, err := ioutil.ReadFile("test/Maildir/sisyphus.db.backup.sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = dbs["test/Maildir"].Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("Statistics")).Put([]byte("Something"), []byte("new"))
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// as left by a Backup interrupted between its renames
+			err = os.Rename("test/Maildir/sisyphus.db.backup.sha256", "test/Maildir/sisyphus.db.backup.new.sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile("test/Maildir/sisyphus.db.backup.sha256", previous, 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = VerifyBackup("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = os.Remove("test/Maildir/sisyphus.db.backup.new.sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = VerifyBackup("test/Maildir")
+			Ω(err).Should(Equal(ErrChecksum))
+		})
+
+		It("Check a database for missing buckets", func() {
+			err = Check(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = dbs["test/Maildir"].Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket([]byte("Learned"))
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = Check(dbs["test/Maildir"])
+			Ω(err).Should(MatchError("database lacks bucket Learned"))
+		})
+
+		It("Keep the previous backup if the new one cannot be verified", func() {
+			err = dbs["test/Maildir"].Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket([]byte("Learned"))
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(MatchError("database lacks bucket Learned"))
+			Ω("test/Maildir/sisyphus.db.backup.new").ShouldNot(BeAnExistingFile())
+			Ω("test/Maildir/sisyphus.db.backup.new.sha256").ShouldNot(BeAnExistingFile())
+
+			err = VerifyBackup("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Restore the backup and keep the replaced database", func() {
+			defer os.Remove("test/Maildir/sisyphus.db.pre-restore")
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			CloseDatabases(dbs)
+
+			err = RestoreBackup("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(BeZero())
+			Ω(jTotal).Should(Equal(uint64(1)))
+
+			previous, err := os.Stat("test/Maildir/sisyphus.db.pre-restore")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(previous.Size()).Should(BeNumerically(">", 0))
+		})
+
+		It("Skip a corrupt database at startup, or restore its backup", func() {
+			defer os.Remove("test/Maildir/sisyphus.db.pre-restore")
+			CloseDatabases(dbs)
+			err = ioutil.WriteFile("test/Maildir/sisyphus.db", make([]byte, 8192), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var failed map[Maildir]error
+			dbs, failed = LoadAvailableDatabases([]Maildir{"test/Maildir"}, false)
+			Ω(dbs).Should(BeEmpty())
+			Ω(failed["test/Maildir"]).Should(HaveOccurred())
+
+			dbs, failed = LoadAvailableDatabases([]Maildir{"test/Maildir"}, true)
+			Ω(failed).Should(BeEmpty())
+			_, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(1)))
+
+			previous, err := os.Stat("test/Maildir/sisyphus.db.pre-restore")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(previous.Size()).Should(Equal(int64(8192)))
+		})
+
+		It("Keep the newest timestamped backups and restore an older one", func() {
+			BackupKeep = 2
+			defer func() {
+				BackupKeep = 0
+				paths, _ := Maildir("test/Maildir").Backups()
+				for _, path := range paths {
+					os.Remove(path)
+					os.Remove(path + ".sha256")
+				}
+				os.Remove("test/Maildir/sisyphus.db.pre-restore")
+			}()
+
+			for i := 0; i < 3; i++ {
+				time.Sleep(5 * time.Millisecond)
+				err = Backup(dbs["test/Maildir"], "test/Maildir")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			paths, err := Maildir("test/Maildir").Backups()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(paths).Should(HaveLen(2))
+			for _, path := range paths {
+				Ω(path).Should(HavePrefix("test/Maildir/sisyphus.db.backup."))
+				_, err = os.Stat(path + ".sha256")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			time.Sleep(5 * time.Millisecond)
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			newest, err := Maildir("test/Maildir").Backups()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(newest).Should(Equal([]string{paths[1], newest[1]}))
+
+			CloseDatabases(dbs)
+			err = RestoreBackupFile("test/Maildir", paths[1])
+			Ω(err).ShouldNot(HaveOccurred())
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(BeZero())
+			Ω(jTotal).Should(Equal(uint64(1)))
+		})
+
+		It("Refuse to restore a database in use", func() {
+			err = RestoreBackup("test/Maildir")
+			Ω(err).Should(Equal(ErrLocked))
+		})
+
+		It("Refuse to restore a corrupted backup", func() {
+			CloseDatabases(dbs)
+			err = ioutil.WriteFile("test/Maildir/sisyphus.db.backup", []byte("garbage"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = RestoreBackup("test/Maildir")
+			Ω(err).Should(Equal(ErrChecksum))
+
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			_, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(1)))
+		})
+	})
+	Context("Back up a database to a directory of backups", func() {
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			BackupDir = ""
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = os.RemoveAll("test/backups")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Write the backup and its checksum to the directory of backups", func() {
+			BackupDir = "test/backups"
+			d := Maildir("test/Maildir")
+			Ω(filepath.Dir(d.BackupPath())).Should(Equal("test/backups"))
+
+			err = Backup(dbs[d], d)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(d.BackupPath()).Should(BeAnExistingFile())
+			Ω(d.ChecksumPath()).Should(BeAnExistingFile())
+			Ω("test/Maildir/sisyphus.db.backup").ShouldNot(BeAnExistingFile())
+		})
+
+		It("Refuse to write a backup where it would be mistaken for a mail", func() {
+			BackupDir = "test/Maildir/new/backups"
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(Equal(ErrBackupPath))
+			Ω("test/Maildir/new/backups").ShouldNot(BeAnExistingFile())
+		})
+
+		It("Tell paths within cur, new or tmp of a maildir or its folders", func() {
+			d := Maildir("test/Maildir")
+			Ω(d.HoldsMail("test/Maildir/new")).Should(BeTrue())
+			Ω(d.HoldsMail("test/Maildir/cur/backups")).Should(BeTrue())
+			Ω(d.HoldsMail("test/Maildir/tmp/../new/x")).Should(BeTrue())
+			Ω(d.HoldsMail("test/Maildir")).Should(BeFalse())
+			Ω(d.HoldsMail("test/Maildir/newer")).Should(BeFalse())
+			Ω(d.HoldsMail("test/Maildir/.Junk/new")).Should(BeTrue())
+			Ω(d.HoldsMail("test/Maildir/.Archive.2017/cur/backups")).Should(BeTrue())
+			Ω(d.HoldsMail("test/Maildir/.Junk")).Should(BeFalse())
+			Ω(d.HoldsMail("test/backups")).Should(BeFalse())
+		})
+	})
+	Context("Compress backups", func() {
+		BeforeEach(func() {
+			CompressBackups = true
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CompressBackups = false
+			CloseDatabases(dbs)
+
+			for _, path := range []string{
+				"test/Maildir/sisyphus.db",
+				"test/Maildir/sisyphus.db.backup.gz",
+				"test/Maildir/sisyphus.db.backup.gz.sha256",
+			} {
+				err = os.Remove(path)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		})
+
+		It("Write the backup compressed with gzip and read it", func() {
+			d := Maildir("test/Maildir")
+			Ω(d.BackupPath()).Should(Equal("test/Maildir/sisyphus.db.backup.gz"))
+			Ω("test/Maildir/sisyphus.db.backup").ShouldNot(BeAnExistingFile())
+			raw, err := ioutil.ReadFile(d.BackupPath())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(raw[:2]).Should(Equal([]byte{0x1f, 0x8b}))
+			db, err := os.Stat(d.DatabasePath())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(int64(len(raw))).Should(BeNumerically("<", db.Size()))
+
+			err = VerifyBackup(d)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			ro, err := LoadReadOnlyDatabases([]Maildir{d})
+			Ω(err).ShouldNot(HaveOccurred())
+			_, jTotal, _, _ := Info(ro[d])
+			Ω(jTotal).Should(Equal(uint64(1)))
+			CloseDatabases(ro)
+		})
+
+		It("Restore a compressed backup", func() {
+			defer os.Remove("test/Maildir/sisyphus.db.pre-restore")
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			CloseDatabases(dbs)
+
+			err = RestoreBackup("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(BeZero())
+			Ω(jTotal).Should(Equal(uint64(1)))
+		})
+
+		It("Detect a truncated compressed backup", func() {
+			raw, err := ioutil.ReadFile("test/Maildir/sisyphus.db.backup.gz")
+			Ω(err).ShouldNot(HaveOccurred())
+			raw = raw[:len(raw)/2]
+			err = ioutil.WriteFile("test/Maildir/sisyphus.db.backup.gz", raw, 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// the checksum matches, so that decompressing fails
+			sum := sha256.Sum256(raw)
+			err = ioutil.WriteFile("test/Maildir/sisyphus.db.backup.gz.sha256", []byte(fmt.Sprintf("%x  sisyphus.db.backup.gz\n", sum)), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = VerifyBackup("test/Maildir")
+			Ω(err).Should(Equal(io.ErrUnexpectedEOF))
+
+			CloseDatabases(dbs)
+			err = RestoreBackup("test/Maildir")
+			Ω(err).Should(Equal(io.ErrUnexpectedEOF))
+			Ω("test/Maildir/sisyphus.db.pre-restore").ShouldNot(BeAnExistingFile())
+		})
+
+		It("Read the latest backup, compressed or not", func() {
+			defer os.Remove("test/Maildir/sisyphus.db.backup")
+			defer os.Remove("test/Maildir/sisyphus.db.backup.sha256")
+			defer os.Remove("test/Maildir/sisyphus.db.pre-restore")
+			d := Maildir("test/Maildir")
+			Ω(d.LatestBackup()).Should(Equal("test/Maildir/sisyphus.db.backup.gz"))
+
+			// an uncompressed backup is written after the compressed one
+			hour := time.Now().Add(-time.Hour)
+			err = os.Chtimes(d.BackupPath(), hour, hour)
+			Ω(err).ShouldNot(HaveOccurred())
+			CompressBackups = false
+			err = Backup(dbs["test/Maildir"], d)
+			Ω(err).ShouldNot(HaveOccurred())
+			CompressBackups = true
+			Ω(d.BackupPath()).Should(Equal("test/Maildir/sisyphus.db.backup.gz"))
+			Ω(d.LatestBackup()).Should(Equal("test/Maildir/sisyphus.db.backup"))
+
+			err = VerifyBackup(d)
+			Ω(err).ShouldNot(HaveOccurred())
+			CloseDatabases(dbs)
+			err = RestoreBackup(d)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+})
@@ -1,14 +1,19 @@
 package sisyphus
 
 import (
-	"os"
+	"context"
+	"fmt"
+	"io"
+	"math"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/boltdb/bolt"
 	"github.com/gonum/stat"
-	"github.com/retailnext/hllpp"
 )
 
 // classificationPrior returns the prior probabilities for good and junk
@@ -26,32 +31,21 @@ func classificationPrior(db *bolt.DB) (g float64, err error) {
 // classificationLikelihoodWordcounts gets wordcounts from database to be used
 // in Likelihood calculation
 func classificationLikelihoodWordcounts(db *bolt.DB, word string) (gN, jN float64, err error) {
+	word = wordKey(word)
 
 	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Wordlists"))
-
-		good := b.Bucket([]byte("Good"))
-		gWordRaw := good.Get([]byte(word))
-		if len(gWordRaw) > 0 {
-			var gWordHLL *hllpp.HLLPP
-			gWordHLL, err = hllpp.Unmarshal(gWordRaw)
-			if err != nil {
-				return err
-			}
-			gN = float64(gWordHLL.Count())
-		}
-		junk := b.Bucket([]byte("Junk"))
-		jWordRaw := junk.Get([]byte(word))
-		if len(jWordRaw) > 0 {
-			var jWordHLL *hllpp.HLLPP
-			jWordHLL, err = hllpp.Unmarshal(jWordRaw)
-			if err != nil {
-				return err
-			}
-			jN = float64(jWordHLL.Count())
+		gN, err = effective(get(bucket(tx, "Wordlists", "Good"), word),
+			get(bucket(tx, "Unlearned", "Good"), word),
+			get(bucket(tx, "Decayed", "Good"), word))
+		if err != nil {
+			return err
 		}
 
-		return nil
+		jN, err = effective(get(bucket(tx, "Wordlists", "Junk"), word),
+			get(bucket(tx, "Unlearned", "Junk"), word),
+			get(bucket(tx, "Decayed", "Junk"), word))
+
+		return err
 	})
 
 	return gN, jN, err
@@ -63,23 +57,16 @@ func classificationStatistics(db *bolt.DB) (gTotal, jTotal float64, err error) {
 
 	err = db.View(func(tx *bolt.Tx) error {
 		p := tx.Bucket([]byte("Statistics"))
-		gRaw := p.Get([]byte("ProcessedGood"))
-		if len(gRaw) > 0 {
-			var gHLL *hllpp.HLLPP
-			gHLL, err = hllpp.Unmarshal(gRaw)
-			if err != nil {
-				return err
-			}
-			gTotal = float64(gHLL.Count())
-		}
-		jRaw := p.Get([]byte("ProcessedJunk"))
-		if len(jRaw) > 0 {
-			var jHLL *hllpp.HLLPP
-			jHLL, err = hllpp.Unmarshal(jRaw)
-			if err != nil {
-				return err
-			}
-			jTotal = float64(jHLL.Count())
+		d := bucket(tx, "Decayed", "Statistics")
+
+		gTotal, err = effective(get(p, "ProcessedGood"), get(p, "UnlearnedGood"), get(d, "Good"))
+		if err != nil {
+			return err
+		}
+
+		jTotal, err = effective(get(p, "ProcessedJunk"), get(p, "UnlearnedJunk"), get(d, "Junk"))
+		if err != nil {
+			return err
 		}
 
 		if gTotal == 0 && jTotal == 0 {
@@ -122,8 +109,9 @@ func classificationLikelihood(db *bolt.DB, word string) (g, j float64, err error
 }
 
 // classificationWord produces the conditional probability of a word belonging
-// to good or junk using the classic Bayes' rule.
-func classificationWord(db *bolt.DB, word string) (g float64, err error) {
+// to good or junk using the classic Bayes' rule, smoothed as configured by
+// Options.Smoothing.
+func (o Options) classificationWord(db *bolt.DB, word string) (g float64, err error) {
 
 	priorG, err := classificationPrior(db)
 	if err != nil {
@@ -137,89 +125,486 @@ func classificationWord(db *bolt.DB, word string) (g float64, err error) {
 
 	g = (likelihoodG * priorG) / (likelihoodG*priorG + likelihoodJ*(1-priorG))
 
-	return g, nil
+	s := o.smoothing()
+	if s == 0 || math.IsNaN(g) {
+		return g, nil
+	}
+
+	// Robinson's adjustment: a word seen in n mails weighs like n mails
+	// against s made-up mails of probability SmoothingProbability
+	gN, jN, err := classificationLikelihoodWordcounts(db, word)
+	if err != nil {
+		return g, err
+	}
+	n := gN + jN
+
+	return (s*SmoothingProbability + n*g) / (s + n), nil
+}
+
+// Classification is the outcome of classifying a new mail.
+type Classification struct {
+	// Probability is the probability of the mail being junk. It is NaN if
+	// none of the mail's words have been learned.
+	Probability float64
+	Junk        bool
+	// Skipped is set for mails left alone because they have already been
+	// seen or trashed.
+	Skipped bool
+	// Untrained is set for mails that would have been junk, but are not
+	// filed as such because too few mails have been learned yet, see
+	// Options.MinTraining.
+	Untrained bool
+	// Rule is the rule of Options.Whitelist or Options.Blacklist the
+	// sender of the mail matched, if any. Such mails are not scored, their
+	// probability is 0 or 1, respectively.
+	Rule string
+	// Destination is the path a junk mail has been moved to, or would have
+	// been moved to in a dry run. It is empty for all other mails.
+	Destination string
+	// Sender is the address of the sender of the mail, if known.
+	Sender string
 }
 
 // Classify analyses a new mail (a mail that arrived in the "new" directory),
 // decides whether it is junk and -- if so -- moves it to the Junk folder. If
 // it is not junk, the mail is untouched so it can be handled by the mail
-// client.
-func (m *Mail) Classify(db *bolt.DB, dir Maildir) (err error) {
+// client. Mails flagged as seen or trashed have already been handled by the
+// user and are left alone, too.
+func (m *Mail) Classify(db *bolt.DB, dir Maildir) (c Classification, err error) {
+	return m.ClassifyContext(context.Background(), db, dir)
+}
+
+// ClassifyContext is like Classify, but gives up once ctx is done, e.g. after
+// a timeout, and returns ctx.Err(). This keeps a malformed or enormous mail
+// from stalling the caller, while the mail is left in place untouched. A panic
+// while reading the mail is returned as an error, too.
+func (m *Mail) ClassifyContext(ctx context.Context, db *bolt.DB, dir Maildir) (c Classification, err error) {
+
+	if strings.ContainsAny(m.Flags(), "ST") {
+		log.WithFields(log.Fields{
+			"mail":  m.Key,
+			"flags": m.Flags(),
+			"dir":   string(dir),
+		}).Info("Skip mail already seen or trashed")
+		c.Skipped = true
+		return c, nil
+	}
 
 	m.New = true
 
-	err = m.Load(dir)
+	err = ctx.Err()
 	if err != nil {
-		return err
+		return c, err
 	}
 
-	list, err := m.cleanWordlist()
+	f, err := m.open(dir)
 	if err != nil {
-		return err
+		return c, err
+	}
+
+	// The mail is classified as a copy, which is left to finish on its
+	// own if ctx is done first. It stops reading the mail then and leaves
+	// the database alone.
+	type result struct {
+		m   Mail
+		c   Classification
+		err error
+	}
+	done := make(chan result, 1)
+	go func(mc Mail) {
+		defer f.Close()
+		// a panic cannot be recovered from by the caller in here
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("panic while classifying mail %s: %v", mc.Key, r)}
+			}
+		}()
+		c, err := mc.classifyReader(ctx, db, f)
+		done <- result{mc, c, err}
+	}(*m)
+
+	select {
+	case <-ctx.Done():
+		return c, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return r.c, r.err
+		}
+		*m = r.m
+		c = r.c
+	}
+	// Move mail around if junk, and record the decision once it is known
+	// whether the mail has been moved
+	if c.Junk {
+		err = m.moveJunk(dir, &c)
+	}
+	m.record(dir, c, err)
+	if err != nil {
+		return c, err
 	}
 
-	junk, prob, err := Junk(db, list)
+	return c, nil
+}
+
+// moveJunk moves a new mail classified as junk to the Junk folder, or only
+// tells where it would have been moved to in a dry run, and sets the
+// destination of its classification c
+func (m *Mail) moveJunk(dir Maildir, c *Classification) error {
+	to, err := m.junkPath(dir)
 	if err != nil {
 		return err
 	}
+	if !m.DryRun {
+		err = move(filepath.Join(string(dir), m.Folder, "new", m.Key), to)
+		if err != nil {
+			return err
+		}
+	}
+	c.Destination = to
 
-	m.Junk = junk
+	var dryRun string
+	if m.DryRun {
+		dryRun = "-- dry run (nothing happened to this mail!)"
+	}
+
+	log.WithFields(log.Fields{
+		"mail": m.Key,
+		"to":   to,
+	}).Info("Moved to Junk folder" + dryRun)
+
+	return nil
+}
+
+// record records the classification c of a mail in the audit log, if any,
+// along with the error moveErr of moving it to the Junk folder
+func (m *Mail) record(dir Maildir, c Classification, moveErr error) {
+	if m.AuditLog == "" {
+		return
+	}
+
+	d := Decision{
+		Time:        time.Now(),
+		Maildir:     dir,
+		Folder:      m.Folder,
+		Key:         m.Key,
+		Probability: c.Probability,
+		Junk:        c.Junk,
+		Rule:        m.redact(c.Rule),
+	}
+	if moveErr != nil {
+		d.Error = moveErr.Error()
+	}
+	err := RecordDecision(m.AuditLog, d)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"mail": m.Key,
+			"file": m.AuditLog,
+		}).Error("Cannot record decision")
+	}
+}
+
+// ClassifyReader analyses the raw mail read from r with the default options
+// and decides whether it is junk, e.g. a mail uploaded to a web application.
+// See Mail.ClassifyReader for classifying with other options.
+func ClassifyReader(db *bolt.DB, r io.Reader) (Classification, error) {
+	var m Mail
+
+	return m.ClassifyReader(db, r)
+}
+
+// ClassifyReader analyses the raw mail read from r, e.g. a mail handed over by
+// an MTA, and decides whether it is junk. Unlike Classify, it neither moves
+// the mail nor records the decision; this is up to the caller. The time of
+// the classification is recorded in the database once a minute at most,
+// unless it is read-only.
+func (m *Mail) ClassifyReader(db *bolt.DB, r io.Reader) (c Classification, err error) {
+	return m.classifyReader(context.Background(), db, r)
+}
+
+// classifyReader is like ClassifyReader, but fails reading the mail once ctx
+// is done, and then returns ctx.Err() without recording the time of the
+// classification
+func (m *Mail) classifyReader(ctx context.Context, db *bolt.DB, r io.Reader) (c Classification, err error) {
+
+	err = m.Read(contextReader{ctx, r})
+	if err != nil {
+		return c, err
+	}
+
+	c, err = m.score(db)
+	if err != nil {
+		return c, err
+	}
+
+	// text read until ctx was done may have been scored, but the caller
+	// has given up on it already
+	err = ctx.Err()
+	if err != nil {
+		return c, err
+	}
+	c.Sender = m.Sender()
 
 	log.WithFields(log.Fields{
 		"mail":        m.Key,
 		"junk":        m.Junk,
-		"probability": prob,
-		"dir":         string(dir),
+		"probability": c.Probability,
 	}).Info("Classified")
 
-	// Move mail around if junk.
-	if junk {
-		if !m.DryRun {
-			err = os.Rename(filepath.Join(string(dir), "new", m.Key), filepath.Join(string(dir), ".Junk", "cur", m.Key))
-			if err != nil {
-				return err
-			}
+	// a database that cannot tell when it was last used is no reason to
+	// fail the classification
+	if !db.IsReadOnly() {
+		err = recordClassified(db, time.Now())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"mail": m.Key,
+			}).Warning("Cannot record time of classification")
 		}
+	}
 
-		var dryRun string
-		if m.DryRun {
-			dryRun = "-- dry run (nothing happened to this mail!)"
-		}
+	m.Subject = nil
+	m.Body = nil
+	m.Header = nil
+
+	return c, nil
+}
+
+// classifiedInterval is the least time between two records of when a
+// database was last classified with, so that classifying a mail takes no
+// write to the database most of the time
+const classifiedInterval = time.Minute
+
+// recordClassified records t as the time db was last classified with, unless
+// a time less than classifiedInterval before has been recorded already
+func recordClassified(db *bolt.DB, t time.Time) error {
+	var last time.Time
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		last, err = getTime(tx, "LastClassified")
+		return err
+	})
+	if err != nil || t.Sub(last) < classifiedInterval {
+		return err
+	}
+
+	return db.Batch(func(tx *bolt.Tx) error {
+		return setTime(tx, "LastClassified", t)
+	})
+}
+
+// contextReader reads from r until ctx is done, and then fails with ctx.Err()
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
+func (r contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// score classifies a loaded mail
+func (m *Mail) score(db *bolt.DB) (c Classification, err error) {
+
+	rule, ok := m.Whitelist.Match(m.Sender())
+	if ok {
 		log.WithFields(log.Fields{
-			"mail": m.Key,
-		}).Info("Moved to Junk folder" + dryRun)
+			"mail":   m.Key,
+			"sender": m.redact(m.Sender()),
+			"rule":   m.redact(rule),
+		}).Info("Sender is whitelisted")
+		m.Junk = false
+		c.Rule = rule
+		return c, nil
+	}
+
+	rule, ok = m.Blacklist.Match(m.Sender())
+	if ok {
+		log.WithFields(log.Fields{
+			"mail":   m.Key,
+			"sender": m.redact(m.Sender()),
+			"rule":   m.redact(rule),
+		}).Info("Sender is blacklisted")
+		m.Junk = true
+		c.Junk = true
+		c.Probability = 1
+		c.Rule = rule
+		return c, nil
 	}
 
-	err = m.Unload(dir)
+	list, err := m.cleanWordlist()
+	if err != nil {
+		return c, err
+	}
 
-	return err
+	junk, prob, err := m.junk(db, list, m.upstreamProbabilities()...)
+	if err != nil {
+		return c, err
+	}
+
+	if junk && m.MinTraining > 0 {
+		gTotal, jTotal, err := classificationStatistics(db)
+		if err != nil {
+			return c, err
+		}
+		min := float64(m.MinTraining)
+		if gTotal < min || jTotal < min {
+			log.WithFields(log.Fields{
+				"mail":        m.Key,
+				"probability": prob,
+				"good":        gTotal,
+				"junk":        jTotal,
+				"minimum":     m.MinTraining,
+			}).Info("Too few mails learned yet, not filing mail as junk")
+			junk = false
+			c.Untrained = true
+		}
+	}
+
+	m.Junk = junk
+	c.Junk = junk
+	c.Probability = prob
+
+	return c, nil
 }
 
 // Junk returns true if the wordlist is classified as a junk mail using Bayes'
-// rule. If required, it also returns the calculated probability of being junk,
-// but this is typically not needed.
+// rule and the default threshold. If required, it also returns the calculated
+// probability of being junk, but this is typically not needed.
 func Junk(db *bolt.DB, wordlist []string) (junk bool, prob float64, err error) {
-	var probabilities []float64
+	return Options{}.junk(db, wordlist)
+}
+
+// junk returns true if the probability of the wordlist being junk exceeds the
+// configured threshold. Further probabilities of being good, such as the
+// verdicts of upstream filters, are combined with those of the most
+// interesting words, see Options.MaxTokens.
+func (o Options) junk(db *bolt.DB, wordlist []string, extra ...float64) (junk bool, prob float64, err error) {
+	var words []evidence
 
 	// initial value should be no junk
 	prob = 1.0
 
 	for _, val := range wordlist {
 		var p float64
-		p, err = classificationWord(db, val)
+		p, err = o.classificationWord(db, val)
 		if err != nil {
 			return false, 0.0, err
 		}
-		probabilities = append(probabilities, p)
+		// words that have never been learned carry no information, unless
+		// there is nothing else to go by
+		if math.IsNaN(p) {
+			continue
+		}
+		words = append(words, evidence{p: p, weight: o.tokenWeight(val)})
+	}
+	var all []evidence
+	for _, p := range extra {
+		all = append(all, evidence{p: p, weight: 1})
+	}
+	all = append(all, mostInteresting(words, o.maxTokens())...)
+	if len(all) == 0 && len(wordlist) > 0 {
+		return false, math.NaN(), err
 	}
 
-	if len(probabilities) > 0 {
-		prob = stat.HarmonicMean(probabilities, nil)
+	// the order of the words is random, but rounding depends on the order
+	// of summation, so the probabilities are summed in ascending order to
+	// make the result reproducible
+	if len(all) > 0 {
+		sort.Slice(all, func(i, j int) bool {
+			if all[i].p == all[j].p {
+				return all[i].weight < all[j].weight
+			}
+			return all[i].p < all[j].p
+		})
+		probabilities := make([]float64, len(all))
+		weights := make([]float64, len(all))
+		for i, e := range all {
+			probabilities[i], weights[i] = e.p, e.weight
+		}
+
+		switch o.method() {
+		case MethodFisher:
+			prob = fisher(probabilities, weights)
+		default:
+			prob = stat.HarmonicMean(probabilities, weights)
+		}
 	}
-	if prob < 0.5 {
+	if (1 - prob) > o.threshold() {
 		return true, (1 - prob), err
 	}
 
 	return false, (1 - prob), err
 }
+
+// evidence is the probability of a mail being good indicated by one of its
+// words, or by an upstream filter, along with the weight it is combined with
+type evidence struct {
+	p, weight float64
+}
+
+// mostInteresting returns the n probabilities farthest from 0.5, i.e. those of
+// the words telling good from junk best, or all of them if n is negative
+func mostInteresting(probabilities []evidence, n int) []evidence {
+	if n < 0 || len(probabilities) <= n {
+		return probabilities
+	}
+
+	sort.Slice(probabilities, func(i, j int) bool {
+		pi, pj := probabilities[i].p, probabilities[j].p
+		di, dj := math.Abs(pi-0.5), math.Abs(pj-0.5)
+		if di == dj {
+			if pi == pj {
+				return probabilities[i].weight > probabilities[j].weight
+			}
+			return pi < pj
+		}
+		return di > dj
+	})
+
+	return probabilities[:n]
+}
+
+// fisher combines the probabilities of being good using Fisher's method, as
+// proposed by Gary Robinson and used by SpamBayes: it tests how unlikely the
+// probabilities of being good and those of being junk, respectively, are to
+// be that low by chance, and returns the probability of being good indicated
+// by the difference of both. A probability of weight 2 counts twice.
+func fisher(probabilities, weights []float64) float64 {
+	var logGood, logJunk, total float64
+	for i, p := range probabilities {
+		logGood += weights[i] * math.Log(p)
+		logJunk += weights[i] * math.Log(1-p)
+		total += weights[i]
+	}
+	// the degrees of freedom are even, i.e. twice a whole number of words
+	n := 2 * int(math.Max(1, math.Round(total)))
+
+	// low probabilities of being good are evidence of junk, and vice versa
+	junk := 1 - chi2Q(-2*logGood, n)
+	good := 1 - chi2Q(-2*logJunk, n)
+
+	return (good - junk + 1) / 2
+}
+
+// chi2Q returns the probability of a chi-squared distributed variable with an
+// even number of degrees of freedom v exceeding x
+func chi2Q(x float64, v int) float64 {
+	if math.IsInf(x, 1) {
+		return 0
+	}
+
+	m := x / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+
+	return math.Min(sum, 1)
+}
@@ -1,8 +1,12 @@
 package sisyphus_test
 
 import (
+	"context"
+	"io/ioutil"
 	"math"
 	"os"
+	"strings"
+	"sync/atomic"
 
 	. "github.com/carlostrub/sisyphus"
 
@@ -10,6 +14,20 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// expiringContext is done after its first check
+type expiringContext struct {
+	context.Context
+	checks int32
+}
+
+func (c *expiringContext) Err() error {
+	if atomic.AddInt32(&c.checks, 1) > 1 {
+		return context.Canceled
+	}
+
+	return nil
+}
+
 var _ = Describe("Classify Mails", func() {
 	Context("Classify one word from the mail that was ", func() {
 		BeforeEach(func() {
@@ -27,7 +45,7 @@ var _ = Describe("Classify Mails", func() {
 
 			// Load junk mail
 			m = &Mail{
-				Key:  "1488226337.M327833P8269.mail.carlostrub.ch,S=6960,W=7161:2,Sa",
+				Key:  "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
 				Junk: true,
 			}
 
@@ -52,7 +70,7 @@ var _ = Describe("Classify Mails", func() {
 
 		It("learned before and is junk", func() {
 
-			answer, prob, err := Junk(dbs["test/Maildir"], []string{"london"})
+			answer, prob, err := Junk(dbs["test/Maildir"], []string{"herpes"})
 
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(prob).Should(Equal(1.0))
@@ -82,7 +100,7 @@ var _ = Describe("Classify Mails", func() {
 
 		It("learned both as good and junk, respectively", func() {
 
-			answer, prob, err := Junk(dbs["test/Maildir"], []string{"than"})
+			answer, prob, err := Junk(dbs["test/Maildir"], []string{"with"})
 
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(prob).Should(Equal(0.5))
@@ -124,4 +142,405 @@ var _ = Describe("Classify Mails", func() {
 
 		})
 	})
+
+	Context("Classify a new mail with a configurable threshold", func() {
+		BeforeEach(func() {
+			// Load db
+			dbs, err = LoadDatabases([]Maildir{
+				"test/Maildir",
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// Learn junk and good mail
+			m = &Mail{
+				Key:  "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// Deliver a new mail containing a word learned as both good
+			// and junk, i.e. with a junk probability of 0.5
+			err = os.MkdirAll("test/Maildir/new", 0700)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile("test/Maildir/new/1600000000.M1P1.test", []byte("Subject: with\n\n"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			// Cleanup
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = os.RemoveAll("test/Maildir/new")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("keeps the mail with the default threshold", func() {
+			m = &Mail{
+				Key:    "1600000000.M1P1.test",
+				DryRun: true,
+			}
+
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeFalse())
+		})
+
+		It("files the mail as junk with a lower threshold", func() {
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				DryRun:  true,
+				Options: Options{Threshold: 0.4},
+			}
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeTrue())
+			Ω(c).Should(Equal(Classification{
+				Probability: 0.5,
+				Junk:        true,
+				Destination: "test/Maildir/.Junk/cur/1600000000.M1P1.test:2,S",
+			}))
+		})
+
+		It("falls back to the default threshold if out of range", func() {
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				DryRun:  true,
+				Options: Options{Threshold: 1.5},
+			}
+
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeFalse())
+		})
+
+		It("moves junk delivered to a subfolder into the Junk folder of the maildir", func() {
+			err = os.MkdirAll("test/Maildir/.Lists/new", 0700)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll("test/Maildir/.Lists")
+			err = os.Rename("test/Maildir/new/1600000000.M1P1.test", "test/Maildir/.Lists/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Folder:  ".Lists",
+				Options: Options{Threshold: 0.4},
+			}
+
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeTrue())
+
+			err = os.Remove("test/Maildir/.Junk/cur/1600000000.M1P1.test:2,S")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("moves junk into the configured junk folder", func() {
+			defer os.RemoveAll("test/Maildir/.Spam")
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4, JunkFolder: ".Spam"},
+			}
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c.Destination).Should(Equal("test/Maildir/.Spam/cur/1600000000.M1P1.test:2,S"))
+
+			_, err = os.Stat(c.Destination)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("gives up classifying once the context is done", func() {
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = m.ClassifyContext(ctx, dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(Equal(context.Canceled))
+			Ω(m.Junk).Should(BeFalse())
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("stops reading and leaves the database alone once the context is done", func() {
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4},
+			}
+
+			// the context is done as soon as the mail is read
+			ctx := &expiringContext{Context: context.Background()}
+			_, err = m.ClassifyContext(ctx, dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(Equal(context.Canceled))
+
+			s, err := Statistics(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(s.LastClassified.IsZero()).Should(BeTrue())
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("marks junk as seen and keeps its other flags when moving it", func() {
+			err = os.Rename("test/Maildir/new/1600000000.M1P1.test", "test/Maildir/new/1600000000.M1P1.test:2,F")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test:2,F",
+				Options: Options{Threshold: 0.4},
+			}
+
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeTrue())
+
+			err = os.Remove("test/Maildir/.Junk/cur/1600000000.M1P1.test:2,FS")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("gives junk a new name if its name is taken in the Junk folder", func() {
+			err = ioutil.WriteFile("test/Maildir/.Junk/cur/1600000000.M1P1.test:2,RS", []byte("Subject: other\n\n"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Remove("test/Maildir/.Junk/cur/1600000000.M1P1.test:2,RS")
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4},
+			}
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Remove(c.Destination)
+			Ω(c.Destination).Should(MatchRegexp(`^test/Maildir/\.Junk/cur/\d+\.M\d+P\d+Q\d+\.[^/:]+:2,S$`))
+
+			raw, err := ioutil.ReadFile(c.Destination)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(raw)).Should(Equal("Subject: with\n\n"))
+			raw, err = ioutil.ReadFile("test/Maildir/.Junk/cur/1600000000.M1P1.test:2,RS")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(raw)).Should(Equal("Subject: other\n\n"))
+		})
+
+		It("records the decision in the audit log", func() {
+			defer os.Remove("test/audit.jsonl")
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				DryRun:  true,
+				Options: Options{Threshold: 0.4, AuditLog: "test/audit.jsonl"},
+			}
+
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			raw, err := ioutil.ReadFile("test/audit.jsonl")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(raw)).Should(ContainSubstring(`"key":"1600000000.M1P1.test","probability":0.5,"junk":true}`))
+		})
+
+		It("records why junk could not be moved in the audit log", func() {
+			defer os.Remove("test/audit.jsonl")
+
+			// a file in place of the Junk folder keeps the mail from
+			// being moved
+			err = ioutil.WriteFile("test/Maildir/.Blocked", nil, 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Remove("test/Maildir/.Blocked")
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4, JunkFolder: ".Blocked", AuditLog: "test/audit.jsonl"},
+			}
+
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(HaveOccurred())
+
+			raw, err := ioutil.ReadFile("test/audit.jsonl")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(strings.Count(string(raw), "\n")).Should(Equal(1))
+			Ω(string(raw)).Should(ContainSubstring(`"junk":true,"error":`))
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("weighs in the verdict of an upstream filter if enabled", func() {
+			err = ioutil.WriteFile("test/Maildir/new/1600000000.M1P1.test", []byte("Subject: with\nX-Spam-Flag: YES\n\n"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:    "1600000000.M1P1.test",
+				DryRun: true,
+			}
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeFalse())
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				DryRun:  true,
+				Options: Options{Upstream: true},
+			}
+			_, err = m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeTrue())
+		})
+
+		It("classifies a mail read from a reader without moving it", func() {
+			m = &Mail{
+				Options: Options{Threshold: 0.4},
+			}
+
+			c, err := m.ClassifyReader(dbs["test/Maildir"], strings.NewReader("Subject: with\n\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c).Should(Equal(Classification{
+				Probability: 0.5,
+				Junk:        true,
+			}))
+			Ω(m.Subject).Should(BeNil())
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("classifies a mail read from a reader with the default options", func() {
+			c, err := ClassifyReader(dbs["test/Maildir"], strings.NewReader("Subject: with\n\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c).Should(Equal(Classification{
+				Probability: 0.5,
+			}))
+		})
+
+		It("leaves mails alone that have already been seen", func() {
+			err = os.Rename("test/Maildir/new/1600000000.M1P1.test", "test/Maildir/new/1600000000.M1P1.test:2,S")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test:2,S",
+				Options: Options{Threshold: 0.4},
+			}
+			Ω(m.Flags()).Should(Equal("S"))
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeFalse())
+			Ω(c.Skipped).Should(BeTrue())
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test:2,S")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("never files mail of a whitelisted sender as junk", func() {
+			err = ioutil.WriteFile("test/Maildir/new/1600000000.M1P1.test", []byte("From: News <news@lists.example.org>\nSubject: with\n\n"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4, Whitelist: SenderList{"example.org"}},
+			}
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeFalse())
+			Ω(c).Should(Equal(Classification{Rule: "example.org", Sender: "news@lists.example.org"}))
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("always files mail of a blacklisted sender as junk", func() {
+			err = ioutil.WriteFile("test/Maildir/new/1600000000.M1P1.test", []byte("From: Offers <offers@mail.example.net>\nSubject: localbase\n\n"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				DryRun:  true,
+				Options: Options{Blacklist: SenderList{"*.example.net"}},
+			}
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeTrue())
+			Ω(c).Should(Equal(Classification{
+				Probability: 1,
+				Junk:        true,
+				Rule:        "*.example.net",
+				Destination: "test/Maildir/.Junk/cur/1600000000.M1P1.test:2,S",
+				Sender:      "offers@mail.example.net",
+			}))
+		})
+
+		It("leaves junk in new while too few mails have been learned", func() {
+			m = &Mail{
+				Key:     "1600000000.M1P1.test",
+				Options: Options{Threshold: 0.4, MinTraining: 2},
+			}
+
+			c, err := m.Classify(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(m.Junk).Should(BeFalse())
+			Ω(c).Should(Equal(Classification{
+				Probability: 0.5,
+				Untrained:   true,
+			}))
+
+			_, err = os.Stat("test/Maildir/new/1600000000.M1P1.test")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("Weigh the words of a mail by where they appear", func() {
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = SetMailCount(dbs["test/Maildir"], 10, 10)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "subj:cheap", 3, 6)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "hello", 9, 1)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		classify := func(o Options) float64 {
+			m := &Mail{Options: o}
+			c, err := m.ClassifyReader(dbs["test/Maildir"], strings.NewReader("Subject: cheap\n\nhello\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			return c.Probability
+		}
+
+		It("scores all words alike by default", func() {
+			Ω(classify(Options{})).Should(BeNumerically("~", 0.5135, 0.0001))
+			Ω(classify(Options{SubjectWeight: 1, FromWeight: 1, BodyWeight: 1})).Should(Equal(classify(Options{})))
+			Ω(classify(Options{Method: MethodFisher, SubjectWeight: 1, BodyWeight: 1})).Should(Equal(classify(Options{Method: MethodFisher})))
+		})
+
+		It("weighs the words of the subject and of the body as configured", func() {
+			prob := classify(Options{})
+			Ω(classify(Options{SubjectWeight: 5})).Should(BeNumerically("~", 0.6276, 0.0001))
+			Ω(classify(Options{BodyWeight: 3})).Should(BeNumerically("<", prob))
+
+			prob = classify(Options{Method: MethodFisher})
+			Ω(classify(Options{Method: MethodFisher, SubjectWeight: 3})).Should(BeNumerically(">", prob))
+		})
+	})
 })
@@ -0,0 +1,113 @@
+package sisyphus
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrLocked is returned when a database is held open by another process,
+// e.g. a running sisyphus daemon.
+var ErrLocked = errors.New("database is in use by another process")
+
+// lockTimeout is the time to wait for another process to release a database
+const lockTimeout = time.Second
+
+// Compact rewrites the database of a maildir into a fresh file without free
+// pages and atomically replaces the old file with it. As BoltDB files never
+// shrink, this reclaims the space left over by learning and unlearning. It
+// returns ErrLocked if the database is in use.
+func Compact(m Maildir) (err error) {
+	return CompactFile(m.DatabasePath())
+}
+
+// CompactFile compacts the database at path like Compact, e.g. a database
+// shared among maildirs.
+func CompactFile(path string) (err error) {
+
+	_, err = os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	src, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:  lockTimeout,
+		ReadOnly: true,
+	})
+	if err == bolt.ErrTimeout {
+		return ErrLocked
+	}
+	if err != nil {
+		return err
+	}
+
+	// remove leftovers of an interrupted compaction
+	tmp := path + ".compact"
+	os.Remove(tmp)
+
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+
+				return copyBucket(b, nb)
+			})
+		})
+	})
+	dstErr := dst.Close()
+	srcErr := src.Close()
+	if err == nil {
+		err = dstErr
+	}
+	if err == nil {
+		err = srcErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"file": path,
+	}).Info("Database compacted")
+
+	return nil
+}
+
+// copyBucket copies all keys and nested buckets of src into dst
+func copyBucket(src, dst *bolt.Bucket) error {
+	// keys are copied in order, so pages can be filled completely
+	dst.FillPercent = 1.0
+
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+
+		return copyBucket(src.Bucket(k), nb)
+	})
+}
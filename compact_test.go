@@ -0,0 +1,63 @@
+package sisyphus_test
+
+import (
+	"os"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compact", func() {
+	Context("Compact a database", func() {
+
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Compact a closed database and check that everything learned is kept", func() {
+			gTotal, jTotal, gWords, jWords := Info(dbs["test/Maildir"])
+			CloseDatabases(dbs)
+
+			err = Compact("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = os.Stat("test/Maildir/sisyphus.db.compact")
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+
+			g, j, gW, jW := Info(dbs["test/Maildir"])
+			Ω(g).Should(Equal(gTotal))
+			Ω(j).Should(Equal(jTotal))
+			Ω(gW).Should(Equal(gWords))
+			Ω(jW).Should(Equal(jWords))
+
+			learned, err := m.Learned(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(learned).Should(BeTrue())
+		})
+
+		It("Refuse to compact a database in use", func() {
+			defer CloseDatabases(dbs)
+
+			err = Compact("test/Maildir")
+			Ω(err).Should(Equal(ErrLocked))
+		})
+	})
+})
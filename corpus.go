@@ -0,0 +1,149 @@
+package sisyphus
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultCorpusVocabulary and DefaultCorpusWords are the number of words of
+// each class and of the body of each mail of a Corpus if no other numbers are
+// configured.
+const (
+	DefaultCorpusVocabulary = 500
+	DefaultCorpusWords      = 100
+)
+
+// ErrCorpusOverlap is returned when generating a corpus whose overlap does not
+// lie within [0,1].
+var ErrCorpusOverlap = errors.New("overlap of the vocabularies must lie within [0,1]")
+
+// Corpus describes a synthetic corpus of labeled mails made up of random
+// words, e.g. for reproducible benchmarks and tests of learning and
+// classification. The zero value generates no mails.
+type Corpus struct {
+	// Good and Junk are the numbers of good and junk mails.
+	Good, Junk int
+	// Vocabulary is the number of words each class draws its mails from.
+	// Zero selects DefaultCorpusVocabulary.
+	Vocabulary int
+	// Overlap is the share of the vocabulary both classes have in common,
+	// within [0,1]: the higher, the harder it is to tell them apart.
+	Overlap float64
+	// Words is the number of words of the body of each mail. Zero selects
+	// DefaultCorpusWords.
+	Words int
+	// Seed seeds the random choice of words, so that equal seeds generate
+	// equal corpora.
+	Seed int64
+}
+
+// corpusEpoch is the time the mails of a corpus are dated from, so that equal
+// seeds generate equal mails
+var corpusEpoch = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Generate writes the mails of the corpus into the maildir, creating its
+// directories if required: the good mails into its cur directory, the junk
+// into the cur directory of its junk folder, i.e. where Index finds them
+// labeled. It returns the keys of the mails written.
+func (c Corpus) Generate(d Maildir) (keys []string, err error) {
+	if c.Overlap < 0 || c.Overlap > 1 {
+		return keys, ErrCorpusOverlap
+	}
+	err = d.CreateDirs()
+	if err != nil {
+		return keys, err
+	}
+
+	r := rand.New(rand.NewSource(c.Seed))
+	size := c.Vocabulary
+	if size <= 0 {
+		size = DefaultCorpusVocabulary
+	}
+	shared := int(c.Overlap * float64(size))
+	words := randomWords(r, 2*size-shared)
+	vocabulary := map[bool][]string{
+		false: words[:size],
+		true:  words[size-shared:],
+	}
+	domains := map[bool][]string{
+		false: randomWords(r, 5),
+		true:  randomWords(r, 50),
+	}
+
+	for i := 0; i < c.Good+c.Junk; i++ {
+		junk := i >= c.Good
+		key := fmt.Sprintf("%d.M%dP%d.corpus", corpusEpoch.Unix()+int64(i), i, c.Seed)
+		dir := filepath.Join(string(d), "cur")
+		if junk {
+			dir = filepath.Join(string(d), DefaultJunkFolder, "cur")
+		}
+
+		raw := c.mail(r, i, vocabulary[junk], domains[junk])
+		err = ioutil.WriteFile(filepath.Join(dir, key+":2,S"), []byte(raw), 0600)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// mail returns the i-th raw mail of the corpus, made up of words of the
+// vocabulary and sent from one of the domains
+func (c Corpus) mail(r *rand.Rand, i int, vocabulary, domains []string) string {
+	pick := func(n int) []string {
+		w := make([]string, n)
+		for j := range w {
+			w[j] = vocabulary[r.Intn(len(vocabulary))]
+		}
+		return w
+	}
+
+	n := c.Words
+	if n <= 0 {
+		n = DefaultCorpusWords
+	}
+	var body []string
+	for words := pick(n); len(words) > 0; {
+		line := words
+		if len(line) > 10 {
+			line = line[:10]
+		}
+		body = append(body, strings.Join(line, " "))
+		words = words[len(line):]
+	}
+
+	h := []string{
+		"From: " + pick(1)[0] + "@" + domains[r.Intn(len(domains))] + ".example",
+		"To: user@example.org",
+		"Subject: " + strings.Join(pick(3+r.Intn(4)), " "),
+		"Date: " + corpusEpoch.Add(time.Duration(i)*time.Minute).Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%d.%d@corpus.example>", c.Seed, i),
+	}
+
+	return strings.Join(h, "\n") + "\n\n" + strings.Join(body, "\n") + "\n"
+}
+
+// randomWords returns n distinct random words of 4 to 10 lowercase letters,
+// i.e. of the lengths counted by default
+func randomWords(r *rand.Rand, n int) (words []string) {
+	seen := make(map[string]bool, n)
+	for len(words) < n {
+		b := make([]byte, 4+r.Intn(7))
+		for i := range b {
+			b[i] = byte('a' + r.Intn(26))
+		}
+		if w := string(b); !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+
+	return words
+}
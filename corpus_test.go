@@ -0,0 +1,103 @@
+package sisyphus_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Corpus", func() {
+	Context("Generate a synthetic corpus", func() {
+		AfterEach(func() {
+			err = os.RemoveAll("test/corpus")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = os.RemoveAll("test/corpus2")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Write labeled mails where the index finds them", func() {
+			keys, err := Corpus{Good: 3, Junk: 2, Seed: 1}.Generate("test/corpus")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(keys).Should(HaveLen(5))
+
+			mails, err := Maildir("test/corpus").Index()
+			Ω(err).ShouldNot(HaveOccurred())
+			var junk int
+			for _, m := range mails {
+				if m.Junk {
+					junk++
+				}
+			}
+			Ω(mails).Should(HaveLen(5))
+			Ω(junk).Should(Equal(2))
+
+			m := Mail{Key: keys[4], Junk: true}
+			err = m.Load("test/corpus")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Subject).ShouldNot(BeEmpty())
+			Ω(m.Header.Get("From")).Should(HaveSuffix(".example"))
+		})
+
+		It("Generate equal corpora from equal seeds", func() {
+			keys, err := Corpus{Good: 2, Junk: 2, Seed: 7}.Generate("test/corpus")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = Corpus{Good: 2, Junk: 2, Seed: 7}.Generate("test/corpus2")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for i, key := range keys {
+				dir := "cur"
+				if i >= 2 {
+					dir = ".Junk/cur"
+				}
+				a, err := ioutil.ReadFile(filepath.Join("test/corpus", dir, key+":2,S"))
+				Ω(err).ShouldNot(HaveOccurred())
+				b, err := ioutil.ReadFile(filepath.Join("test/corpus2", dir, key+":2,S"))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(a).Should(Equal(b))
+			}
+		})
+
+		It("Tell the classes of a corpus without overlap apart", func() {
+			_, err := Corpus{Good: 20, Junk: 20, Vocabulary: 50, Words: 20, Seed: 3}.Generate("test/corpus")
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = Corpus{Good: 1, Junk: 1, Vocabulary: 50, Words: 20, Seed: 3}.Generate("test/corpus2")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			dbs, err := LoadDatabases([]Maildir{"test/corpus"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+			mails, err := Maildir("test/corpus").Index()
+			Ω(err).ShouldNot(HaveOccurred())
+			var batch []Mail
+			for _, m := range mails {
+				batch = append(batch, *m)
+			}
+			err = LearnBatch(dbs["test/corpus"], "test/corpus", batch)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// corpora of the same seed and size of vocabulary draw from
+			// the same words
+			mails, err = Maildir("test/corpus2").Index()
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, m := range mails {
+				err = m.Load("test/corpus2")
+				Ω(err).ShouldNot(HaveOccurred())
+				err = m.Clean()
+				Ω(err).ShouldNot(HaveOccurred())
+				list, err := m.Wordlist()
+				Ω(err).ShouldNot(HaveOccurred())
+				verdict, _, err := Junk(dbs["test/corpus"], list)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(verdict).Should(Equal(m.Junk))
+			}
+
+			_, err = Corpus{Overlap: 2}.Generate("test/corpus")
+			Ω(err).Should(Equal(ErrCorpusOverlap))
+		})
+	})
+})
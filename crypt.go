@@ -0,0 +1,182 @@
+package sisyphus
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrEncrypted is returned when opening an encrypted database without
+	// DatabaseKey.
+	ErrEncrypted = errors.New("database is encrypted, but no key is given")
+	// ErrDatabaseKey is returned when a database is encrypted with another
+	// key than DatabaseKey.
+	ErrDatabaseKey = errors.New("database is encrypted with another key")
+	// ErrNotEncrypted is returned when a database that already holds words
+	// in the clear is opened with DatabaseKey.
+	ErrNotEncrypted = errors.New("database holds words that are not encrypted")
+)
+
+// DatabaseKey, if set, is the key the words learned are encrypted with in all
+// databases, so that the tokens of senders and subjects cannot be read from
+// the files, e.g. on a shared host. Encryption is deterministic, such that
+// words can still be looked up: equal words remain equal. The counts of the
+// words and the keys of the mails learned are not encrypted. A key should be
+// long and random, and must be set before a database is opened.
+var DatabaseKey []byte
+
+// wordCipher encrypts words with the subkeys derived from a DatabaseKey
+type wordCipher struct {
+	key   string
+	mac   []byte
+	check []byte
+	aead  cipher.AEAD
+}
+
+var (
+	cipherMu sync.Mutex
+	cached   *wordCipher
+)
+
+// currentCipher returns the cipher of DatabaseKey, or nil if it is not set
+func currentCipher() *wordCipher {
+	if len(DatabaseKey) == 0 {
+		return nil
+	}
+
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+	if cached != nil && cached.key == string(DatabaseKey) {
+		return cached
+	}
+
+	block, err := aes.NewCipher(derive(DatabaseKey, "sisyphus word encryption"))
+	if err != nil {
+		panic(err) // a derived key always has a valid size
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	mac := derive(DatabaseKey, "sisyphus word nonce")
+	cached = &wordCipher{
+		key:   string(DatabaseKey),
+		mac:   mac,
+		check: derive(mac, "sisyphus key check"),
+		aead:  aead,
+	}
+
+	return cached
+}
+
+// derive derives a 256 bit subkey for the given purpose from key
+func derive(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose))
+
+	return h.Sum(nil)
+}
+
+// wordKey returns the key a word is stored under. With DatabaseKey, this is
+// the word encrypted with a nonce derived from the word itself, so that
+// encrypting it again yields the same key.
+func wordKey(word string) string {
+	c := currentCipher()
+	if c == nil {
+		return word
+	}
+
+	nonce := derive(c.mac, word)[:c.aead.NonceSize()]
+
+	return string(c.aead.Seal(nonce, nonce, []byte(word), nil))
+}
+
+// wordOf returns the word stored under key, see wordKey
+func wordOf(key string) (string, error) {
+	c := currentCipher()
+	if c == nil {
+		return key, nil
+	}
+
+	n := c.aead.NonceSize()
+	if len(key) < n {
+		return "", ErrDatabaseKey
+	}
+	word, err := c.aead.Open(nil, []byte(key[:n]), []byte(key[n:]), nil)
+	if err != nil {
+		return "", ErrDatabaseKey
+	}
+
+	return string(word), nil
+}
+
+// checkKey verifies that the database is encrypted with DatabaseKey, or not
+// at all without one. A new database opened with DatabaseKey is marked as
+// encrypted, unless record is false, e.g. for a backup, which must not be
+// changed.
+func checkKey(db *bolt.DB, record bool) error {
+	c := currentCipher()
+
+	var check []byte
+	var words bool
+	err := db.View(func(tx *bolt.Tx) error {
+		check = get(tx.Bucket([]byte("Meta")), "KeyCheck")
+		for _, class := range []string{"Good", "Junk"} {
+			b := bucket(tx, "Wordlists", class)
+			if b != nil {
+				k, _ := b.Cursor().First()
+				words = words || k != nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == nil && check == nil:
+		return nil
+	case c == nil:
+		return ErrEncrypted
+	case check != nil && !hmac.Equal(check, c.check):
+		return ErrDatabaseKey
+	case check != nil:
+		return nil
+	case words:
+		return ErrNotEncrypted
+	case !record || db.IsReadOnly():
+		return nil
+	}
+
+	return db.Update(setKeyCheck)
+}
+
+// setKeyCheck marks the database as encrypted with DatabaseKey, if set
+func setKeyCheck(tx *bolt.Tx) error {
+	c := currentCipher()
+	if c == nil {
+		return nil
+	}
+
+	b, err := metaBucket(tx)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte("KeyCheck"), c.check)
+}
+
+// sameKey reports whether two databases are encrypted with the same key, or
+// both not at all
+func sameKey(a, b *bolt.Tx) bool {
+	return bytes.Equal(get(a.Bucket([]byte("Meta")), "KeyCheck"),
+		get(b.Bucket([]byte("Meta")), "KeyCheck"))
+}
@@ -0,0 +1,106 @@
+package sisyphus_test
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/boltdb/bolt"
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+	Context("Encrypt the words of a database", func() {
+
+		BeforeEach(func() {
+			DatabaseKey = []byte("a long and random key")
+
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = SetMailCount(dbs["test/Maildir"], 10, 10)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "cheap", 1, 3)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "offer", 2, 5)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			DatabaseKey = nil
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Keep the words out of the file, but classify and export them as usual", func() {
+			err = dbs["test/Maildir"].View(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("Wordlists")).Bucket([]byte("Junk"))
+				Ω(b.Stats().KeyN).Should(Equal(2))
+				Ω(b.Get([]byte("cheap"))).Should(BeNil())
+				return nil
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			subject := "cheap offer"
+			_, prob, err := Explain(dbs["test/Maildir"], Mail{Subject: &subject})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically(">", 0.5))
+
+			var out bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(`word,good_count,junk_count
+,10,10
+cheap,1,3
+offer,2,5
+`))
+		})
+
+		It("Refuse to open the database without the key or with another one", func() {
+			CloseDatabases(dbs)
+
+			DatabaseKey = nil
+			_, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).Should(Equal(ErrEncrypted))
+
+			DatabaseKey = []byte("another key")
+			_, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).Should(Equal(ErrDatabaseKey))
+
+			DatabaseKey = []byte("a long and random key")
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Refuse to encrypt a database holding words in the clear", func() {
+			CloseDatabases(dbs)
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			DatabaseKey = nil
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "cheap", 1, 3)
+			Ω(err).ShouldNot(HaveOccurred())
+			CloseDatabases(dbs)
+
+			DatabaseKey = []byte("a long and random key")
+			_, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).Should(Equal(ErrNotEncrypted))
+
+			// a database without words can be encrypted after all
+			DatabaseKey = nil
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(Reset(dbs["test/Maildir"])).Should(Succeed())
+			CloseDatabases(dbs)
+
+			DatabaseKey = []byte("a long and random key")
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+})
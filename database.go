@@ -1,72 +1,486 @@
 package sisyphus
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/boltdb/bolt"
+	"github.com/retailnext/hllpp"
 )
 
+// DatabaseDir, if set, is the directory the databases of all maildirs and
+// their backups are kept in, rather than in the maildirs themselves, where
+// they may confuse IMAP servers scanning them. It must be set before a
+// database is opened.
+var DatabaseDir string
+
+// BackupDir, if set, is the directory the backups of the databases of all
+// maildirs are written to, e.g. on another disk. It must be set before a
+// backup is written.
+var BackupDir string
+
+// DatabasePath returns the path of the maildir's database file. Within
+// DatabaseDir, it is named after the maildir, see databaseName.
+func (d Maildir) DatabasePath() string {
+	if DatabaseDir == "" {
+		return filepath.Join(string(d), "sisyphus.db")
+	}
+
+	return filepath.Join(DatabaseDir, d.databaseName())
+}
+
+// BackupPath returns the path of the backup of the maildir's database file,
+// which lies next to the database unless BackupDir is set. A compressed
+// backup, see CompressBackups, has the suffix ".gz".
+func (d Maildir) BackupPath() string {
+	if CompressBackups {
+		return d.backupBase() + ".gz"
+	}
+
+	return d.backupBase()
+}
+
+// LatestBackup returns the path of the latest backup of the maildir's
+// database, i.e. the newer of its compressed and its uncompressed backup, so
+// that it is found even after CompressBackups has been changed. It returns
+// BackupPath if there is no backup at all.
+func (d Maildir) LatestBackup() string {
+	path := d.BackupPath()
+	latest, err := os.Stat(path)
+	for _, p := range []string{d.backupBase(), d.backupBase() + ".gz"} {
+		info, e := os.Stat(p)
+		if e == nil && (err != nil || info.ModTime().After(latest.ModTime())) {
+			path, latest, err = p, info, nil
+		}
+	}
+
+	return path
+}
+
+// backupBase returns the path of the uncompressed backup of the maildir's
+// database file, which the paths of all its backups start with
+func (d Maildir) backupBase() string {
+	if BackupDir == "" {
+		return d.DatabasePath() + ".backup"
+	}
+
+	return filepath.Join(BackupDir, d.databaseName()+".backup")
+}
+
+// databaseName names the database of a maildir kept in a directory of
+// databases after the maildir, e.g. Maildir-3f2a9c1e.db for
+// /home/JohnDoe/Maildir, such that maildirs of the same name do not share it.
+func (d Maildir) databaseName() string {
+	dir, err := filepath.Abs(string(d))
+	if err != nil {
+		dir = filepath.Clean(string(d))
+	}
+	sum := sha256.Sum256([]byte(dir))
+
+	return fmt.Sprintf("%s-%x.db", filepath.Base(dir), sum[:4])
+}
+
+// HoldsMail reports whether path lies within a cur, new or tmp directory of
+// the maildir or of any of its folders, e.g. .Junk/new, where a file would be
+// mistaken for a mail
+func (d Maildir) HoldsMail(path string) bool {
+	dir, err := filepath.Abs(string(d))
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		switch part {
+		case "cur", "new", "tmp":
+			return true
+		}
+	}
+
+	return false
+}
+
+// lockPoll is how long opening a database waits for the lock of another
+// process at a time before checking whether it has been cancelled
+const lockPoll = 100 * time.Millisecond
+
 // openDB creates and opens a new database and its respective buckets (if required)
-func openDB(m Maildir) (db *bolt.DB, err error) {
+func openDB(ctx context.Context, m Maildir) (db *bolt.DB, err error) {
 
 	log.WithFields(log.Fields{
 		"dir": string(m),
 	}).Info("Loading database")
+
+	if DatabaseDir != "" {
+		err = os.MkdirAll(DatabaseDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return openDBFile(ctx, m.DatabasePath())
+}
+
+// openDBFile creates and opens the database at path and its respective
+// buckets (if required), upgrading the layout of an older database
+func openDBFile(ctx context.Context, path string) (db *bolt.DB, err error) {
+
 	// Open the sisyphus.db data file in your current directory.
 	// It will be created if it doesn't exist.
-	db, err = bolt.Open(filepath.Join(string(m), "sisyphus.db"), 0600, nil)
+	db, err = openBolt(ctx, path)
 	if err != nil {
 		return db, err
 	}
 
-	// Create DB bucket for the map of processed e-mail IDs
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte("Statistics"))
-		return err
-	})
+	err = Migrate(db)
+	if err == nil {
+		err = checkKey(db, true)
+	}
 	if err != nil {
-		return db, err
+		db.Close()
+		return nil, err
 	}
 
-	// Create DB bucket for word lists
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte("Wordlists"))
-		return err
+	return db, nil
+}
+
+// Reset clears all learned information from a database, i.e. the word lists
+// and statistics, but leaves the database file itself in place.
+func Reset(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"Statistics", "Wordlists", "Unlearned", "Learned", "Decayed", "Meta"} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		err = setVersion(tx, SchemaVersion)
+		if err != nil {
+			return err
+		}
+
+		return setKeyCheck(tx)
 	})
+}
+
+// bucket returns the (nested) bucket at the given path, or nil if it does not
+// exist (e.g. in an empty backup or a backup of an older database).
+func bucket(tx *bolt.Tx, path ...string) *bolt.Bucket {
+	b := tx.Bucket([]byte(path[0]))
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(name))
+	}
+
+	return b
+}
+
+// get returns the value stored under key, or nil if the bucket does not exist.
+func get(b *bolt.Bucket, key string) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return b.Get([]byte(key))
+}
+
+// count returns the number of distinct mails in a serialized counter
+func count(raw []byte) (n uint64, err error) {
+	if len(raw) == 0 {
+		return 0, nil
+	}
+
+	counter, err := hllpp.Unmarshal(raw)
 	if err != nil {
-		return db, err
+		return 0, err
 	}
 
-	// Create DB bucket for Junk inside bucket Wordlists
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Wordlists"))
-		_, err = b.CreateBucketIfNotExists([]byte("Junk"))
-		return err
-	})
+	return counter.Count(), nil
+}
+
+// netCount returns the number of learned mails less the number of mails that
+// have been unlearned since. It never drops below zero.
+func netCount(learned, unlearned []byte) (n uint64, err error) {
+	l, err := count(learned)
 	if err != nil {
-		return db, err
+		return 0, err
+	}
+	u, err := count(unlearned)
+	if err != nil {
+		return 0, err
+	}
+	if u > l {
+		return 0, nil
 	}
 
-	// Create DB bucket for Good inside bucket Wordlists
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Wordlists"))
-		_, err = b.CreateBucketIfNotExists([]byte("Good"))
-		return err
-	})
+	return l - u, nil
+}
 
-	return db, err
+// effective returns the number of learned mails less the number of mails that
+// have been unlearned and less the share of them that has decayed since, see
+// Decay. It never drops below zero.
+func effective(learned, unlearned, decayed []byte) (n float64, err error) {
+	net, err := netCount(learned, unlearned)
+	if err != nil {
+		return 0, err
+	}
+
+	n = float64(net) - decodeFloat(decayed)
+	if n < 0 {
+		return 0, nil
+	}
+
+	return n, nil
+}
+
+// decodeFloat returns a float stored by encodeFloat, or zero if raw is empty
+func decodeFloat(raw []byte) float64 {
+	if len(raw) != 8 {
+		return 0
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(raw))
+}
+
+// encodeFloat returns the binary representation of f to be stored
+func encodeFloat(f float64) []byte {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, math.Float64bits(f))
+
+	return raw
+}
+
+// contains reports whether a mail key has been added to a serialized counter.
+// As counters are HyperLogLog sketches, this is an estimate: the key is
+// considered present if adding it does not change the count.
+func contains(raw []byte, key string) (ok bool, err error) {
+	if len(raw) == 0 {
+		return false, nil
+	}
+
+	counter, err := hllpp.Unmarshal(raw)
+	if err != nil {
+		return false, err
+	}
+	n := counter.Count()
+	counter.Add([]byte(key))
+
+	return counter.Count() == n, nil
+}
+
+// add adds a mail key to the counter stored under name in bucket b
+func add(b *bolt.Bucket, name, key string) (err error) {
+	raw := b.Get([]byte(name))
+	var counter *hllpp.HLLPP
+	if len(raw) == 0 {
+		counter = hllpp.New()
+	} else {
+		counter, err = hllpp.Unmarshal(raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	counter.Add([]byte(key))
+
+	return b.Put([]byte(name), counter.Marshal())
+}
+
+// openBolt opens the database file at path, waiting for as long as another
+// process holds it, until ctx is done
+func openBolt(ctx context.Context, path string) (*bolt.DB, error) {
+	for {
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: lockPoll})
+		if err != bolt.ErrTimeout {
+			return db, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
 }
 
 // LoadDatabases loads all databases from a given slice of Maildirs
 func LoadDatabases(d []Maildir) (databases map[Maildir]*bolt.DB, err error) {
+	return LoadDatabasesContext(context.Background(), d)
+}
+
+// LoadDatabasesContext is like LoadDatabases, but gives up once ctx is done,
+// e.g. while waiting for a database held by another process, and returns
+// ctx.Err() along with the databases loaded until then.
+func LoadDatabasesContext(ctx context.Context, d []Maildir) (databases map[Maildir]*bolt.DB, err error) {
 	databases = make(map[Maildir]*bolt.DB)
 	for _, val := range d {
-		databases[val], err = openDB(val)
+		err = ctx.Err()
+		if err != nil {
+			return databases, err
+		}
+
+		db, err := openDB(ctx, val)
 		if err != nil {
 			return databases, err
 		}
+		databases[val] = db
+	}
+
+	log.Info("All databases loaded")
+
+	return databases, nil
+}
+
+// LoadAvailableDatabases is like LoadDatabases, but skips the Maildirs whose
+// database cannot be opened, e.g. because it is corrupt or held by another
+// process, with an error logged, instead of giving up on all of them. A
+// database in use is waited for no longer than a second. If restore is true,
+// a database that cannot be read is replaced by its backup, see RestoreBackup,
+// and opened again. It returns the errors of the Maildirs skipped.
+func LoadAvailableDatabases(d []Maildir, restore bool) (databases map[Maildir]*bolt.DB, failed map[Maildir]error) {
+	databases = make(map[Maildir]*bolt.DB)
+	failed = make(map[Maildir]error)
+	for _, val := range d {
+		db, err := openAvailableDB(val)
+		if err != nil && restore && restorable(err) {
+			log.WithFields(log.Fields{
+				"err": err,
+				"dir": string(val),
+			}).Warning("Cannot load database, restoring its backup")
+			err = RestoreBackup(val)
+			if err == nil {
+				db, err = openAvailableDB(val)
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"dir": string(val),
+			}).Error("Cannot load database, skipping maildir")
+			failed[val] = err
+			continue
+		}
+		databases[val] = db
+	}
+
+	if len(failed) == 0 {
+		log.Info("All databases loaded")
+	}
+
+	return databases, failed
+}
+
+// openAvailableDB opens the database of Maildir m like openDB, but returns
+// ErrLocked if another process holds it for longer than lockTimeout
+func openAvailableDB(m Maildir) (*bolt.DB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+
+	db, err := openDB(ctx, m)
+	if err == context.DeadlineExceeded {
+		return nil, ErrLocked
+	}
+
+	return db, err
+}
+
+// restorable reports whether a database that could not be opened with err
+// may be replaced by its backup: not if it is in use, encrypted with another
+// key or written by a newer version of sisyphus, which its backup would be
+// just as well
+func restorable(err error) bool {
+	switch err {
+	case ErrLocked, ErrEncrypted, ErrDatabaseKey, ErrNotEncrypted, ErrSchemaVersion:
+		return false
+	}
+
+	return true
+}
+
+// OpenDatabase opens the database at path, which needs not belong to any
+// maildir, e.g. one trained from folders of known mails. It is created along
+// with its buckets if required.
+func OpenDatabase(path string) (*bolt.DB, error) {
+
+	log.WithFields(log.Fields{
+		"file": path,
+	}).Info("Loading database")
+
+	return openDBFile(context.Background(), path)
+}
+
+// OpenTempDatabase opens a new, empty database in a temporary file, e.g. for
+// tests and benchmarks of learning and classification without any maildir.
+// It is not synced to disk, so it must be closed by CloseTempDatabase, which
+// removes the file. A bolt database opened otherwise can be prepared with
+// Migrate instead.
+func OpenTempDatabase() (*bolt.DB, error) {
+	f, err := ioutil.TempFile("", "sisyphus-temp")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	db, err := openDBFile(context.Background(), f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	db.NoSync = true
+
+	return db, nil
+}
+
+// CloseTempDatabase closes a database opened by OpenTempDatabase and removes
+// its file
+func CloseTempDatabase(db *bolt.DB) error {
+	path := db.Path()
+	err := db.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// LoadSharedDatabase loads the database at path and shares it among a given
+// slice of Maildirs, so that what is learned from one of them helps in
+// classifying the mails of all the others. The file is opened only once.
+func LoadSharedDatabase(d []Maildir, path string) (databases map[Maildir]*bolt.DB, err error) {
+	databases = make(map[Maildir]*bolt.DB)
+
+	log.WithFields(log.Fields{
+		"file": path,
+	}).Info("Loading shared database")
+
+	db, err := openDBFile(context.Background(), path)
+	if err != nil {
+		return databases, err
+	}
+	for _, val := range d {
+		databases[val] = db
 	}
 
 	log.Info("All databases loaded")
@@ -78,7 +492,16 @@ func LoadDatabases(d []Maildir) (databases map[Maildir]*bolt.DB, err error) {
 func LoadBackupDatabases(d []Maildir) (databases map[Maildir]*bolt.DB, err error) {
 	databases = make(map[Maildir]*bolt.DB)
 	for _, val := range d {
-		databases[val], err = bolt.Open(filepath.Join(string(val), "sisyphus.db.backup"), 0600, nil)
+		path := val.LatestBackup()
+		if compressed(path) {
+			databases[val], err = openBackupFile(path)
+		} else {
+			databases[val], err = bolt.Open(path, 0600, nil)
+		}
+		if err != nil {
+			return databases, err
+		}
+		err = checkKey(databases[val], false)
 		if err != nil {
 			return databases, err
 		}
@@ -89,13 +512,110 @@ func LoadBackupDatabases(d []Maildir) (databases map[Maildir]*bolt.DB, err error
 	return databases, nil
 }
 
-// CloseDatabases closes all databases from a given slice of Maildirs
+// OpenReadOnly opens the existing database at path read-only, so that any
+// number of processes may read it at the same time. Its layout is checked, but
+// not upgraded, see Migrate. It returns ErrLocked if another process, e.g. a
+// running sisyphus, has opened the database for writing. A compressed backup
+// is opened, too, see CompressBackups.
+func OpenReadOnly(path string) (*bolt.DB, error) {
+	// bolt would create a missing database, even if opened read-only
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openBackupFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = Migrate(db)
+	if err == nil {
+		err = checkKey(db, false)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// LoadReadOnlyDatabases opens the databases of a given slice of Maildirs
+// read-only, e.g. to show statistics. Bolt keeps even readers out of a
+// database opened for writing, so the backup is opened instead of a database
+// in use, see OpenReadOnly, which is as recent as the last backup.
+func LoadReadOnlyDatabases(d []Maildir) (databases map[Maildir]*bolt.DB, err error) {
+	databases = make(map[Maildir]*bolt.DB)
+	for _, val := range d {
+		db, err := openReadOnlyOrBackup(val, val.DatabasePath())
+		if err != nil {
+			return databases, err
+		}
+		databases[val] = db
+	}
+
+	log.Info("All databases loaded")
+
+	return databases, nil
+}
+
+// LoadReadOnlySharedDatabase opens the database at path read-only and shares
+// it among a given slice of Maildirs, like LoadSharedDatabase. If it is in
+// use, the backup of the first of the Maildirs, which a shared database is
+// backed up along with, is opened and shared instead, like by
+// LoadReadOnlyDatabases.
+func LoadReadOnlySharedDatabase(d []Maildir, path string) (databases map[Maildir]*bolt.DB, err error) {
+	databases = make(map[Maildir]*bolt.DB)
+
+	db, err := OpenReadOnly(path)
+	if err == ErrLocked && len(d) > 0 {
+		db, err = openReadOnlyOrBackup(d[0], "")
+	}
+	if err != nil {
+		return databases, err
+	}
+	for _, val := range d {
+		databases[val] = db
+	}
+
+	log.Info("All databases loaded")
+
+	return databases, nil
+}
+
+// openReadOnlyOrBackup opens the database at path read-only or, if it is in
+// use or missing, the latest backup of Maildir m, see LatestBackup. An empty
+// path always opens the backup.
+func openReadOnlyOrBackup(m Maildir, path string) (*bolt.DB, error) {
+	if path != "" {
+		db, err := OpenReadOnly(path)
+		if err != ErrLocked && !os.IsNotExist(err) {
+			return db, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"dir": string(m),
+	}).Info("Database is in use or missing, reading its backup")
+
+	return OpenReadOnly(m.LatestBackup())
+}
+
+// CloseDatabases closes all databases from a given slice of Maildirs. A
+// database shared among several Maildirs is closed once.
 func CloseDatabases(databases map[Maildir]*bolt.DB) {
+	closed := make(map[*bolt.DB]bool)
 	for key, val := range databases {
+		if closed[val] {
+			continue
+		}
+		closed[val] = true
+
 		err := val.Close()
 		if err != nil {
 			log.WithFields(log.Fields{
-				"db": filepath.Join(string(key), "sisyphus.db"),
+				"db": key.DatabasePath(),
 			}).Error("Unable to close database")
 		}
 		log.WithFields(log.Fields{
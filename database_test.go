@@ -1,7 +1,11 @@
 package sisyphus_test
 
 import (
+	"context"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	. "github.com/carlostrub/sisyphus"
@@ -50,6 +54,36 @@ var _ = Describe("Database", func() {
 			CloseDatabases(dbs)
 		})
 
+		It("Give up waiting for a database held by another process", func() {
+			dbs, err := LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+
+			other, err := LoadDatabasesContext(ctx, []Maildir{"test/Maildir"})
+			Ω(err).Should(Equal(context.DeadlineExceeded))
+			Ω(other).Should(BeEmpty())
+		})
+
+		It("Skip a maildir whose database is held by another process", func() {
+			err = os.MkdirAll("test/Other", 0700)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll("test/Other")
+
+			dbs, err := LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+
+			other, failed := LoadAvailableDatabases([]Maildir{"test/Maildir", "test/Other"}, true)
+			defer CloseDatabases(other)
+			Ω(failed).Should(HaveLen(1))
+			Ω(failed["test/Maildir"]).Should(Equal(ErrLocked))
+			Ω(other).Should(HaveLen(1))
+			Ω(other).Should(HaveKey(Maildir("test/Other")))
+		})
+
 		It("Closes an open database", func() {
 			dbs, err := LoadDatabases([]Maildir{"test/Maildir"})
 			Ω(err).ShouldNot(HaveOccurred())
@@ -69,5 +103,169 @@ var _ = Describe("Database", func() {
 			Ω(err).Should(HaveOccurred())
 			Ω(n).Should(Equal(4))
 		})
+
+		It("Resets a database", func() {
+			dbs, err := LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m := &Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = Reset(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+
+			gTotal, jTotal, gWords, jWords := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(0)))
+			Ω(jTotal).Should(Equal(uint64(0)))
+			Ω(gWords).Should(Equal(uint64(0)))
+			Ω(jWords).Should(Equal(uint64(0)))
+
+			// the database remains usable
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, jTotal, _, _ = Info(dbs["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(1)))
+
+			CloseDatabases(dbs)
+		})
+	})
+
+	Context("Shared Bolt Database", func() {
+		BeforeEach(func() {
+			err = LoadMaildirs([]Maildir{"test/Maildir2"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			err = os.Remove("test/shared.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			err = os.RemoveAll("test/Maildir2")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Share one database among maildirs", func() {
+			dbs, err := LoadSharedDatabase([]Maildir{"test/Maildir", "test/Maildir2"}, "test/shared.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(dbs["test/Maildir"]).Should(BeIdenticalTo(dbs["test/Maildir2"]))
+
+			_, err = os.Stat("test/Maildir/sisyphus.db")
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+
+			m := &Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, jTotal, _, _ := Info(dbs["test/Maildir2"])
+			Ω(jTotal).Should(Equal(uint64(1)))
+
+			CloseDatabases(dbs)
+		})
+
+		It("Read a shared database in use from the backup of its first maildir", func() {
+			dbs, err := LoadSharedDatabase([]Maildir{"test/Maildir", "test/Maildir2"}, "test/shared.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+			err = Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Remove("test/Maildir/sisyphus.db.backup")
+			defer os.Remove("test/Maildir/sisyphus.db.backup.sha256")
+
+			ro, err := LoadReadOnlySharedDatabase([]Maildir{"test/Maildir", "test/Maildir2"}, "test/shared.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(ro)
+			Ω(ro["test/Maildir"].Path()).Should(Equal("test/Maildir/sisyphus.db.backup"))
+			Ω(ro["test/Maildir2"]).Should(BeIdenticalTo(ro["test/Maildir"]))
+		})
+	})
+
+	Context("Database of no maildir", func() {
+		AfterEach(func() {
+			err = os.Remove("test/trained.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Open a database at any path and learn into it", func() {
+			db, err := OpenDatabase("test/trained.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer db.Close()
+
+			f, err := os.Open("test/Maildir/.Junk/cur/1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730:2,Sa")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer f.Close()
+
+			m := &Mail{
+				Junk:    true,
+				Options: Options{Bigrams: true},
+			}
+			err = m.LearnReader(db, f)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, jTotal, _, _ := Info(db)
+			Ω(jTotal).Should(Equal(uint64(1)))
+		})
+	})
+	Context("Temporary database", func() {
+		It("Learn and classify without any maildir and remove the database when closed", func() {
+			db, err := OpenTempDatabase()
+			Ω(err).ShouldNot(HaveOccurred())
+			path := db.Path()
+
+			junk := &Mail{Junk: true}
+			err = junk.LearnReader(db, strings.NewReader("Subject: cheap pills\n\nbuy cheap pills today\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			good := &Mail{}
+			err = good.LearnReader(db, strings.NewReader("Subject: meeting notes\n\nnotes from today's meeting\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m := &Mail{}
+			c, err := m.ClassifyReader(db, strings.NewReader("Subject: cheap pills\n\ncheap\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c.Junk).Should(BeTrue())
+
+			err = CloseTempDatabase(db)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(path).ShouldNot(BeAnExistingFile())
+		})
+	})
+
+	Context("Databases kept outside of the maildirs", func() {
+		BeforeEach(func() {
+			DatabaseDir = "test/databases"
+		})
+		AfterEach(func() {
+			DatabaseDir = ""
+			err = os.RemoveAll("test/databases")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Load the database of a maildir from the database directory", func() {
+			d := Maildir("test/Maildir")
+			path := d.DatabasePath()
+			Ω(filepath.Dir(path)).Should(Equal("test/databases"))
+			Ω(filepath.Base(path)).Should(MatchRegexp(`^Maildir-[0-9a-f]{8}\.db$`))
+			Ω(d.BackupPath()).Should(Equal(path + ".backup"))
+
+			dbs, err := LoadDatabases([]Maildir{d})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+
+			Ω(path).Should(BeAnExistingFile())
+			Ω("test/Maildir/sisyphus.db").ShouldNot(BeAnExistingFile())
+
+			err = Backup(dbs[d], d)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(d.BackupPath()).Should(BeAnExistingFile())
+		})
+
+		It("Name the databases of maildirs of the same name apart", func() {
+			Ω(Maildir("test/Maildir").DatabasePath()).ShouldNot(Equal(Maildir("test/other/Maildir").DatabasePath()))
+		})
 	})
 })
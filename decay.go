@@ -0,0 +1,134 @@
+package sisyphus
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrDecayFactor is returned when a decay factor does not lie within (0,1).
+var ErrDecayFactor = errors.New("decay factor must lie within (0,1)")
+
+// Decay lets old learning fade, so that the vocabulary of junk may drift. It
+// multiplies the counts of all words and the numbers of learned mails by
+// factor, which must lie within (0,1), such that mails learned afterwards
+// weigh more than those learned before. Words whose counts fall below one in
+// both classes are removed.
+//
+// As the counts are HyperLogLog sketches of mail keys, they cannot be scaled
+// themselves; instead, the decayed share of each count is recorded and
+// subtracted when classifying.
+func Decay(db *bolt.DB, factor float64) (err error) {
+	if factor <= 0 || factor >= 1 {
+		return ErrDecayFactor
+	}
+
+	var pruned int
+	err = db.Update(func(tx *bolt.Tx) error {
+		p := tx.Bucket([]byte("Statistics"))
+		d, err := decayedBucket(tx, "Statistics")
+		if err != nil {
+			return err
+		}
+		for _, class := range []string{"Good", "Junk"} {
+			err = decay(d, class, factor, get(p, "Processed"+class), get(p, "Unlearned"+class))
+			if err != nil {
+				return err
+			}
+		}
+
+		// words below one in both classes are pruned once both are decayed
+		low := make(map[string]int)
+		for _, class := range []string{"Good", "Junk"} {
+			w := bucket(tx, "Wordlists", class)
+			u := bucket(tx, "Unlearned", class)
+			d, err := decayedBucket(tx, class)
+			if err != nil {
+				return err
+			}
+
+			// keys are collected first, as a bucket must not be changed
+			// while iterating over it
+			var words []string
+			err = w.ForEach(func(k, v []byte) error {
+				words = append(words, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, word := range words {
+				err = decay(d, word, factor, get(w, word), get(u, word))
+				if err != nil {
+					return err
+				}
+				n, err := effective(get(w, word), get(u, word), get(d, word))
+				if err != nil {
+					return err
+				}
+				if n < 1 {
+					low[word]++
+				}
+			}
+		}
+
+		for word, classes := range low {
+			// a word learned in one class only is absent from the other
+			inBoth := get(bucket(tx, "Wordlists", "Good"), word) != nil &&
+				get(bucket(tx, "Wordlists", "Junk"), word) != nil
+			if inBoth && classes < 2 {
+				continue
+			}
+
+			_, err = removeWord(tx, word)
+			if err != nil {
+				return err
+			}
+			pruned++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"factor": factor,
+		"pruned": pruned,
+	}).Info("Decayed learned words")
+
+	return nil
+}
+
+// decayedBucket returns the bucket holding the decayed shares of the named
+// bucket, creating it in databases that predate decay
+func decayedBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte("Decayed"))
+	if err != nil {
+		return nil, err
+	}
+
+	return b.CreateBucketIfNotExists([]byte(name))
+}
+
+// decay multiplies the effective count stored under key by factor and
+// records the decayed share in bucket d
+func decay(d *bolt.Bucket, key string, factor float64, learned, unlearned []byte) error {
+	net, err := netCount(learned, unlearned)
+	if err != nil {
+		return err
+	}
+	n, err := effective(learned, unlearned, get(d, key))
+	if err != nil {
+		return err
+	}
+	if n == 0 && len(get(d, key)) == 0 {
+		return nil
+	}
+
+	return d.Put([]byte(key), encodeFloat(float64(net)-n*factor))
+}
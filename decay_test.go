@@ -0,0 +1,94 @@
+package sisyphus_test
+
+import (
+	"math"
+	"os"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Decay", func() {
+	Context("Let learned words fade", func() {
+
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for _, key := range []string{
+				"1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				"1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
+			} {
+				m = &Mail{
+					Key:  key,
+					Junk: true,
+				}
+				err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Prune words that fall below one and keep the others", func() {
+			_, _, gWords, jWords := Info(dbs["test/Maildir"])
+
+			// words of both junk mails are counted twice and are kept
+			err = Decay(dbs["test/Maildir"], 0.6)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, _, g, j := Info(dbs["test/Maildir"])
+			Ω(g).Should(BeNumerically("<", gWords))
+			Ω(j).Should(BeNumerically("<", jWords))
+			Ω(j).Should(BeNumerically(">", 0))
+
+			answer, prob, err := Junk(dbs["test/Maildir"], []string{"from"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(1.0))
+			Ω(answer).Should(BeTrue())
+
+			// "herpes" has been learned from one junk mail only
+			_, prob, err = Junk(dbs["test/Maildir"], []string{"herpes"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(math.IsNaN(prob)).Should(BeTrue())
+		})
+
+		It("Let mails learned afterwards outweigh faded ones", func() {
+			// "with" has been learned from one good and one junk mail
+			_, prob, err := Junk(dbs["test/Maildir"], []string{"with"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically("~", 0.5))
+
+			err = Decay(dbs["test/Maildir"], 0.9)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:  "1488228352.M339670P8269.mail.carlostrub.ch,S=12659,W=12782:2,Sa",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, prob, err = Junk(dbs["test/Maildir"], []string{"with"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(1.0))
+		})
+
+		It("Refuse factors outside of (0,1)", func() {
+			err = Decay(dbs["test/Maildir"], 1.5)
+			Ω(err).Should(Equal(ErrDecayFactor))
+		})
+	})
+})
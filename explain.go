@@ -0,0 +1,190 @@
+package sisyphus
+
+import (
+	"math"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// TokenScore holds the contribution of a single word to the classification of
+// a mail.
+type TokenScore struct {
+	Word string
+	// Good and Junk are the number of good and junk mails the word has been
+	// learned from.
+	Good, Junk uint64
+	// Probability is the probability of a mail containing this word being
+	// junk. It is NaN if the word has never been learned.
+	Probability float64
+}
+
+// confidenceZ is the quantile of the normal distribution the intervals of
+// token scores are computed with, i.e. for 95% confidence
+const confidenceZ = 1.96
+
+// Interval returns the Wilson score interval the junk probability of the word
+// lies within with 95% confidence, given the number of mails it has been
+// learned from. Words learned from only a few mails have wide intervals, such
+// that they can be told from well-supported ones. Both bounds are NaN if the
+// word has never been learned.
+func (t TokenScore) Interval() (low, high float64) {
+	if math.IsNaN(t.Probability) {
+		return math.NaN(), math.NaN()
+	}
+	n := float64(t.Good + t.Junk)
+	if n == 0 {
+		return 0, 1
+	}
+
+	p, z2 := t.Probability, confidenceZ*confidenceZ
+	center := p + z2/(2*n)
+	spread := confidenceZ * math.Sqrt(p*(1-p)/n+z2/(4*n*n))
+	low = math.Max(0, (center-spread)/(1+z2/n))
+	high = math.Min(1, (center+spread)/(1+z2/n))
+
+	return low, high
+}
+
+// contribution returns how far a token pulls the classification away from
+// being undecided; never learned words do not contribute at all.
+func (t TokenScore) contribution() float64 {
+	if math.IsNaN(t.Probability) {
+		return 0
+	}
+
+	return math.Abs(t.Probability - 0.5)
+}
+
+// Explain returns the words of a loaded mail together with their junk
+// probabilities and counts, sorted by their contribution to the final
+// classification, as well as the probability of the mail being junk. The mail
+// itself is left untouched.
+func Explain(db *bolt.DB, m Mail) (scores []TokenScore, prob float64, err error) {
+
+	list, err := m.cleanWordlist()
+	if err != nil {
+		return scores, prob, err
+	}
+
+	for _, val := range list {
+		var gN, jN, g float64
+		gN, jN, err = classificationLikelihoodWordcounts(db, val)
+		if err != nil {
+			return scores, prob, err
+		}
+		g, err = m.classificationWord(db, val)
+		if err != nil {
+			return scores, prob, err
+		}
+
+		scores = append(scores, TokenScore{
+			Word:        val,
+			Good:        uint64(gN),
+			Junk:        uint64(jN),
+			Probability: 1 - g,
+		})
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		ci, cj := scores[i].contribution(), scores[j].contribution()
+		if ci == cj {
+			return scores[i].Word < scores[j].Word
+		}
+		return ci > cj
+	})
+
+	if m.Redact {
+		for i := range scores {
+			scores[i].Word = Redact(scores[i].Word)
+		}
+	}
+
+	_, prob, err = m.junk(db, list, m.upstreamProbabilities()...)
+
+	return scores, prob, err
+}
+
+// TopWords returns the n words most indicative of junk, or of good mails if
+// junk is unset, among those learned from at least min mails, together with
+// their junk probabilities and counts. The words are sorted by how strongly
+// they indicate the class, then by the number of mails they have been learned
+// from. All words are returned if n is not positive.
+func TopWords(db *bolt.DB, o Options, junk bool, n, min int) (scores []TokenScore, err error) {
+
+	// words are collected first, so the probabilities are computed like
+	// for any mail
+	var words []string
+	err = db.View(func(tx *bolt.Tx) error {
+		seen := make(map[string]bool)
+		for _, class := range []string{"Good", "Junk"} {
+			b := bucket(tx, "Wordlists", class)
+			if b == nil {
+				continue
+			}
+			err := b.ForEach(func(k, v []byte) error {
+				word, err := wordOf(string(k))
+				if err != nil {
+					return err
+				}
+				if !seen[word] {
+					seen[word] = true
+					words = append(words, word)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return scores, err
+	}
+
+	for _, word := range words {
+		gN, jN, err := classificationLikelihoodWordcounts(db, word)
+		if err != nil {
+			return scores, err
+		}
+		if gN+jN < float64(min) {
+			continue
+		}
+		g, err := o.classificationWord(db, word)
+		if err != nil {
+			return scores, err
+		}
+		if math.IsNaN(g) {
+			continue
+		}
+
+		scores = append(scores, TokenScore{
+			Word:        word,
+			Good:        uint64(gN),
+			Junk:        uint64(jN),
+			Probability: 1 - g,
+		})
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		pi, pj := scores[i].Probability, scores[j].Probability
+		if pi != pj {
+			return pi > pj == junk
+		}
+		si, sj := scores[i].Good+scores[i].Junk, scores[j].Good+scores[j].Junk
+		if si != sj {
+			return si > sj
+		}
+		return scores[i].Word < scores[j].Word
+	})
+	if n > 0 && len(scores) > n {
+		scores = scores[:n]
+	}
+
+	for i := range scores {
+		scores[i].Word = o.redact(scores[i].Word)
+	}
+
+	return scores, nil
+}
@@ -0,0 +1,118 @@
+package sisyphus_test
+
+import (
+	"math"
+	"os"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Explain", func() {
+	Context("Confidence of a word", func() {
+		It("narrows the interval of words learned from many mails", func() {
+			low, high := TokenScore{Junk: 1, Probability: 1}.Interval()
+			Ω(low).Should(BeNumerically("~", 0.2065, 0.0001))
+			Ω(high).Should(Equal(1.0))
+
+			low, high = TokenScore{Junk: 1000, Probability: 1}.Interval()
+			Ω(low).Should(BeNumerically(">", 0.99))
+			Ω(high).Should(Equal(1.0))
+
+			low, high = TokenScore{Good: 50, Junk: 50, Probability: 0.5}.Interval()
+			Ω(low).Should(BeNumerically("~", 0.4038, 0.0001))
+			Ω(high).Should(BeNumerically("~", 0.5962, 0.0001))
+		})
+
+		It("has no interval for words never learned", func() {
+			low, high := TokenScore{Probability: math.NaN()}.Interval()
+			Ω(math.IsNaN(low)).Should(BeTrue())
+			Ω(math.IsNaN(high)).Should(BeTrue())
+		})
+	})
+
+	Context("Explain the classification of a mail", func() {
+		BeforeEach(func() {
+			// Load db
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// Learn junk and good mail
+			m = &Mail{
+				Key:  "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
+				Junk: true,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			// Cleanup
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("returns the word scores sorted by their contribution", func() {
+			subject := "herpes with abcdefg"
+			scores, _, err := Explain(dbs["test/Maildir"], Mail{Subject: &subject})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(scores).Should(HaveLen(3))
+			Ω(scores[0]).Should(Equal(TokenScore{Word: "herpes", Junk: 1, Probability: 1.0}))
+			Ω(scores[1].Word).Should(Equal("abcdefg"))
+			Ω(math.IsNaN(scores[1].Probability)).Should(BeTrue())
+			Ω(scores[2]).Should(Equal(TokenScore{Word: "with", Good: 1, Junk: 1, Probability: 0.5}))
+		})
+
+		It("returns the probability of the mail being junk", func() {
+			subject := "herpes with"
+			_, prob, err := Explain(dbs["test/Maildir"], Mail{Subject: &subject})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(1.0))
+		})
+		It("lists the words indicating junk the most", func() {
+			scores, err := TopWords(dbs["test/Maildir"], Options{}, true, 10, 1)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(scores).Should(HaveLen(10))
+			for i, s := range scores {
+				Ω(s.Probability).Should(Equal(1.0))
+				Ω(s.Good).Should(BeZero())
+				if i > 0 {
+					Ω(s.Junk).Should(BeNumerically("<=", scores[i-1].Junk))
+				}
+			}
+		})
+
+		It("lists the words indicating good mails the most", func() {
+			scores, err := TopWords(dbs["test/Maildir"], Options{}, false, 10, 1)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(scores).Should(HaveLen(10))
+			for _, s := range scores {
+				Ω(s.Probability).Should(Equal(0.0))
+				Ω(s.Junk).Should(BeZero())
+			}
+		})
+
+		It("leaves out words learned from too few mails", func() {
+			scores, err := TopWords(dbs["test/Maildir"], Options{}, true, 0, 2)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(scores).ShouldNot(BeEmpty())
+			for _, s := range scores {
+				Ω(s.Good + s.Junk).Should(BeNumerically(">=", 2))
+				Ω(s.Probability).Should(Equal(0.5))
+			}
+		})
+	})
+})
@@ -0,0 +1,121 @@
+package sisyphus
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/maildir"
+)
+
+// Folders tells which folders of a maildir are learned from and how their mails
+// are labeled: a folder maps to true if it holds junk and to false if it holds
+// good mails. The inbox is the folder "", all others are named as in a
+// Maildir++ layout, e.g. ".Archive". Mails in folders not listed are left
+// alone.
+type Folders map[string]bool
+
+// DefaultFolders learns the mails in the inbox as good and those in the Junk
+// folder as junk.
+var DefaultFolders = Folders{
+	"":                false,
+	DefaultJunkFolder: true,
+}
+
+// names returns the folders in a stable order
+func (f Folders) names() []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// IndexFolders loads the keys of all mails in cur of the given folders of the
+// Maildir, labeled as junk or good by the folder they are in. Folders missing
+// from the Maildir are skipped. Files in the maildir itself, such as the
+// database and its backup, are never indexed.
+func (d Maildir) IndexFolders(f Folders) (m []*Mail, err error) {
+	err = d.WalkFolders(f, func(mail *Mail) error {
+		m = append(m, mail)
+		return nil
+	})
+
+	return m, err
+}
+
+// WalkFolders calls fn for each mail in cur of the given folders of the
+// Maildir, labeled like by IndexFolders, one mail at a time, so that mails
+// that have been handled need not be kept in memory. It stops at the first
+// error returned by fn and returns it.
+func (d Maildir) WalkFolders(f Folders, fn func(m *Mail) error) error {
+
+	dir := string(d)
+
+	log.WithFields(log.Fields{
+		"dir": dir,
+	}).Info("Start indexing mails")
+
+	for _, folder := range f.names() {
+		j, err := maildir.Dir(filepath.Join(dir, folder)).Keys()
+		if os.IsNotExist(err) && folder != "" {
+			// not every maildir needs to have all folders
+			log.WithFields(log.Fields{
+				"dir":    dir,
+				"folder": folder,
+			}).Warning("Skip missing folder")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, v := range j {
+			err = fn(&Mail{
+				Key:    v,
+				Junk:   f[folder],
+				Folder: folder,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"dir": dir,
+	}).Info("All mails indexed")
+
+	return nil
+}
+
+// LoadFolders loads all mails in the given folders of a slice of Maildirs,
+// see IndexFolders
+func LoadFolders(d []Maildir, f Folders) (mails map[Maildir][]*Mail, err error) {
+	return LoadFoldersContext(context.Background(), d, f)
+}
+
+// LoadFoldersContext is like LoadFolders, but gives up once ctx is done and
+// returns ctx.Err() along with the mails of the Maildirs loaded until then
+func LoadFoldersContext(ctx context.Context, d []Maildir, f Folders) (mails map[Maildir][]*Mail, err error) {
+	mails = make(map[Maildir][]*Mail)
+
+	for _, val := range d {
+		var m []*Mail
+		err = val.WalkFolders(f, func(mail *Mail) error {
+			m = append(m, mail)
+			return ctx.Err()
+		})
+		if err != nil {
+			return mails, err
+		}
+
+		mails[val] = m
+	}
+
+	return mails, nil
+}
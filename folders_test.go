@@ -0,0 +1,68 @@
+package sisyphus_test
+
+import (
+	"errors"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Folders", func() {
+	Context("Index the mails of folders", func() {
+		It("Label the mails by the folder they are in", func() {
+			mails, err := Maildir("test/Maildir").IndexFolders(Folders{"": true})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mails).Should(Equal([]*Mail{
+				{
+					Key:  "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+					Junk: true,
+				},
+			}))
+
+			mails, err = Maildir("test/Maildir").IndexFolders(Folders{".Junk": false})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mails).Should(HaveLen(10))
+			for _, m := range mails {
+				Ω(m.Junk).Should(BeFalse())
+				Ω(m.Folder).Should(Equal(".Junk"))
+			}
+		})
+
+		It("Load mails from the folder they are in", func() {
+			mails, err := Maildir("test/Maildir").IndexFolders(Folders{".Junk": false})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = mails[0].Load("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*mails[0].Body).ShouldNot(BeEmpty())
+		})
+
+		It("Skip folders that do not exist", func() {
+			mails, err := Maildir("test/Maildir").IndexFolders(Folders{"": false, ".Spam": true})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mails).Should(HaveLen(1))
+		})
+
+		It("Walk the mails one at a time and stop at the first error", func() {
+			stop := errors.New("stop")
+			var keys []string
+			err := Maildir("test/Maildir").WalkFolders(DefaultFolders, func(m *Mail) error {
+				keys = append(keys, m.Key)
+				if len(keys) == 3 {
+					return stop
+				}
+				return nil
+			})
+			Ω(err).Should(Equal(stop))
+			Ω(keys).Should(HaveLen(3))
+			Ω(keys[0]).Should(Equal("1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119"))
+		})
+
+		It("Fail if the Maildir does not exist", func() {
+			_, err := Maildir("test/DOESNOTEXIST").IndexFolders(Folders{"": false, ".Spam": true})
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -1,50 +1,85 @@
 package sisyphus
 
 import (
+	"time"
+
 	"github.com/boltdb/bolt"
-	"github.com/retailnext/hllpp"
 )
 
+// Stats are the statistics of a database
+type Stats struct {
+	// GTotal and JTotal are the numbers of good and junk mails learned
+	GTotal, JTotal uint64
+	// GWords and JWords are the numbers of words learned from good and
+	// junk mails
+	GWords, JWords uint64
+	// Tokens is the number of distinct words learned from mails of either
+	// class
+	Tokens uint64
+	// Size is the size of the database file in bytes
+	Size int64
+	// LastLearned is when a mail was last learned, or the zero time if
+	// none has been learned yet
+	LastLearned time.Time
+	// LastClassified is when a mail was last classified, recorded once a
+	// minute at most, or the zero time if none has been classified yet
+	LastClassified time.Time
+}
+
 // Info produces statistics
 func Info(db *bolt.DB) (gTotal, jTotal, gWords, jWords uint64) {
+	s, _ := Statistics(db)
 
-	_ = db.View(func(tx *bolt.Tx) error {
-		p := tx.Bucket([]byte("Statistics"))
-		gRaw := p.Get([]byte("ProcessedGood"))
-		if len(gRaw) > 0 {
-			var gHLL *hllpp.HLLPP
-			gHLL, _ = hllpp.Unmarshal(gRaw)
-			gTotal = gHLL.Count()
-		}
-		jRaw := p.Get([]byte("ProcessedJunk"))
-		if len(jRaw) > 0 {
-			var jHLL *hllpp.HLLPP
-			jHLL, _ = hllpp.Unmarshal(jRaw)
-			jTotal = jHLL.Count()
-		}
+	return s.GTotal, s.JTotal, s.GWords, s.JWords
+}
 
-		return nil
-	})
+// Statistics produces the statistics of the database, like Info
+func Statistics(db *bolt.DB) (s Stats, err error) {
 
-	_ = db.View(func(tx *bolt.Tx) error {
-		p := tx.Bucket([]byte("Wordlists"))
-		pj := p.Bucket([]byte("Junk"))
+	err = db.View(func(tx *bolt.Tx) error {
+		s.Size = tx.Size()
 
-		stats := pj.Stats()
-		jWords = uint64(stats.KeyN)
+		p := tx.Bucket([]byte("Statistics"))
+		s.GTotal, err = netCount(get(p, "ProcessedGood"), get(p, "UnlearnedGood"))
+		if err != nil {
+			return err
+		}
+		s.JTotal, err = netCount(get(p, "ProcessedJunk"), get(p, "UnlearnedJunk"))
+		if err != nil {
+			return err
+		}
 
-		return nil
-	})
+		g := bucket(tx, "Wordlists", "Good")
+		j := bucket(tx, "Wordlists", "Junk")
+		if g != nil {
+			s.GWords = uint64(g.Stats().KeyN)
+		}
+		if j != nil {
+			s.JWords = uint64(j.Stats().KeyN)
+		}
 
-	_ = db.View(func(tx *bolt.Tx) error {
-		p := tx.Bucket([]byte("Wordlists"))
-		pg := p.Bucket([]byte("Good"))
+		// words learned in both classes are counted once
+		s.Tokens = s.GWords
+		if j != nil {
+			err = j.ForEach(func(k, v []byte) error {
+				if g == nil || g.Get(k) == nil {
+					s.Tokens++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
 
-		stats := pg.Stats()
-		gWords = uint64(stats.KeyN)
+		s.LastLearned, err = getTime(tx, "LastLearned")
+		if err != nil {
+			return err
+		}
+		s.LastClassified, err = getTime(tx, "LastClassified")
 
-		return nil
+		return err
 	})
 
-	return gTotal, jTotal, gWords, jWords
+	return s, err
 }
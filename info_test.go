@@ -0,0 +1,94 @@
+package sisyphus_test
+
+import (
+	"io"
+	"os"
+	"time"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Info", func() {
+	Context("Statistics of a database", func() {
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Report nothing learned for a new database", func() {
+			s, err := Statistics(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(s.GTotal).Should(BeZero())
+			Ω(s.JTotal).Should(BeZero())
+			Ω(s.Tokens).Should(BeZero())
+			Ω(s.LastLearned.IsZero()).Should(BeTrue())
+			Ω(s.LastClassified.IsZero()).Should(BeTrue())
+			Ω(s.Size).Should(BeNumerically(">", 0))
+		})
+
+		It("Report the mails and words learned and when", func() {
+			before := time.Now()
+
+			mails, err := LoadMails([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, val := range mails["test/Maildir"] {
+				err = val.Learn(dbs["test/Maildir"], "test/Maildir")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			s, err := Statistics(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+
+			gTotal, jTotal, gWords, jWords := Info(dbs["test/Maildir"])
+			Ω(s.GTotal).Should(Equal(gTotal))
+			Ω(s.JTotal).Should(Equal(jTotal))
+			Ω(s.GWords).Should(Equal(gWords))
+			Ω(s.JWords).Should(Equal(jWords))
+			Ω(s.GTotal).Should(Equal(uint64(1)))
+			Ω(s.JTotal).Should(Equal(uint64(10)))
+
+			// words of both classes are counted once
+			Ω(s.Tokens).Should(BeNumerically(">=", s.JWords))
+			Ω(s.Tokens).Should(BeNumerically("<", s.GWords+s.JWords))
+
+			Ω(s.LastLearned).Should(BeTemporally(">=", before))
+			Ω(s.LastLearned).Should(BeTemporally("<=", time.Now()))
+		})
+
+		It("Report when a mail was last classified", func() {
+			before := time.Now()
+
+			f, err := os.Open("test/Maildir/.Junk/cur/1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730:2,Sa")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer f.Close()
+
+			_, err = ClassifyReader(dbs["test/Maildir"], f)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			s, err := Statistics(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(s.LastLearned.IsZero()).Should(BeTrue())
+			Ω(s.LastClassified).Should(BeTemporally(">=", before))
+			Ω(s.LastClassified).Should(BeTemporally("<=", time.Now()))
+
+			// classifying again soon after takes no write
+			_, err = f.Seek(0, io.SeekStart)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = ClassifyReader(dbs["test/Maildir"], f)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			again, err := Statistics(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(again.LastClassified).Should(Equal(s.LastClassified))
+		})
+	})
+})
@@ -1,109 +1,424 @@
 package sisyphus
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/boltdb/bolt"
-	"github.com/retailnext/hllpp"
 )
 
-// learnWordlist adds the mail key to the respective word's list
-func (m *Mail) learnWordlist(w string, db *bolt.DB) error {
-	wordKey := "Good"
+// ErrNotLearned is returned when unlearning a mail that has not been learned,
+// or that has already been unlearned.
+var ErrNotLearned = errors.New("mail has not been learned")
+
+// class returns the name of the buckets and counters the mail belongs to
+func (m *Mail) class() string {
 	if m.Junk {
-		wordKey = "Junk"
+		return "Junk"
 	}
 
-	err := db.Update(func(tx *bolt.Tx) (err error) {
-		b := tx.Bucket([]byte("Wordlists"))
+	return "Good"
+}
 
-		bucket := b.Bucket([]byte(wordKey))
-		wordRaw := bucket.Get([]byte(w))
-		var word *hllpp.HLLPP
-		if len(wordRaw) == 0 {
-			word = hllpp.New()
-		} else {
-			word, err = hllpp.Unmarshal(wordRaw)
-			if err != nil {
-				return err
-			}
-		}
+// learnWordlist adds the mail key to the respective word's list
+func (m *Mail) learnWordlist(tx *bolt.Tx, w string) error {
+	b := tx.Bucket([]byte("Wordlists"))
+
+	bucket := b.Bucket([]byte(m.class()))
+
+	return add(bucket, wordKey(w), m.Key)
+}
 
-		word.Add([]byte(m.Key))
+// learnStatistics adds the mail key to the respective word's list, marks
+// the mail as learned and records when the database was last learned into
+func (m *Mail) learnStatistics(tx *bolt.Tx) error {
+	p := tx.Bucket([]byte("Statistics"))
 
-		err = bucket.Put([]byte(w), word.Marshal())
+	err := add(p, "Processed"+m.class(), m.Key)
+	if err != nil {
+		return err
+	}
 
+	err = setTime(tx, "LastLearned", time.Now())
+	if err != nil {
 		return err
+	}
+
+	return tx.Bucket([]byte("Learned")).Put([]byte(m.Key), []byte(m.class()))
+}
+
+// Learned reports whether the mail has already been learned in its current
+// class, i.e. as junk or good.
+func (m *Mail) Learned(db *bolt.DB) (learned bool, err error) {
+	err = db.View(func(tx *bolt.Tx) error {
+		class := get(bucket(tx, "Learned"), m.Key)
+		learned = string(class) == m.class()
+		return nil
 	})
 
-	return err
+	return learned, err
 }
 
-// learnStatistics adds the mail key to the respective word's list
-func (m *Mail) learnStatistics(db *bolt.DB) error {
-	err := db.Update(func(tx *bolt.Tx) (err error) {
-		p := tx.Bucket([]byte("Statistics"))
+// LearnBatchSize and LearnBatchInterval limit the number of mails, and the
+// time spent on loading them, before LearnBatch commits the learned words to
+// the database.
+var (
+	LearnBatchSize     = 1000
+	LearnBatchInterval = 10 * time.Second
+)
+
+// skip reports whether Learn would skip the mail because it has already been
+// learned
+func (m *Mail) skip(db *bolt.DB, dir Maildir) (bool, error) {
+	if m.Relearn {
+		return false, nil
+	}
+
+	learned, err := m.Learned(db)
+	if err != nil {
+		return false, err
+	}
+	if learned {
+		log.WithFields(log.Fields{
+			"dir":  string(dir),
+			"mail": m.Key,
+		}).Debug("Skip learned mail")
+	}
+
+	return learned, nil
+}
+
+// words loads the mail and returns the words to be learned from it
+func (m *Mail) words(dir Maildir) (list []string, err error) {
+
+	log.WithFields(log.Fields{
+		"dir":  string(dir),
+		"mail": m.Key,
+	}).Info("Learn mail")
+
+	err = m.Load(dir)
+	if err != nil {
+		return list, err
+	}
+
+	list, err = m.cleanWordlist()
+	if err != nil {
+		return list, err
+	}
+
+	err = m.Unload(dir)
+
+	return list, err
+}
 
-		key := "ProcessedGood"
-		if m.Junk {
-			key = "ProcessedJunk"
+// learn learns the words of the mail and updates the statistics counter
+func (m *Mail) learn(tx *bolt.Tx, list []string) error {
+	if m.Weight > 0 && m.Weight < 1 {
+		return m.learnWeighted(tx, list)
+	}
+
+	for _, val := range list {
+		err := m.learnWordlist(tx, val)
+		if err != nil {
+			return err
 		}
+	}
 
-		keyRaw := p.Get([]byte(key))
-		var counter *hllpp.HLLPP
-		if len(keyRaw) == 0 {
-			counter = hllpp.New()
-		} else {
-			counter, err = hllpp.Unmarshal(keyRaw)
+	return m.learnStatistics(tx)
+}
+
+// learnWeighted learns the mail like learn, but records the share 1-Weight of
+// each count it adds as decayed, see Decay, so that the mail only counts with
+// its weight. Counts the mail has been added to before are left as they are.
+func (m *Mail) learnWeighted(tx *bolt.Tx, list []string) error {
+	share := 1 - m.Weight
+
+	d, err := decayedBucket(tx, m.class())
+	if err != nil {
+		return err
+	}
+	w := bucket(tx, "Wordlists", m.class())
+	for _, val := range list {
+		key := wordKey(val)
+		learned, err := contains(get(w, key), m.Key)
+		if err != nil {
+			return err
+		}
+		err = m.learnWordlist(tx, val)
+		if err != nil {
+			return err
+		}
+		if !learned {
+			err = d.Put([]byte(key), encodeFloat(decodeFloat(get(d, key))+share))
 			if err != nil {
 				return err
 			}
 		}
+	}
+
+	s, err := decayedBucket(tx, "Statistics")
+	if err != nil {
+		return err
+	}
+	learned, err := contains(get(tx.Bucket([]byte("Statistics")), "Processed"+m.class()), m.Key)
+	if err != nil {
+		return err
+	}
+	if !learned {
+		err = s.Put([]byte(m.class()), encodeFloat(decodeFloat(get(s, m.class()))+share))
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.learnStatistics(tx)
+}
+
+// Learn adds the the mail key to the list of words using hyper log log algorithm.
+// Mails that have already been learned in the same class are skipped, unless
+// Relearn is set. It is safe to learn several mails concurrently.
+func (m *Mail) Learn(db *bolt.DB, dir Maildir) (err error) {
+	return m.LearnContext(context.Background(), db, dir)
+}
+
+// LearnContext is like Learn, but gives up once ctx is done and returns
+// ctx.Err(). The mail is either learned completely or not at all.
+func (m *Mail) LearnContext(ctx context.Context, db *bolt.DB, dir Maildir) (err error) {
+
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
 
-		counter.Add([]byte(m.Key))
+	skip, err := m.skip(db, dir)
+	if err != nil || skip {
+		return err
+	}
 
-		err = p.Put([]byte(key), counter.Marshal())
+	list, err := m.words(dir)
+	if err != nil {
+		return err
+	}
 
+	// loading may take a while for a large mail
+	err = ctx.Err()
+	if err != nil {
 		return err
+	}
+
+	return m.store(db, list)
+}
+
+// store learns the words of the mail and updates the statistics counter in a
+// single transaction. Batch combines the transactions of mails learned
+// concurrently; since adding a key to a counter twice does not change it, a
+// retry of the function is harmless.
+func (m *Mail) store(db *bolt.DB, list []string) error {
+	return db.Batch(func(tx *bolt.Tx) error {
+		return m.learn(tx, list)
 	})
+}
 
-	return err
+// LearnReader learns the raw mail read from r as junk or good with the default
+// options, without the mail living in a maildir, e.g. a mail uploaded to a web
+// application. See Mail.LearnReader for learning with other options.
+func LearnReader(db *bolt.DB, r io.Reader, junk bool) error {
+	m := Mail{Junk: junk}
+
+	return m.LearnReader(db, r)
 }
 
-// Learn adds the the mail key to the list of words using hyper log log algorithm.
-func (m *Mail) Learn(db *bolt.DB, dir Maildir) (err error) {
+// LearnReader learns the raw mail read from r like Learn. Unless the mail has
+// a key, it is identified by its Message-ID or, lacking one, by the checksum
+// of its content, so learning it again changes nothing.
+func (m *Mail) LearnReader(db *bolt.DB, r io.Reader) (err error) {
+
+	h := sha256.New()
+	err = m.Read(io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+
+	if m.Key == "" {
+		m.Key = m.Header.Get("Message-Id")
+	}
+	if m.Key == "" {
+		m.Key = fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	skip, err := m.skip(db, "")
+	if err != nil || skip {
+		return err
+	}
 
 	log.WithFields(log.Fields{
-		"dir":  string(dir),
 		"mail": m.Key,
+		"junk": m.Junk,
 	}).Info("Learn mail")
 
-	err = m.Load(dir)
+	list, err := m.cleanWordlist()
 	if err != nil {
 		return err
 	}
+	m.Unload("")
+
+	return m.store(db, list)
+}
+
+// LearnBatch learns a slice of mails of a maildir like Learn, but commits
+// them in as few transactions as possible: one per LearnBatchSize mails, or
+// whenever loading the mails took longer than LearnBatchInterval. Mails that
+// cannot be loaded are skipped with a warning.
+func LearnBatch(db *bolt.DB, dir Maildir, mails []Mail) (err error) {
+	return LearnBatchContext(context.Background(), db, dir, mails)
+}
+
+// LearnBatchContext is like LearnBatch, but stops once ctx is done, e.g. on
+// shutdown, and returns ctx.Err(). The mails loaded until then are committed
+// first, so that they need not be loaded again.
+func LearnBatchContext(ctx context.Context, db *bolt.DB, dir Maildir, mails []Mail) (err error) {
+
+	var pending []*Mail
+	var lists [][]string
+	start := time.Now()
+
+	commit := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		err := db.Update(func(tx *bolt.Tx) error {
+			for i, m := range pending {
+				err := m.learn(tx, lists[i])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		pending, lists = pending[:0], lists[:0]
+		start = time.Now()
 
-	list, err := m.cleanWordlist()
-	if err != nil {
 		return err
 	}
 
-	// Learn words
-	for _, val := range list {
-		err = m.learnWordlist(val, db)
+	for i := range mails {
+		m := &mails[i]
+
+		if ctx.Err() != nil {
+			err = commit()
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+
+		skip, err := m.skip(db, dir)
 		if err != nil {
 			return err
 		}
+		if skip {
+			continue
+		}
+
+		list, err := m.words(dir)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"mail": m.Key,
+			}).Warning("Cannot learn mail")
+			continue
+		}
+
+		pending = append(pending, m)
+		lists = append(lists, list)
+
+		if len(pending) >= LearnBatchSize || time.Since(start) >= LearnBatchInterval {
+			err = commit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return commit()
+}
+
+// Unlearn reverts a previous Learn of the mail, e.g. after it has been moved
+// from the Junk folder back to the inbox. Since hyper log log counters cannot
+// forget a key, the mail key is added to a separate list of unlearned mails
+// which is subtracted whenever words are counted. Unlearning a mail that has
+// not been learned returns ErrNotLearned and changes nothing.
+func (m *Mail) Unlearn(db *bolt.DB, dir Maildir) (err error) {
+
+	log.WithFields(log.Fields{
+		"dir":  string(dir),
+		"mail": m.Key,
+	}).Info("Unlearn mail")
+
+	err = m.Load(dir)
+	if err != nil {
+		return err
 	}
 
-	// Update the statistics counter
-	err = m.learnStatistics(db)
+	list, err := m.cleanWordlist()
 	if err != nil {
 		return err
 	}
 
 	err = m.Unload(dir)
+	if err != nil {
+		return err
+	}
 
-	return err
+	err = db.Update(func(tx *bolt.Tx) error {
+		p := tx.Bucket([]byte("Statistics"))
 
+		learned, err := contains(p.Get([]byte("Processed"+m.class())), m.Key)
+		if err != nil {
+			return err
+		}
+		unlearned, err := contains(p.Get([]byte("Unlearned"+m.class())), m.Key)
+		if err != nil {
+			return err
+		}
+		if !learned || unlearned {
+			return ErrNotLearned
+		}
+
+		words := tx.Bucket([]byte("Wordlists")).Bucket([]byte(m.class()))
+		forgotten := tx.Bucket([]byte("Unlearned")).Bucket([]byte(m.class()))
+		for _, val := range list {
+			key := wordKey(val)
+			// only unlearn words that this mail did contribute to
+			learned, err = contains(words.Get([]byte(key)), m.Key)
+			if err != nil {
+				return err
+			}
+			if !learned {
+				continue
+			}
+
+			err = add(forgotten, key, m.Key)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Bucket([]byte("Learned")).Delete([]byte(m.Key))
+		if err != nil {
+			return err
+		}
+
+		return add(p, "Unlearned"+m.class(), m.Key)
+	})
+
+	return err
 }
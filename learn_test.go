@@ -1,7 +1,10 @@
 package sisyphus_test
 
 import (
+	"context"
+	"math"
 	"os"
+	"sync"
 
 	"github.com/boltdb/bolt"
 	. "github.com/carlostrub/sisyphus"
@@ -69,7 +72,7 @@ var _ = Describe("Learn", func() {
 
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(gN).Should(Equal(0))
-			Ω(jN).Should(Equal(27))
+			Ω(jN).Should(Equal(32))
 			Ω(sN).Should(Equal(1))
 
 		})
@@ -102,5 +105,240 @@ var _ = Describe("Learn", func() {
 			Ω(wordCount).Should(Equal(uint64(1)))
 
 		})
+
+		It("Learn a mail twice and check that it is marked as learned and only counted once", func() {
+
+			learned, err := m.Learned(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(learned).Should(BeFalse())
+
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			learned, err = m.Learned(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(learned).Should(BeTrue())
+
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m.Relearn = true
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(0)))
+			Ω(jTotal).Should(Equal(uint64(1)))
+
+			// a mail learned as junk has not been learned as good
+			m.Junk = false
+			learned, err = m.Learned(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(learned).Should(BeFalse())
+		})
+
+		It("Learn all mails of a maildir concurrently", func() {
+
+			mails, err := LoadMails([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var wg sync.WaitGroup
+			errs := make(chan error, len(mails["test/Maildir"]))
+			for _, val := range mails["test/Maildir"] {
+				wg.Add(1)
+				go func(mail *Mail) {
+					defer wg.Done()
+					errs <- mail.Learn(dbs["test/Maildir"], "test/Maildir")
+				}(val)
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(1)))
+			Ω(jTotal).Should(Equal(uint64(10)))
+		})
+
+		It("Learn all mails of a maildir in batches", func() {
+
+			size := LearnBatchSize
+			LearnBatchSize = 3
+			defer func() { LearnBatchSize = size }()
+
+			mails, err := LoadMails([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var batch []Mail
+			for _, val := range mails["test/Maildir"] {
+				batch = append(batch, *val)
+			}
+
+			err = LearnBatch(dbs["test/Maildir"], "test/Maildir", batch)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(1)))
+			Ω(jTotal).Should(Equal(uint64(10)))
+
+			for _, val := range batch {
+				learned, err := val.Learned(dbs["test/Maildir"])
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(learned).Should(BeTrue())
+			}
+		})
+
+		It("Learn nothing once the context is cancelled", func() {
+
+			mails, err := LoadMails([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var batch []Mail
+			for _, val := range mails["test/Maildir"] {
+				batch = append(batch, *val)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err = LearnBatchContext(ctx, dbs["test/Maildir"], "test/Maildir", batch)
+			Ω(err).Should(Equal(context.Canceled))
+
+			err = m.LearnContext(ctx, dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(Equal(context.Canceled))
+
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(0)))
+			Ω(jTotal).Should(Equal(uint64(0)))
+		})
+
+		It("Learn a mail read from a reader twice and check that it is only counted once", func() {
+			for i := 0; i < 2; i++ {
+				f, err := os.Open("test/Maildir/.Junk/cur/1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730:2,Sa")
+				Ω(err).ShouldNot(HaveOccurred())
+				err = LearnReader(dbs["test/Maildir"], f, true)
+				f.Close()
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			gTotal, jTotal, _, jWords := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(0)))
+			Ω(jTotal).Should(Equal(uint64(1)))
+			Ω(jWords).Should(BeNumerically(">", 0))
+
+			// the mail is identified by its Message-ID
+			m = &Mail{
+				Key:  "<003501d2912f$0537037a$9950f7a2$@striker.ottawa.on.ca>",
+				Junk: true,
+			}
+			learned, err := m.Learned(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(learned).Should(BeTrue())
+		})
+
+		It("Learn a mail with a reduced weight, also when learning it again", func() {
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// "with" has been learned from the good mail and from this
+			// junk mail only, which would make it undecided at full weight
+			m = &Mail{
+				Key:    "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
+				Junk:   true,
+				Weight: 0.25,
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, prob, err := Junk(dbs["test/Maildir"], []string{"with"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically("<", 0.4))
+
+			m.Relearn = true
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, again, err := Junk(dbs["test/Maildir"], []string{"with"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(again).Should(Equal(prob))
+		})
+	})
+
+	Context("Unlearn a mail", func() {
+
+		BeforeEach(func() {
+			// Load db
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m = &Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+		})
+		AfterEach(func() {
+			// Cleanup
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Learn and unlearn a mail, then check that the totals and word counts are back to zero", func() {
+
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(1)))
+
+			err = m.Unlearn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(0)))
+			Ω(jTotal).Should(Equal(uint64(0)))
+
+			learned, err := m.Learned(dbs["test/Maildir"])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(learned).Should(BeFalse())
+
+			answer, prob, err := Junk(dbs["test/Maildir"], []string{"looking"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(math.IsNaN(prob)).Should(BeTrue())
+			Ω(answer).Should(BeFalse())
+		})
+
+		It("Unlearn a mail that has never been learned", func() {
+
+			err = m.Unlearn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(Equal(ErrNotLearned))
+
+			_, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(0)))
+		})
+
+		It("Unlearn a mail twice without counts going negative", func() {
+
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = m.Unlearn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = m.Unlearn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).Should(Equal(ErrNotLearned))
+
+			_, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(jTotal).Should(Equal(uint64(0)))
+		})
 	})
 })
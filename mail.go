@@ -2,21 +2,37 @@ package sisyphus
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"mime"
+	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/carlostrub/maildir"
 	"github.com/kennygrant/sanitize"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Maildir represents the address to a Maildir directory
@@ -26,11 +42,28 @@ type Maildir string
 type Mail struct {
 	Key           string
 	Subject, Body *string
-	Junk, New     bool
-	DryRun        bool
+	// Header holds the header of the loaded mail
+	Header    mail.Header
+	Junk, New bool
+	DryRun    bool
+	// Folder is the subfolder of the Maildir a mail is in, e.g. ".Lists" in
+	// a Maildir++ layout, or a new mail has been delivered to. It is empty
+	// for the inbox; a junk mail without a folder is in the junk folder of
+	// its Options.
+	Folder string
+	// Relearn makes Learn add the mail again even if it has already been
+	// learned.
+	Relearn bool
+	// Weight is the weight a mail is learned with, within (0,1), e.g. for
+	// mails that are likely junk, but have not been marked as such by the
+	// user. Any other value learns the mail with full weight.
+	Weight float64
+	Options
 }
 
-// CreateDirs creates all the required dirs -- if not already there.
+// CreateDirs creates all the required dirs -- if not already there: the cur,
+// new and tmp directories of the Maildir and the cur directory of its Junk
+// folder. It fails, naming the path, if any of them is not a directory.
 func (d Maildir) CreateDirs() error {
 
 	dir := string(d)
@@ -39,98 +72,462 @@ func (d Maildir) CreateDirs() error {
 		"dir": dir,
 	}).Info("Create missing directories")
 
-	err := os.MkdirAll(filepath.Join(dir, ".Junk", "cur"), 0700)
+	err := createDir(dir)
 	if err != nil {
 		return err
 	}
-	err = os.MkdirAll(filepath.Join(dir, "new"), 0700)
-	if err != nil {
-		return err
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		err = createDir(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
 	}
-	err = os.MkdirAll(filepath.Join(dir, "cur"), 0700)
 
-	return err
+	return d.CreateFolder(DefaultJunkFolder)
 }
 
-// Index loads all mail keys from the Maildir directory for processing.
-func (d Maildir) Index() (m []*Mail, err error) {
-
-	dir := string(d)
+// CreateFolder creates the cur directory of a folder of the Maildir, e.g.
+// ".Spam", -- if not already there.
+func (d Maildir) CreateFolder(folder string) error {
+	err := createDir(filepath.Join(string(d), folder))
+	if err != nil {
+		return err
+	}
 
-	log.WithFields(log.Fields{
-		"dir": dir,
-	}).Info("Start indexing mails")
+	return createDir(filepath.Join(string(d), folder, "cur"))
+}
 
-	dirs := []string{dir, filepath.Join(dir, ".Junk")}
-	for _, val := range dirs {
-		j, err := maildir.Dir(val).Keys()
+// createDir creates the directory at path, accessible by its owner only, or
+// checks that it is a directory if it exists
+func createDir(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(path, 0700)
 		if err != nil {
-			return m, err
-		}
-		for _, v := range j {
-			var new Mail
-			new.Key = v
-			if val == filepath.Join(dir, ".Junk") {
-				new.Junk = true
-			}
-			m = append(m, &new)
+			return err
 		}
+		// the permissions of Mkdir are subject to the umask
+		return os.Chmod(path, 0700)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory, but a %s", path, fileType(info.Mode()))
 	}
 
-	log.WithFields(log.Fields{
-		"dir": dir,
-	}).Info("All mails indexed")
+	return nil
+}
+
+// fileType names the type of a file that is no directory
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "file"
+	}
+}
 
-	return m, nil
+// Index loads all mail keys from the Maildir directory for processing, labeled
+// by DefaultFolders.
+func (d Maildir) Index() (m []*Mail, err error) {
+	return d.IndexFolders(DefaultFolders)
 }
 
 // Load reads a mail's subject and body
 func (m *Mail) Load(dir Maildir) (err error) {
 
-	var message *mail.Message
+	f, err := m.open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return m.Read(f)
+}
+
+// open opens the file of a mail in the maildir
+func (m *Mail) open(dir Maildir) (f *os.File, err error) {
 
 	switch {
-	case m.Junk:
-		dir = Maildir(filepath.Join(string(dir), ".Junk"))
+	case m.Junk && m.Folder == "":
+		dir = Maildir(filepath.Join(string(dir), m.junkFolder()))
 	case m.New:
-		dir = Maildir(filepath.Join(string(dir), "new"))
+		dir = Maildir(filepath.Join(string(dir), m.Folder, "new"))
+	default:
+		dir = Maildir(filepath.Join(string(dir), m.Folder))
+	}
+
+	filename, err := maildir.Dir(dir).Filename(m.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(filename)
+}
+
+// gzipMagic are the first bytes of a gzip-compressed file
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Read reads a mail's subject and body from r, which holds the raw mail, e.g.
+// as handed over by an MTA or fetched from an IMAP server. Mails compressed
+// with gzip, as stored by some backup tools, are decompressed transparently.
+func (m *Mail) Read(r io.Reader) (err error) {
+
+	b := bufio.NewReader(r)
+	if magic, err := b.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		z, err := gzip.NewReader(b)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		r = z
+	} else {
+		r = b
 	}
 
-	message, err = maildir.Dir(dir).Message(m.Key)
+	message, err := mail.ReadMessage(r)
 	if err != nil {
 		return err
 	}
 
+	return m.parse(message)
+}
+
+// parse extracts the subject, header and body of a message
+func (m *Mail) parse(message *mail.Message) (err error) {
+
 	// get Subject
 	if m.Subject != nil {
 		return errors.New("there is already a subject")
 	}
-	subject := message.Header.Get("Subject")
+	subject := decodeHeader(message.Header.Get("Subject"))
 	m.Subject = &subject
+	m.Header = message.Header
 
 	// get Body
-	bQ := quotedprintable.NewReader(message.Body)
-	var b []string
-	bScanner := bufio.NewScanner(bQ)
-	for bScanner.Scan() {
-		raw := bScanner.Text()
-		b = append(b, raw)
-	}
-
-	body := strings.Join(b, " ")
 	if m.Body != nil {
 		return errors.New("there is already a body")
 	}
+	left := m.maxBody()
+	b, err := m.readPart(message.Header, message.Body, &left)
+	if err != nil {
+		return err
+	}
+	body := strings.Join(b, " ")
 	m.Body = &body
 
 	return nil
 }
 
+// headerDecoder decodes the encoded words of RFC 2047 in any charset known to
+// HTML, e.g. =?UTF-8?B?...?= or =?windows-1251?Q?...?=
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+// decodeHeader decodes the encoded words of a header value, which junk often
+// uses to hide its subject from filters. A value that cannot be decoded is
+// kept as it is.
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// header is implemented by both, the header of a mail and of a MIME part
+type header interface {
+	Get(key string) string
+}
+
+// readPart returns the text lines of a MIME part after undoing its transfer
+// encoding. Multipart parts are walked recursively, choosing the alternative
+// with the most text where there is a choice. Non-text parts, such as images or
+// other binary attachments, are skipped. Reading stops once the number of bytes
+// of text left to read has been used up.
+func (m *Mail) readPart(h header, r io.Reader, left *int) (text []string, err error) {
+
+	mediatype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 defaults to plain text
+		mediatype = "text/plain"
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	switch {
+	case strings.HasPrefix(mediatype, "multipart/"):
+		var alternatives [][]string
+
+		// parts are read as far as possible, malformed mails often lack a
+		// proper end boundary
+		mr := multipart.NewReader(r, params["boundary"])
+		for *left > 0 {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			t, err := m.readPart(p.Header, p, left)
+			if err != nil {
+				return text, err
+			}
+			alternatives = append(alternatives, t)
+		}
+
+		if mediatype != "multipart/alternative" {
+			for _, t := range alternatives {
+				text = append(text, t...)
+			}
+			return text, nil
+		}
+
+		// all alternatives should carry the same content, but junk often
+		// leaves one of them nearly empty, hence the richest one is used
+		var max int
+		for _, t := range alternatives {
+			if n := len(strings.Join(t, " ")); n > max {
+				max = n
+				text = t
+			}
+		}
+
+		return text, nil
+
+	case mediatype == "message/rfc822":
+		message, err := mail.ReadMessage(r)
+		if err != nil {
+			return text, nil
+		}
+		subject := decodeHeader(message.Header.Get("Subject"))
+		text, err = m.readPart(message.Header, message.Body, left)
+
+		return append([]string{subject}, text...), err
+
+	case strings.HasPrefix(mediatype, "text/"):
+		// a line longer than the text left is cut short, hence no line
+		// can outgrow the buffer of the scanner
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, *left+1)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			if token == nil && err == nil && len(data) > *left {
+				return len(data), data, nil
+			}
+			return advance, token, err
+		})
+		for *left > 0 && scanner.Scan() {
+			line := scanner.Text()
+			if len(line) > *left {
+				text = append(text, truncate(line, *left))
+				*left = 0
+				break
+			}
+			*left -= len(line)
+			text = append(text, line)
+		}
+		if err := scanner.Err(); err != nil {
+			// keep what could be read, junk often comes badly encoded
+			log.WithFields(log.Fields{
+				"err":  err,
+				"mail": m.Key,
+			}).Warning("Cannot read all text of mail")
+		}
+
+		// extract visible text and links from HTML parts
+		if mediatype == "text/html" && !m.KeepHTML {
+			text = []string{htmlText(strings.Join(text, " "))}
+		}
+
+		return text, nil
+	}
+
+	return text, nil
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 encoded rune
+func truncate(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// htmlText extracts the visible text from an HTML document, decoding entities
+// on the way. Link targets are kept as well, as they are often a strong
+// indicator for junk.
+func htmlText(s string) string {
+	var text []string
+	var skip int
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.Join(text, " ")
+		case html.TextToken:
+			if skip == 0 {
+				text = append(text, string(z.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "script", "style":
+				if t.Type == html.StartTagToken {
+					skip++
+				}
+			case "a":
+				for _, a := range t.Attr {
+					if a.Key == "href" {
+						text = append(text, a.Val)
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style":
+				if skip > 0 {
+					skip--
+				}
+			}
+		}
+	}
+}
+
+// infoSeparator separates the unique name of a mail in a Maildir from its
+// flags, e.g. "1488226337.M327822P8269.mail.carlostrub.ch:2,S".
+const infoSeparator = ":2,"
+
+// Flags returns the Maildir flags of a mail, as far as they are part of its
+// key, e.g. "S" if it has been seen or "T" if it has been trashed.
+func (m *Mail) Flags() string {
+	i := strings.LastIndex(m.Key, infoSeparator)
+	if i < 0 {
+		return ""
+	}
+
+	return m.Key[i+len(infoSeparator):]
+}
+
+// junkName returns the file name of a mail once it has been moved to the Junk
+// folder, i.e. its key with the seen flag added to its flags, which are kept
+// in ASCII order as required by the Maildir specification.
+func (m *Mail) junkName() string {
+	name := m.Key
+	i := strings.LastIndex(name, infoSeparator)
+	if i >= 0 {
+		name = name[:i]
+	}
+
+	flags := []byte(m.Flags())
+	if !strings.Contains(m.Flags(), "S") {
+		flags = append(flags, 'S')
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i] < flags[j] })
+
+	return name + infoSeparator + string(flags)
+}
+
+// junkPath returns the path of a mail once it has been moved to the Junk
+// folder of dir, see junkName. If a mail of the same unique name is in the
+// Junk folder already, whatever its flags, the mail is given a new unique
+// name, as two mails of the same name would confuse IMAP servers such as
+// Dovecot, which tell mails apart by their names.
+func (m *Mail) junkPath(dir Maildir) (string, error) {
+	cur := filepath.Join(string(dir), m.junkFolder(), "cur")
+	name := m.junkName()
+	i := strings.LastIndex(name, infoSeparator)
+
+	taken, err := nameTaken(cur, name[:i])
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		name = uniqueName() + name[i:]
+	}
+
+	return filepath.Join(cur, name), nil
+}
+
+// nameTaken reports whether a mail of the given unique name is in dir, with
+// or without flags
+func nameTaken(dir, name string) (bool, error) {
+	_, err := os.Lstat(filepath.Join(dir, name))
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	// escape the name, which may contain characters special to patterns
+	pattern := globEscaper.Replace(name) + infoSeparator + "*"
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+
+	return len(matches) > 0, err
+}
+
+// globEscaper escapes the characters special to filepath.Match
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// moved counts the mails given a new unique name by this process
+var moved uint64
+
+// uniqueName returns a new unique name for a mail, made of the time, the
+// process ID, a counter and the host name as laid out by the Maildir
+// specification, e.g. "1600000000.M12345P678Q1.mail.example.com".
+func uniqueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// the specification reserves "/" and ":" in names
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddUint64(&moved, 1), host)
+}
+
+// move renames the mail file from to the path to, without overwriting an
+// existing file. Both paths have to be within the same maildir, such that the
+// rename is atomic.
+func move(from, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0700)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Lstat(to)
+	if err == nil {
+		return fmt.Errorf("cannot move mail to %s: file exists", to)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Rename(from, to)
+}
+
 // Unload removes a mail's subject and body from the internal cache
 func (m *Mail) Unload(dir Maildir) (err error) {
 
 	m.Subject = nil
 	m.Body = nil
+	m.Header = nil
 
 	return nil
 }
@@ -142,11 +539,15 @@ func trimStringFromBase64(s string) string {
 	return s
 }
 
-func cleanString(i string) (s string) {
+// cleanString reduces a text to space separated words, lowercased unless
+// exact tokens are requested
+func (o Options) cleanString(i string) (s string) {
 
 	s = sanitize.Accents(i)
 	s = sanitize.HTML(s)
-	s = strings.ToLower(s)
+	if !o.ExactTokens {
+		s = strings.ToLower(s)
+	}
 
 	bad := []string{
 		"boundary=", "charset", "content-transfer-encoding",
@@ -172,13 +573,13 @@ func cleanString(i string) (s string) {
 func (m *Mail) Clean() error {
 	if m.Subject != nil {
 		s := trimStringFromBase64(*m.Subject)
-		s = cleanString(s)
+		s = m.cleanString(s)
 		m.Subject = &s
 	}
 
 	if m.Body != nil {
 		b := trimStringFromBase64(*m.Body)
-		b = cleanString(b)
+		b = m.cleanString(b)
 		m.Body = &b
 	}
 
@@ -186,20 +587,37 @@ func (m *Mail) Clean() error {
 }
 
 // wordlist takes a string of space separated text and returns a list of unique
-// words in a space separated string
-func wordlist(s string) (l []string, err error) {
+// words in a space separated string, along with the bigrams of consecutive
+// words if enabled
+func (o Options) wordlist(s string) (l []string, err error) {
 	list := make(map[string]int)
 
 	raw := strings.Split(s, " ")
 	var clean []string
 
 	// use regexp compile for use in the loop that follows
-	regexMatcher, err := regexp.Compile("(^[a-z]+$)")
+	pattern := "(^[a-z]+$)"
+	if o.ExactTokens {
+		pattern = "(^[a-zA-Z]+$)"
+	}
+	regexMatcher, err := regexp.Compile(pattern)
 	if err != nil {
 		return l, err
 	}
+	lower := cases.Lower(language.Und)
+	stop := make(map[string]bool, len(o.StopWords))
+	for _, w := range o.StopWords {
+		stop[w] = true
+	}
 
 	for _, w := range raw {
+		// unless exact tokens are requested, words are normalized to
+		// Unicode NFKC and lowercased, so that e.g. "ｆｒｅｅ" and "FREE"
+		// both become "free"
+		if !o.ExactTokens {
+			w = lower.String(norm.NFKC.String(w))
+		}
+
 		str := w
 		for len(str) > 0 {
 			r, size := utf8.DecodeLastRuneInString(str)
@@ -212,13 +630,13 @@ func wordlist(s string) (l []string, err error) {
 
 		// no long or too short words
 		length := len(w)
-		if length < 4 || length > 10 {
+		if length < o.minToken() || length > o.maxToken() {
 			continue
 		}
 
 		// no numbers, special characters, etc. -- only words
 		match := regexMatcher.MatchString(w)
-		if !match {
+		if !match || stop[strings.ToLower(w)] {
 			continue
 		} else {
 			clean = append(clean, w)
@@ -230,6 +648,11 @@ func wordlist(s string) (l []string, err error) {
 	for i := 0; i < maxWords; i++ {
 		w := clean[i]
 		list[w]++
+
+		// words never contain spaces, so bigrams cannot collide with them
+		if o.Bigrams && i+1 < maxWords {
+			list[w+" "+clean[i+1]]++
+		}
 	}
 
 	for word, count := range list {
@@ -239,6 +662,8 @@ func wordlist(s string) (l []string, err error) {
 
 		l = append(l, word)
 	}
+	// maps are iterated in random order
+	sort.Strings(l)
 
 	return l, nil
 }
@@ -255,12 +680,75 @@ func (m *Mail) Wordlist() (w []string, err error) {
 		s = s + " " + *m.Body
 	}
 
-	w, err = wordlist(s)
+	w, err = m.wordlist(s)
 
 	return w, err
 }
 
-// cleanWordlist combines Clean and Wordlist in one internal function
+// addressHeaders are the headers holding mail addresses, of which only the
+// domains are used as tokens
+var addressHeaders = map[string]bool{
+	"From":        true,
+	"Reply-To":    true,
+	"Return-Path": true,
+	"Sender":      true,
+	"To":          true,
+	"Cc":          true,
+}
+
+// namespace returns the prefix of the tokens of a header
+func namespace(header string) string {
+	if header == "Subject" {
+		return "subj"
+	}
+
+	return strings.ToLower(header)
+}
+
+// HeaderTokens returns the tokens of the configured headers of a loaded mail.
+// They are prefixed with the header's namespace, e.g. "subj:free" or
+// "from:example.com", so they do not collide with the words of the body.
+// Address headers contribute the domains of their addresses, all other
+// headers their words.
+func (m *Mail) HeaderTokens() (tokens []string, err error) {
+	seen := make(map[string]bool)
+
+	for _, name := range m.headers() {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		value := m.Header.Get(name)
+		if value == "" {
+			continue
+		}
+
+		var words []string
+		addresses, err := mail.ParseAddressList(value)
+		if addressHeaders[name] && err == nil {
+			for _, a := range addresses {
+				i := strings.LastIndex(a.Address, "@")
+				words = append(words, strings.ToLower(a.Address[i+1:]))
+			}
+		} else {
+			words, err = m.wordlist(m.cleanString(decodeHeader(value)))
+			if err != nil {
+				return tokens, err
+			}
+		}
+
+		for _, w := range words {
+			t := namespace(name) + ":" + w
+			if w == "" || seen[t] {
+				continue
+			}
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens, nil
+}
+
+// cleanWordlist combines Clean and Wordlist in one internal function and
+// adds the header tokens
 func (m *Mail) cleanWordlist() (w []string, err error) {
 	err = m.Clean()
 	if err != nil {
@@ -268,26 +756,25 @@ func (m *Mail) cleanWordlist() (w []string, err error) {
 	}
 
 	w, err = m.Wordlist()
+	if err != nil {
+		return w, err
+	}
 
-	return w, err
+	h, err := m.HeaderTokens()
+
+	return append(w, h...), err
 }
 
-// LoadMails loads all mails from a given slice of Maildirs
+// LoadMails loads all mails from a given slice of Maildirs, labeled by
+// DefaultFolders
 func LoadMails(d []Maildir) (mails map[Maildir][]*Mail, err error) {
-	mails = make(map[Maildir][]*Mail)
-
-	// create missing directories and write index
-	for _, val := range d {
-		var m []*Mail
-		m, err = val.Index()
-		if err != nil {
-			return mails, err
-		}
-
-		mails[val] = m
-	}
+	return LoadFoldersContext(context.Background(), d, DefaultFolders)
+}
 
-	return mails, nil
+// LoadMailsContext is like LoadMails, but gives up once ctx is done and
+// returns ctx.Err()
+func LoadMailsContext(ctx context.Context, d []Maildir) (mails map[Maildir][]*Mail, err error) {
+	return LoadFoldersContext(ctx, d, DefaultFolders)
 }
 
 // LoadMaildirs creates Maildirs and required directories, if missing
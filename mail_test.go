@@ -1,7 +1,13 @@
 package sisyphus_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 
 	s "github.com/carlostrub/sisyphus"
 
@@ -51,50 +57,83 @@ var _ = Describe("Mail", func() {
 				[]*s.Mail{
 
 					{
-						Key:  "1488181583.M633084P4781.mail.carlostrub.ch,S=708375,W=720014",
-						Junk: true,
+						Key:    "1488181583.M633084P4781.mail.carlostrub.ch,S=708375,W=720014",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
-						Junk: true,
+						Key:    "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167",
-						Junk: true,
+						Key:    "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1488226337.M327825P8269.mail.carlostrub.ch,S=802286,W=812785",
-						Junk: true,
+						Key:    "1488226337.M327825P8269.mail.carlostrub.ch,S=802286,W=812785",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1488226337.M327833P8269.mail.carlostrub.ch,S=6960,W=7161",
-						Junk: true,
+						Key:    "1488226337.M327833P8269.mail.carlostrub.ch,S=6960,W=7161",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1488228352.M339670P8269.mail.carlostrub.ch,S=12659,W=12782",
-						Junk: true,
+						Key:    "1488228352.M339670P8269.mail.carlostrub.ch,S=12659,W=12782",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
 						Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
 					},
 					{
-						Key:  "1504991721.M985788P1901.mail.carlostrub.ch,S=6474,W=6588",
-						Junk: true,
+						Key:    "1504991721.M985788P1901.mail.carlostrub.ch,S=6474,W=6588",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1504991774.M467861P1924.mail.carlostrub.ch,S=6478,W=6592",
-						Junk: true,
+						Key:    "1504991774.M467861P1924.mail.carlostrub.ch,S=6478,W=6592",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1505075914.M288773P9791.mail.carlostrub.ch,S=21241,W=21583",
-						Junk: true,
+						Key:    "1505075914.M288773P9791.mail.carlostrub.ch,S=21241,W=21583",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 					{
-						Key:  "1505392305.M710650P33881.mail.carlostrub.ch,S=6961,W=7064",
-						Junk: true,
+						Key:    "1505392305.M710650P33881.mail.carlostrub.ch,S=6961,W=7064",
+						Junk:   true,
+						Folder: ".Junk",
 					},
 				}))
 		})
+		It("Leave out the database and its backup", func() {
+			dbs, err := s.LoadDatabases([]s.Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			err = s.Backup(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+			s.CloseDatabases(dbs)
+			defer func() {
+				for _, path := range []string{
+					"test/Maildir/sisyphus.db",
+					"test/Maildir/sisyphus.db.backup",
+					"test/Maildir/sisyphus.db.backup.sha256",
+				} {
+					Ω(os.Remove(path)).Should(Succeed())
+				}
+			}()
+
+			result, err := s.Maildir("test/Maildir").Index()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result).Should(HaveLen(11))
+			for _, m := range result {
+				Ω(m.Key).ShouldNot(HavePrefix("sisyphus.db"))
+			}
+		})
 		It("Fail if Maildir does not exist", func() {
 			_, err := s.Maildir("test/DOESNOTEXIST").Index()
 			Ω(err).Should(HaveOccurred())
@@ -113,16 +152,69 @@ var _ = Describe("Mail", func() {
 			err := m.Load("test/Maildir")
 			Ω(err).ShouldNot(HaveOccurred())
 
+			Ω(m.Header.Get("From")).Should(Equal("<hillebrad@striker.ottawa.on.ca>"))
+
 			subject := "hello"
-			body := "This is a multi-part message in MIME format.  ------=_NextPart_000_0032_01D2912F.05324BC6 Content-Type: text/plain; \tcharset=\"cp-850\" Content-Transfer-Encoding: quoted-printable  Dear cs,  We are looking for employees working remotely.  My name is Kari, I am the personnel manager of a large International company. Most of the work you can do from home, that is, at a distance.  Salary is $2000-$5300.  If you are interested in this offer, please visit  Our Site  Best regards! ------=_NextPart_000_0032_01D2912F.05324BC6 Content-Type: text/html; \tcharset=\"cp-850\" Content-Transfer-Encoding: quoted-printable  <html xmlns:v=\"urn:schemas-microsoft-com:vml\" xmlns:o=\"urn:schemas-microsoft-com:office:office\" xmlns:w=\"urn:schemas-microsoft-com:office:word\" xmlns:m=\"http://schemas.microsoft.com/office/2004/12/omml\" xmlns=\"http://www.w3.org/TR/REC-html40\"><head><META HTTP-EQUIV=\"Content-Type\" CONTENT=\"text/html; charset=us-ascii\"><meta name=Generator content=\"Microsoft Word 14 (filtered medium)\"><style><!-- /* Font Definitions */ @font-face \t{font-family:Calibri; \tpanose-1:2 15 5 2 2 2 4 3 2 4;} /* Style Definitions */ p.MsoNormal, li.MsoNormal, div.MsoNormal \t{margin:0in; \tmargin-bottom:.0001pt; \tfont-size:11.0pt; \tfont-family:\"Calibri\",\"sans-serif\";} a:link, span.MsoHyperlink \t{mso-style-priority:99; \tcolor:blue; \ttext-decoration:underline;} a:visited, span.MsoHyperlinkFollowed \t{mso-style-priority:99; \tcolor:purple; \ttext-decoration:underline;} span.EmailStyle17 \t{mso-style-type:personal-compose; \tfont-family:\"Calibri\",\"sans-serif\"; \tcolor:windowtext;} .MsoChpDefault \t{mso-style-type:export-only; \tfont-family:\"Calibri\",\"sans-serif\";} @page WordSection1 \t{size:8.5in 11.0in; \tmargin:1.0in 1.0in 1.0in 1.0in;} div.WordSection1 \t{page:WordSection1;} --></style><!--[if gte mso 9]><xml> <o:shapedefaults v:ext=\"edit\" spidmax=\"1026\" /> </xml><![endif]--><!--[if gte mso 9]><xml> <o:shapelayout v:ext=\"edit\"> <o:idmap v:ext=\"edit\" data=\"1\" /> </o:shapelayout></xml><![endif]--></head><body lang=EN-US link=blue vlink=purple><div class=WordSection1><p class=MsoNormal>Dear cs,<br> <br> We are looking for employees working remotely.<br> <br> My name is Kari, I am the personnel manager of a large International company.<br> Most of the work you can do from home, that is, at a distance.<br> <b>Salary is $2000-$5300.</b><br> <br> If you are interested in this offer, please visit <a href=\"http://www.xn-----6kcabdfroa7c7a2as1an7a2j.xn--p1ai/components/com_contact/views/categories/tmpl/5f9506d3f8.html\"><b>Our Site</b></a><br> <br> Best regards!<br><o:p></o:p></p></div></body></html> ------=_NextPart_000_0032_01D2912F.05324BC6--  "
+			body := "Dear cs,    We are looking for employees working remotely.    My name is Kari, I am the personnel manager of a large International company.  Most of the work you can do from home, that is, at a distance.   Salary is $2000-$5300.    If you are interested in this offer, please visit  http://www.xn-----6kcabdfroa7c7a2as1an7a2j.xn--p1ai/components/com_contact/views/categories/tmpl/5f9506d3f8.html Our Site    Best regards!"
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
 					Subject: &subject,
 					Body:    &body,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
+		It("Load gzip-compressed mail content into struct", func() {
+			dir, err := ioutil.TempDir("", "sisyphus")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			raw, err := ioutil.ReadFile("test/Maildir/.Junk/cur/1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730:2,Sa")
+			Ω(err).ShouldNot(HaveOccurred())
+			var compressed bytes.Buffer
+			z := gzip.NewWriter(&compressed)
+			_, err = z.Write(raw)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(z.Close()).Should(Succeed())
+
+			err = s.Maildir(dir).CreateDirs()
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(dir, "cur", "1600000000.M1P1.test:2,S"), compressed.Bytes(), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			m := s.Mail{Key: "1600000000.M1P1.test"}
+			err = m.Load(s.Maildir(dir))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Subject).Should(Equal("hello"))
+			Ω(m.Header.Get("From")).Should(Equal("<hillebrad@striker.ottawa.on.ca>"))
+		})
+
+		It("Read no more text than configured", func() {
+			m := s.Mail{Options: s.Options{MaxBody: 16}}
+
+			err := m.Read(strings.NewReader("Subject: hello\n\nwonderful offers\nfor you today\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Body).Should(Equal("wonderful offers"))
+		})
+
+		It("Read text after lines longer than 64 KiB", func() {
+			m := s.Mail{}
+
+			long := strings.Repeat("offer ", 20000)
+			err := m.Read(strings.NewReader("Subject: hello\n\n" + long + "\nbuy now\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Body).Should(Equal(long + " buy now"))
+		})
+
+		It("Cut text short without splitting a character", func() {
+			m := s.Mail{Options: s.Options{MaxBody: 16}}
+
+			err := m.Read(strings.NewReader("Subject: hello\n\nwonderful offerés\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Body).Should(Equal("wonderful offer"))
+		})
+
 		It("Unload mail content from struct", func() {
 			m := s.Mail{
 				Key:     "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
@@ -185,12 +277,13 @@ var _ = Describe("Mail", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			subjectOutput := "hello"
-			bodyOutput := " ------ 000 0032 01d2912f.05324bc6 : ; cp-850 : dear cs we are looking for employees working remotely my name is kari i am the personnel manager of a large international company most of the work you can do from home that is at a distance salary is 2000- 5300 if you are interested in this offer please visit our site best regards ------ 000 0032 01d2912f.05324bc6 : ; cp-850 : dear cs we are looking for employees working remotely. my name is kari i am the personnel manager of a large international company. most of the work you can do from home that is at a distance. salary is 2000- 5300. if you are interested in this offer please visit our site best regards ------ 000 0032 01d2912f.05324bc6-- "
+			bodyOutput := "dear cs we are looking for employees working remotely my name is kari i am the personnel manager of a large international company most of the work you can do from home that is at a distance salary is 2000- 5300 if you are interested in this offer please visit http://www.xn-----6kcabdfroa7c7a2as1an7a2j.xn--p1ai/components/com contact/views/categories/tmpl/5f9506d3f8.html our site best regards "
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
 					Subject: &subjectOutput,
 					Body:    &bodyOutput,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
@@ -210,12 +303,13 @@ var _ = Describe("Mail", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			subjectOutput := "confirm remittance"
-			bodyOutput := " ------ 000 0085 01c2a9a6.0d17aca6 : ; ---- 001 0086 01c2a9a6.0d17aca6 ------ 001 0086 01c2a9a6.0d17aca6 : ; : 7bit pfa remmittance copy value date 27022017 confirm payment detail thanks best regards admin director alliance bank this e-mail has been scanned for all known computer viruses this e-mail and any files transmitted with it are confidential and intended solely for the use of the individual or entity to whom they are addressed if you are not the intended recipient you are hereby notified that any dissemination forwarding copying or use of any of the information is strictly prohibited and the e-mail should immediately be deleted cobantur boltas makes no warranty as to the accuracy or completeness of any information contained in this message and hereby excludes any liability of any kind for the information contained therein or for the information transmission reception storage or use of such in any way whatsoever the opinions expressed in this message belong to sender alone and may not necessarily reflect the opinions of cobantur boltas ------ 001 0086 01c2a9a6.0d17aca6 : ; index.jpeg "
+			bodyOutput := " pfa remmittance copy value date 27022017 confirm payment detail \u00a0 \u00a0 thanks best regards admin director alliance bank this e-mail has been scanned for all known computer viruses this e-mail and any files transmitted with it are confidential and intended solely for the use of the individual or entity to whom they are addressed if you are not the intended recipient you are hereby notified that any dissemination forwarding copying or use of any of the information is strictly prohibited and the e-mail should immediately be deleted cobantur boltas makes no warranty as to the accuracy or completeness of any information contained in this message and hereby excludes any liability of any kind for the information contained therein or for the information transmission reception storage or use of such in any way whatsoever the opinions expressed in this message belong to sender alone and may not necessarily reflect the opinions of cobantur boltas "
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488181583.M633084P4781.mail.carlostrub.ch,S=708375,W=720014:2,a",
 					Subject: &subjectOutput,
 					Body:    &bodyOutput,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
@@ -235,12 +329,13 @@ var _ = Describe("Mail", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			subjectOutput := "herpes breakthrough shocks medical world"
-			bodyOutput := "--5ba77035ef2d5e8c615e79c26f9448f3 : ; : 8bit --5ba77035ef2d5e8c615e79c26f9448f3 : ; : 8bit i got herpes from this girl at a club but i got rid of it fast with this alert: herpes finally cured by rachael rettner senior writer february 27 2017 studies in mice suggest that gut bacteria can influence anxiety and other mental states. credit: dreamstime view full size image a new drug has successfully combated the virus that causes genital herpes starting today it will be used as a treatment for people with the condition. there have been many topical creams and drugs used as herpes cure treatments these treatments for herpes give short-term relief but only this can remove the virus and prevent re-occurrences to cure herpes. end your embarrassment - cure your herpes were appointed as provincial governors alongside members of the local aristocracy the title of doux was used but unlike earlier times these were mostly civilian governors with little military authority theodore awarded titles with such largesse that erly exclusive titles such as pansebastos sebastos or megalodoxotatos were devalued and came to be held by city notables to secure his new capital theodore instituted a guard of tzakones under a kastrophylax he portrait of a middle-aged man with a dark forked beard wearing a golden jewel-encrusted domed crown john iii doukas vatatzes emperor of nicaea from a 15th-century manuscript of the extracts of history of john zonaras --5ba77035ef2d5e8c615e79c26f9448f3-- "
+			bodyOutput := " i got herpes from this girl at a club but i got rid of it fast with this http://nonnenrot.us/kx0eqjsfwbxkl01h5yjjrihvrqzygayvrp1ymztk http://nonnenrot.us/e59ow7wpvip5b4vzvjucb-qllyy1jukx0uowrpqy1w alert: herpes finally cured by rachael rettner senior writer\u00a0\u00a0 \u00a0\u00a0february 27 2017 http://nonnenrot.us/e59ow7wpvip5b4vzvjucb-qllyy1jukx0uowrpqy1w studies in mice suggest that gut bacteria can influence anxiety and other mental states credit: dreamstime http://nonnenrot.us/e59ow7wpvip5b4vzvjucb-qllyy1jukx0uowrpqy1w view full size image \u00a0 a new drug has successfully combated the virus that causes genital herpes starting today it will be used as a treatment for people with the condition \u00a0 there have been many topical creams and drugs used as herpes cure treatments these treatments for herpes give short-term relief http://nonnenrot.us/e59ow7wpvip5b4vzvjucb-qllyy1jukx0uowrpqy1w but only this can remove the virus and prevent re-occurrences to cure herpes \u00a0 \u00a0 http://nonnenrot.us/e59ow7wpvip5b4vzvjucb-qllyy1jukx0uowrpqy1w end your embarrassment - cure your herpes http://nonnenrot.us/danf2bnbumvdlkz2dddkkxc vvosyh16t4v0oqolpg were appointed as provincial governors alongside members of the local aristocracy the title of doux was used but unlike earlier times these were mostly civilian governors with little military authority theodore awarded titles with such largesse that erly exclusive titles such as pansebastos sebastos or megalodoxotatos were devalued and came to be held by city notables to secure his new capital theodore instituted a guard of tzakones under a kastrophylax he portrait of a middle-aged man with a dark forked beard wearing a golden jewel-encrusted domed crown john iii doukas vatatzes emperor of nicaea from a 15th-century manuscript of the extracts of history of john zonaras \u00a0 http://nonnenrot.us/d28ea0-f9ewxfuthac3ufrztccufi28f4kega-gl6a "
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
 					Subject: &subjectOutput,
 					Body:    &bodyOutput,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
@@ -260,12 +355,13 @@ var _ = Describe("Mail", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			subjectOutput := "cosan day 2017 new york friday march 24"
-			bodyOutput := " --97bb499b431c6ea9472ef64c004b1106 : ; b82d2d2d1215b6505c0692de003f7694 --b82d2d2d1215b6505c0692de003f7694 : ; 075713cc6dc6562a324d22c8001fd90a --075713cc6dc6562a324d22c8001fd90a : ; : invitation cosan day 2017 new york friday march 24 2017 venue: park hyatt new york 153 west 57th street between 6th and 7th avenue new york ny 10019 the onyx room second level program 08:30 am registration 09:00 am cosan s/a csan3 presentations and q amp;a 10:45 am rumo s/a rumo3 presentation and q amp;a 11:30 am cosan limited czz presentation and q amp;a 12:10 pm closing and lunch rsvp http://www.invite-taylor-rafferty.com/ cosan/irday2017/default.htm or call briget ampudia at taylor rafferty 212 889 4350 or email cosan taylor-rafferty.com czz listed nyse csan3 novo mercado bm amp;fbovespa cgas5 cgas3 bm amp;fbovespa rlog3 novo mercado bm amp;fbovespa rumo3 novo mercado bm amp;fbovespa --075713cc6dc6562a324d22c8001fd90a : ; : if you cannot download the image below please view invitation and register online here --075713cc6dc6562a324d22c8001fd90a-- --b82d2d2d1215b6505c0692de003f7694 : ; cosan day 2017.jpg "
+			bodyOutput := "invitation cosan day 2017 new york friday march 24 2017 venue: park hyatt new york 153 west 57th street between 6th and 7th avenue new york ny 10019 the onyx room second level program 08:30 am registration 09:00 am cosan s/a csan3 presentations and q amp;a 10:45 am rumo s/a rumo3 presentation and q amp;a 11:30 am cosan limited czz presentation and q amp;a 12:10 pm closing and lunch rsvp http://www.invite-taylor-rafferty.com/ cosan/irday2017/default.htm or call briget ampudia at taylor rafferty 212 889 4350 or email cosan taylor-rafferty.com czz listed nyse csan3 novo mercado bm amp;fbovespa cgas5 cgas3 bm amp;fbovespa rlog3 novo mercado bm amp;fbovespa rumo3 novo mercado bm amp;fbovespa "
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488226337.M327825P8269.mail.carlostrub.ch,S=802286,W=812785",
 					Subject: &subjectOutput,
 					Body:    &bodyOutput,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
@@ -283,12 +379,13 @@ var _ = Describe("Mail", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			subjectOutput := "wear glasses your eyes are headed for serious trouble"
-			bodyOutput := "--c2389532b48d1db204cfca8189242aeb : ; : 8bit --c2389532b48d1db204cfca8189242aeb : ; : 8bit snc .container width: 420px; .container .columns .container .column margin: 0; .container .fourteen.columns .container .fifteen.columns .container .sixteen.columns .container .one-third.column .container .two-thirds.column width: 420px; / self clearing goodness / .container:after content: 0020 ; display: block; height: 0; clear: both; visibility: hidden; .clearfix:before .clearfix:after .row:before .row:after content: 0020 ; display: block; overflow: hidden; visibility: hidden; width: 0; height: 0; .row:after .clearfix:after clear: both; .row .clearfix zoom: 1; .clear clear: both; display: block; overflow: hidden; visibility: hidden; width: 0; height: 0; if you wear glasses contacts or even if you think your vision can be improved you need to know about this.. in the link below you ll discover 1 weird trick that will drastically improve your vision gt; 1 trick to improve your vision today to your success 1 place ville marie 39th floor montreal quebec h3b4m7 canada email marketing by unsu bscribe westcott railway station served the village of westcott buckinghamshire near baron ferdinand de rothschild s estate at manor it was built by the duke of buckingham in 1871 as part of a short horse-drawn tramway that met the aylesbury and buckingham railway at quainton the next year it was converted for passenger use extended to brill railway station and renamed the brill tramway the poor quality locomotives running on the built and line were very slow initially limited to 5 miles per hour 8 km/h the line was taken over by the metropolitan railway in 1899 and transferred to public ownership in 1933 westcott station became part of the london underground despite being over 40 miles 60 km from central london until the closure of the line in 1935 the station building and its associated house pictured are the only significant buildings from the brill tramway to survive other than the junction station at quainton full article.. --c2389532b48d1db204cfca8189242aeb-- "
+			bodyOutput := " snc http://felytial.us/aw61h9d 3igrivfgejwhfjgf5dhiyda9b53s8q24 \u00a0 if you wear glasses contacts or even if you think your vision can be improved you need to know about this.. \u00a0 http://felytial.us/w2f8hnnjqg-ia-wyprrp8l1xpxzlisonvuwuv44d in the link below you ll discover 1 weird trick that will drastically improve your vision \u00a0 http://felytial.us/w2f8hnnjqg-ia-wyprrp8l1xpxzlisonvuwuv44d 1 trick to improve your vision today \u00a0 to your success \u00a0 \u00a0 \u00a0 \u00a0 \u00a0 1 place ville marie 39th floor montreal quebec h3b4m7 canada email marketing by http://felytial.us/w92jr rn m7aifzlrcibu7vuqy7baw-nxdn4ovs unsu bscribe \u00a0 http://felytial.us/n1royfqho-h0eprdo0n lbrxkah3pcdh0s2k44kg "
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488226337.M327833P8269.mail.carlostrub.ch,S=6960,W=7161:2,Sa",
 					Subject: &subjectOutput,
 					Body:    &bodyOutput,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
@@ -306,16 +403,160 @@ var _ = Describe("Mail", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 
 			subjectOutput := "always in good form with our viagra super active."
-			bodyOutput := " body .maintable height:100 important; width:100 important; margin:0; padding:0; img a img border:0; outline:none; text-decoration:none; .imagefix display:block; table td border-collapse:collapse; mso-table-lspace:0pt; mso-table-rspace:0pt; p margin:0; padding:0; margin-bottom:0; .readmsgbody width:100 ; .externalclass width:100 ; .externalclass .externalclass p .externalclass span .externalclass font .externalclass td .externalclass div line-height:100 ; img -ms-interpolation-mode: bicubic; body table td p a li blockquote -ms-text-size-adjust:100 ; -webkit-text-size-adjust:100 ; 96 \u00a0 if you can t read this email please view it online http://6url.ru/lhcj \u00a0 most popular products and special deals limited time offer hola the leading online store presents pharmaceuticals with delivery service in europe the united states and canada you can buy anti-acidity antifungals blood pressure herpes medication antifungals antibiotics anti-depressant diabetes medication antiviral anti-allergy/asthma and other various products keep your eye out for discount when purchasing\u00a0\u00a0\u00a0 check it now amazon web services inc is a subsidiary of amazon.com inc amazon.com is a registered trademark of amazon.com inc this message was produced and distributed by amazon web services inc 410 terry ave north seattle.https://aws.amazon.com/support if you no longer wish to receive these emails simply click on the following link unsubscribe © 2016 amazon all rights reserved \u00a0 "
+			bodyOutput := " \u00a0 if you can t read this email please view it online http://6url.ru/lhcj http://6url.ru/lhyv \u00a0 most popular products and special deals http://6url.ru/lhoe http://6url.ru/lhoo http://6url.ru/lhyh limited time offer hola the leading online store presents pharmaceuticals with delivery service in europe the united states and canada you can buy anti-acidity antifungals blood pressure herpes medication antifungals antibiotics anti-depressant diabetes medication antiviral anti-allergy/asthma and other various products keep your eye out for discount when purchasing\u00a0\u00a0\u00a0 http://6url.ru/lhny check it now amazon web services inc is a subsidiary of amazon.com inc amazon.com is a registered trademark of amazon.com inc this message was produced and distributed by amazon web services inc 410 terry ave north seattle https://aws.amazon.com/support if you no longer wish to receive these emails simply click on the following link https://aws.amazon.com/support/ unsubscribe © 2016 amazon all rights reserved \u00a0 "
 			Ω(m).Should(Equal(
 				s.Mail{
 					Key:     "1488228352.M339670P8269.mail.carlostrub.ch,S=12659,W=12782:2,Sa",
 					Subject: &subjectOutput,
 					Body:    &bodyOutput,
+					Header:  m.Header,
 					Junk:    true,
 				}))
 		})
 
+		It("Keep the markup of HTML mails if requested", func() {
+			m := s.Mail{
+				Key:     "1488228352.M339670P8269.mail.carlostrub.ch,S=12659,W=12782:2,Sa",
+				Junk:    true,
+				Options: s.Options{KeepHTML: true},
+			}
+
+			err := m.Load("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(*m.Body).Should(ContainSubstring("<style"))
+			Ω(*m.Body).Should(ContainSubstring("border-collapse"))
+		})
+
+		It("Extract visible text and links from HTML mails", func() {
+			m := s.Mail{
+				Key:  "1488228352.M339670P8269.mail.carlostrub.ch,S=12659,W=12782:2,Sa",
+				Junk: true,
+			}
+
+			err := m.Load("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(*m.Body).ShouldNot(ContainSubstring("<style"))
+			Ω(*m.Body).ShouldNot(ContainSubstring("border-collapse"))
+			Ω(*m.Body).Should(ContainSubstring("http://6url.ru/lhoe"))
+		})
+
+		It("Tokenize headers with a namespace", func() {
+			m := s.Mail{
+				Key:  "1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				Junk: true,
+			}
+
+			err := m.Load("test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			tokens, err := m.HeaderTokens()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(tokens).Should(ConsistOf(
+				"subj:hello",
+				"from:striker.ottawa.on.ca",
+				"return-path:striker.ottawa.on.ca",
+				"x-mailer:microsoft",
+				"x-mailer:outlook",
+			))
+
+			m.Options = s.Options{Headers: []string{"to"}}
+			tokens, err = m.HeaderTokens()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(tokens).Should(Equal([]string{"to:carlostrub.ch"}))
+
+			m.Options = s.Options{Headers: []string{}}
+			tokens, err = m.HeaderTokens()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(tokens).Should(BeEmpty())
+		})
+
+		It("Decode encoded words of the subject before tokenizing it", func() {
+			m := s.Mail{}
+
+			// "Viagra günstig" and "дешево" in windows-1251
+			err := m.Read(strings.NewReader("Subject: =?UTF-8?B?VmlhZ3JhIGfDvG5zdGln?= =?windows-1251?Q?=E4=E5=F8=E5=E2=EE?=\n\noffers\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Subject).Should(Equal("Viagra günstigдешево"))
+
+			tokens, err := m.HeaderTokens()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(tokens).Should(ContainElement("subj:viagra"))
+			Ω(tokens).ShouldNot(ContainElement(ContainSubstring("utf")))
+		})
+
+		It("Keep subjects that cannot be decoded", func() {
+			m := s.Mail{}
+
+			err := m.Read(strings.NewReader("Subject: =?x-unknown?Q?free?= offers\n\nbody\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(*m.Subject).Should(Equal("=?x-unknown?Q?free?= offers"))
+		})
+
+		It("Add bigrams to the wordlist if requested", func() {
+			body := "wire transfer today"
+			m := s.Mail{
+				Body:    &body,
+				Options: s.Options{Bigrams: true},
+			}
+
+			list, err := m.Wordlist()
+			Ω(err).ShouldNot(HaveOccurred())
+			sort.Strings(list)
+
+			Ω(list).Should(Equal(
+				[]string{"today", "transfer", "transfer today", "wire", "wire transfer"}))
+		})
+
+		It("Normalize words to Unicode NFKC and lowercase", func() {
+			body := "ｆｒｅｅ FREE Free"
+			m := s.Mail{Body: &body}
+
+			list, err := m.Wordlist()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(list).Should(Equal([]string{"free"}))
+		})
+
+		It("Keep words exactly as they are if requested", func() {
+			body := "ｆｒｅｅ FREE Free"
+			m := s.Mail{
+				Body:    &body,
+				Options: s.Options{ExactTokens: true},
+			}
+
+			list, err := m.Wordlist()
+			Ω(err).ShouldNot(HaveOccurred())
+			sort.Strings(list)
+			Ω(list).Should(Equal([]string{"FREE", "Free", "ｅ", "ｆ", "ｒ"}))
+		})
+
+		It("Leave out stop words if requested", func() {
+			body := "this offer ends with today"
+			m := s.Mail{
+				Body:    &body,
+				Options: s.Options{StopWords: s.DefaultStopWords},
+			}
+
+			list, err := m.Wordlist()
+			Ω(err).ShouldNot(HaveOccurred())
+			sort.Strings(list)
+			Ω(list).Should(Equal([]string{"ends", "offer", "today"}))
+		})
+
+		It("Count words of the configured length only", func() {
+			body := "act now to receive your cryptocurrency"
+			m := s.Mail{
+				Body:    &body,
+				Options: s.Options{MinToken: 3, MaxToken: 14},
+			}
+
+			list, err := m.Wordlist()
+			Ω(err).ShouldNot(HaveOccurred())
+			sort.Strings(list)
+			Ω(list).Should(Equal([]string{"act", "cryptocurrency", "now", "receive", "your"}))
+		})
+
 		It("Wordlist 1", func() {
 			m := s.Mail{
 				Key:  "1488181583.M633084P4781.mail.carlostrub.ch,S=708375,W=720014:2,a",
@@ -373,7 +614,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"alongside", "anxiety", "appointed", "authority", "awarded", "bacteria", "beard", "been", "came", "capital", "causes", "city", "civilian", "club", "combated", "creams", "crown", "cure", "cured", "dark", "devalued", "domed", "doukas", "doux", "dreamstime", "drug", "drugs", "earlier", "emperor", "erly", "exclusive", "extracts", "fast", "february", "finally", "forked", "from", "full", "genital", "girl", "give", "golden", "governors", "guard", "have", "held", "herpes", "history", "image", "influence", "instituted", "john", "largesse", "little", "local", "manuscript", "many", "medical", "members", "mental", "mice", "military", "mostly", "nicaea", "notables", "only", "other", "people", "portrait", "prevent", "provincial", "rachael", "relief", "remove", "rettner", "sebastos", "secure", "senior", "shocks", "size", "starting", "studies", "such", "suggest", "that", "theodore", "there", "these", "this", "times", "title", "titles", "today", "topical", "treatment", "treatments", "tzakones", "under", "unlike", "used", "vatatzes", "view", "virus", "wearing", "were", "will", "with", "world", "writer", "your", "zonaras"}))
+				[]string{"alongside", "anxiety", "appointed", "authority", "awarded", "bacteria", "beard", "been", "came", "capital", "causes", "city", "civilian", "club", "combated", "condition", "creams", "crown", "cure", "cured", "dark", "devalued", "domed", "doukas", "doux", "dreamstime", "drug", "drugs", "earlier", "emperor", "erly", "exclusive", "extracts", "fast", "finally", "forked", "from", "full", "genital", "girl", "give", "golden", "governors", "guard", "have", "held", "herpes", "history", "image", "influence", "instituted", "john", "largesse", "little", "local", "manuscript", "many", "medical", "members", "mental", "mice", "military", "mostly", "nicaea", "notables", "only", "other", "people", "portrait", "prevent", "provincial", "rachael", "relief", "remove", "rettner", "sebastos", "secure", "senior", "shocks", "size", "starting", "states", "studies", "such", "suggest", "that", "theodore", "there", "these", "this", "times", "title", "titles", "today", "topical", "treatment", "treatments", "tzakones", "under", "unlike", "used", "vatatzes", "view", "virus", "wearing", "were", "will", "with", "world", "your", "zonaras"}))
 		})
 
 		It("Wordlist 4", func() {
@@ -393,7 +634,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"ampudia", "avenue", "below", "between", "briget", "call", "cannot", "closing", "cosan", "download", "email", "friday", "here", "hyatt", "image", "invitation", "level", "limited", "listed", "lunch", "march", "mercado", "novo", "nyse", "online", "onyx", "park", "please", "program", "rafferty", "register", "room", "rsvp", "rumo", "second", "street", "taylor", "view", "west", "york"}))
+				[]string{"ampudia", "avenue", "between", "briget", "call", "closing", "cosan", "email", "friday", "hyatt", "invitation", "level", "limited", "listed", "lunch", "march", "mercado", "novo", "nyse", "onyx", "park", "program", "rafferty", "room", "rsvp", "rumo", "second", "street", "taylor", "west", "york"}))
 		})
 
 		It("Wordlist 5", func() {
@@ -413,7 +654,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"about", "associated", "aylesbury", "baron", "became", "being", "below", "brill", "bscribe", "buckingham", "building", "buildings", "built", "canada", "central", "clearing", "closure", "contacts", "converted", "despite", "discover", "duke", "email", "estate", "even", "extended", "eyes", "ferdinand", "floor", "from", "full", "glasses", "goodness", "headed", "hour", "house", "improve", "improved", "initially", "junction", "know", "limited", "line", "link", "london", "manor", "marie", "marketing", "miles", "montreal", "near", "need", "next", "only", "other", "over", "ownership", "part", "passenger", "pictured", "place", "poor", "public", "quainton", "quality", "quebec", "railway", "renamed", "rothschild", "running", "self", "serious", "served", "short", "slow", "station", "success", "survive", "taken", "than", "that", "think", "today", "tramway", "trick", "trouble", "unsu", "until", "very", "village", "ville", "vision", "wear", "weird", "were", "westcott", "will", "year", "your"}))
+				[]string{"about", "below", "bscribe", "canada", "contacts", "discover", "email", "even", "eyes", "floor", "glasses", "headed", "improve", "improved", "know", "link", "marie", "marketing", "montreal", "need", "place", "quebec", "serious", "success", "that", "think", "today", "trick", "trouble", "unsu", "ville", "vision", "wear", "weird", "will", "your"}))
 		})
 
 		It("Wordlist 6", func() {
@@ -433,7 +674,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"always", "amazon", "antiviral", "blockquote", "blood", "body", "canada", "check", "click", "deals", "delivery", "diabetes", "discount", "email", "emails", "europe", "following", "font", "form", "good", "herpes", "hola", "keep", "leading", "limited", "link", "longer", "medication", "message", "most", "north", "offer", "online", "other", "please", "popular", "presents", "pressure", "produced", "products", "read", "receive", "registered", "reserved", "rights", "service", "services", "simply", "span", "special", "states", "store", "subsidiary", "super", "table", "terry", "these", "this", "time", "trademark", "united", "various", "viagra", "view", "when", "wish", "with", "your"}))
+				[]string{"always", "amazon", "antiviral", "blood", "canada", "check", "click", "deals", "delivery", "diabetes", "discount", "email", "emails", "europe", "following", "form", "good", "herpes", "hola", "keep", "leading", "limited", "link", "longer", "medication", "message", "most", "north", "offer", "online", "other", "please", "popular", "presents", "pressure", "produced", "products", "read", "receive", "registered", "reserved", "rights", "seattle", "service", "services", "simply", "special", "states", "store", "subsidiary", "super", "terry", "these", "this", "time", "trademark", "united", "various", "viagra", "view", "when", "wish", "with", "your"}))
 		})
 
 		It("Wordlist 7", func() {
@@ -452,7 +693,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"amending", "both", "build", "builds", "clang", "convert", "danfe", "depends", "drop", "explicit", "fine", "install", "instead", "library", "localbase", "manually", "port", "powerpc", "prefer", "rather", "shared", "static", "than", "their", "uses", "utilize", "with", "xorg"}))
+				[]string{"amending", "args", "both", "build", "builds", "categories", "clang", "cmake", "comment", "convert", "danfe", "depends", "drop", "explicit", "fine", "framework", "glfw", "graphics", "install", "instead", "ldconfig", "library", "license", "localbase", "manually", "master", "opengl", "port", "portable", "portdocs", "powerpc", "prefer", "rather", "shared", "sites", "static", "than", "their", "type", "uses", "utilize", "with", "xcursor", "xinerama", "xorg", "xrandr", "zlib"}))
 		})
 
 		It("Wordlist 8", func() {
@@ -472,7 +713,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"‰", "⒏", "。", "《", "》", "下", "专", "倍", "六", "册", "利", "即", "取", "可", "合", "员", "回", "址", "够", "大", "天", "就", "彩", "拵", "拿", "提", "有", "永", "注", "澳", "特", "琻", "碼", "网", "赢", "邀", "钱", "门", "限", "領", "餸", "馈", "首", "，", "："}))
+				[]string{"‰", "。", "《", "》", "下", "专", "倍", "六", "册", "利", "即", "取", "可", "合", "员", "回", "址", "够", "大", "天", "就", "彩", "您", "拵", "拿", "提", "有", "永", "注", "澳", "点", "特", "琻", "碼", "网", "菛", "赢", "送", "邀", "钱", "门", "限", "領", "领", "餸", "馈", "首", "\ue796"}))
 		})
 
 		It("Wordlist 9", func() {
@@ -492,7 +733,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"‰", "⒏", "。", "《", "》", "下", "专", "倍", "六", "册", "利", "即", "取", "可", "合", "员", "回", "址", "够", "大", "天", "就", "彩", "拵", "拿", "提", "有", "永", "注", "澳", "特", "琻", "碼", "网", "赢", "邀", "钱", "门", "限", "領", "餸", "馈", "首", "，", "："}))
+				[]string{"‰", "。", "《", "》", "下", "专", "倍", "六", "册", "利", "即", "取", "可", "合", "员", "回", "址", "够", "大", "天", "就", "彩", "您", "拵", "拿", "提", "有", "永", "注", "澳", "点", "特", "琻", "碼", "网", "菛", "赢", "送", "邀", "钱", "门", "限", "領", "领", "餸", "馈", "首", "\ue796"}))
 		})
 
 		It("Wordlist 10", func() {
@@ -512,7 +753,7 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"agbetome", "banka", "drahy", "eddie", "fond", "odpov", "pozdravem", "prosim", "strycovy", "zesnuly"}))
+				[]string{"agbetome", "banka", "drahy", "eddie", "fond", "pozdravem", "prosim", "strycovy", "zesnuly"}))
 		})
 
 		It("Wordlist 11", func() {
@@ -533,7 +774,70 @@ var _ = Describe("Mail", func() {
 			sort.Strings(list)
 
 			Ω(list).Should(Equal(
-				[]string{"agbetome", "banka", "drahy", "eddie", "fond", "odpov", "pozdravem", "prosim", "strycovy", "zesnuly"}))
+				[]string{"agbetome", "banka", "drahy", "eddie", "fond", "pozdravem", "prosim", "strycovy", "zesnuly"}))
+		})
+	})
+
+	Context("Create the directories of a maildir", func() {
+		AfterEach(func() {
+			err := os.RemoveAll("test/Maildir3")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Create all missing directories, accessible by their owner only", func() {
+			err := os.MkdirAll("test/Maildir3/cur", 0755)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = s.LoadMaildirs([]s.Maildir{"test/Maildir3"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for _, dir := range []string{"new", "tmp", ".Junk", ".Junk/cur"} {
+				info, err := os.Stat(filepath.Join("test/Maildir3", dir))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(info.IsDir()).Should(BeTrue())
+				Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0700)))
+			}
+
+			// existing directories are left as they are
+			info, err := os.Stat("test/Maildir3/cur")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0755)))
+		})
+
+		It("Name the path that is not a directory", func() {
+			err := os.MkdirAll("test/Maildir3/cur", 0700)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ioutil.WriteFile("test/Maildir3/tmp", nil, 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = s.LoadMaildirs([]s.Maildir{"test/Maildir3"})
+			Ω(err).Should(MatchError("test/Maildir3/tmp is not a directory, but a file"))
+		})
+	})
+
+	Context("MIME", func() {
+		BeforeEach(func() {
+			err := s.LoadMaildirs([]s.Maildir{"test/Maildir3"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = ioutil.WriteFile("test/Maildir3/cur/1600000000.M1P1.test:2,S", []byte("Subject: nested\nMIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=\"outer\"\n\n--outer\nContent-Type: multipart/alternative; boundary=\"inner\"\n\n--inner\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: quoted-printable\n\nCheap pills shipped worldwide =\ntonight\n--inner\nContent-Type: text/html; charset=utf-8\nContent-Transfer-Encoding: base64\n\nPGh0bWw+PGJvZHk+PHA+Q2hlYXAgcGlsbHMgc2hpcHBlZCB3b3JsZHdpZGUgdG9uaWdodDwvcD48L2JvZHk+PC9odG1sPg==\n--inner--\n--outer\nContent-Type: application/octet-stream\nContent-Transfer-Encoding: base64\n\nAAQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMkJSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4/A==\n--outer--\n"), 0600)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			err := os.RemoveAll("test/Maildir3")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Walk nested multipart mails and decode their parts", func() {
+			m := s.Mail{
+				Key: "1600000000.M1P1.test",
+			}
+
+			err := m.Load("test/Maildir3")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(*m.Subject).Should(Equal("nested"))
+			Ω(*m.Body).Should(Equal("Cheap pills shipped worldwide tonight"))
 		})
 	})
 })
@@ -0,0 +1,112 @@
+package sisyphus
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrNoMbox is returned when reading a file that does not start with the
+// "From " line of an mbox.
+var ErrNoMbox = errors.New("not an mbox: missing From line")
+
+// IsMbox reports whether the data read from r starts like an mbox, i.e. with a
+// "From " line. It only peeks at r.
+func IsMbox(r *bufio.Reader) bool {
+	start, _ := r.Peek(5)
+
+	return string(start) == "From "
+}
+
+// ReadMbox splits the mbox read from r into its mails and calls fn with each
+// of them, one at a time. Mails are separated by lines starting with "From ";
+// lines within a mail that have been escaped to ">From ", or ">>From " and so
+// forth, lose one ">". It stops at the first error returned by fn and returns
+// it.
+func ReadMbox(r io.Reader, fn func(mail io.Reader) error) error {
+	in := bufio.NewReader(r)
+	if !IsMbox(in) {
+		return ErrNoMbox
+	}
+
+	var mail bytes.Buffer
+	flush := func() error {
+		if mail.Len() == 0 {
+			return nil
+		}
+		// the empty line before the next From line belongs to the mbox
+		raw := mail.Bytes()
+		switch {
+		case bytes.HasSuffix(raw, []byte("\r\n\r\n")):
+			raw = raw[:len(raw)-2]
+		case bytes.HasSuffix(raw, []byte("\n\n")):
+			raw = raw[:len(raw)-1]
+		}
+		err := fn(bytes.NewReader(raw))
+		mail.Reset()
+
+		return err
+	}
+
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		switch {
+		case strings.HasPrefix(line, "From "):
+			ferr := flush()
+			if ferr != nil {
+				return ferr
+			}
+		case strings.HasPrefix(strings.TrimLeft(line, ">"), "From "):
+			mail.WriteString(line[1:])
+		default:
+			mail.WriteString(line)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return flush()
+}
+
+// LearnMbox learns every mail of the mbox read from r like LearnReader, with
+// the label and options of m, e.g. to train from an archive of known junk.
+// Mails that cannot be learned are skipped with a warning. It returns the
+// numbers of mails learned and skipped.
+func (m Mail) LearnMbox(db *bolt.DB, r io.Reader) (learned, failed int, err error) {
+	err = ReadMbox(r, func(raw io.Reader) error {
+		mail := Mail{
+			Junk:    m.Junk,
+			Folder:  m.Folder,
+			Options: m.Options,
+		}
+		err := mail.LearnReader(db, raw)
+		if err != nil {
+			failed++
+			log.WithFields(log.Fields{
+				"err":    err,
+				"number": learned + failed,
+			}).Warning("Cannot learn mail of mbox, skipping it")
+			return nil
+		}
+		learned++
+
+		return nil
+	})
+
+	return learned, failed, err
+}
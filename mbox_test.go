@@ -0,0 +1,78 @@
+package sisyphus_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const mbox = `From alice@example.com Thu Mar  2 10:00:00 2017
+Message-Id: <1@example.com>
+Subject: cheap offer
+
+Buy now
+>From here on, everything is cheap
+
+From bob@example.com Thu Mar  2 11:00:00 2017
+Message-Id: <2@example.com>
+Subject: meeting agenda
+
+See you tomorrow
+`
+
+var _ = Describe("Mbox", func() {
+	Context("Read an mbox", func() {
+		It("Split the mbox into its mails and unescape From lines", func() {
+			var mails []string
+			err := ReadMbox(strings.NewReader(mbox), func(r io.Reader) error {
+				raw, err := ioutil.ReadAll(r)
+				mails = append(mails, string(raw))
+				return err
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mails).Should(Equal([]string{
+				"Message-Id: <1@example.com>\nSubject: cheap offer\n\nBuy now\nFrom here on, everything is cheap\n",
+				"Message-Id: <2@example.com>\nSubject: meeting agenda\n\nSee you tomorrow\n",
+			}))
+		})
+
+		It("Reject a file that is no mbox", func() {
+			err := ReadMbox(strings.NewReader("Subject: hello\n\nworld\n"), func(r io.Reader) error {
+				return nil
+			})
+			Ω(err).Should(Equal(ErrNoMbox))
+		})
+	})
+
+	Context("Learn an mbox", func() {
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Learn every mail of the mbox once", func() {
+			for i := 0; i < 2; i++ {
+				learned, failed, err := Mail{Junk: true}.LearnMbox(dbs["test/Maildir"], strings.NewReader(mbox))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(learned).Should(Equal(2))
+				Ω(failed).Should(BeZero())
+			}
+
+			gTotal, jTotal, _, _ := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(BeZero())
+			Ω(jTotal).Should(Equal(uint64(2)))
+		})
+	})
+})
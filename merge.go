@@ -0,0 +1,146 @@
+package sisyphus
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+	"github.com/retailnext/hllpp"
+)
+
+// ErrMergeItself is returned when a database is to be merged into itself.
+var ErrMergeItself = errors.New("cannot merge a database into itself")
+
+// ErrMergeKey is returned when the databases to be merged are encrypted with
+// different keys, see DatabaseKey, or only one of them is encrypted.
+var ErrMergeKey = errors.New("cannot merge databases encrypted differently")
+
+// MergeDatabases adds everything learned in database src to database dst, e.g.
+// to consolidate the accounts of a user. Unlike a round trip through
+// ExportModel and ImportModel, the counters of both databases are merged
+// themselves, so counts are summed exactly and the mails learned remain known:
+// they are not learned twice, and they can still be unlearned. A mail learned
+// in both databases is counted once, and words learned in only one of them are
+// added as they are. Database src is left unchanged.
+func MergeDatabases(dst, src *bolt.DB) error {
+	if dst == src {
+		return ErrMergeItself
+	}
+
+	return src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			if !sameKey(dtx, stx) {
+				return ErrMergeKey
+			}
+
+			for _, path := range [][]string{
+				{"Statistics"},
+				{"Wordlists", "Good"}, {"Wordlists", "Junk"},
+				{"Unlearned", "Good"}, {"Unlearned", "Junk"},
+			} {
+				err := mergeBucket(dtx, stx, path, mergeCounter)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, name := range []string{"Statistics", "Good", "Junk"} {
+				err := mergeBucket(dtx, stx, []string{"Decayed", name}, mergeDecayed)
+				if err != nil {
+					return err
+				}
+			}
+
+			// the times of the last learning and classification are the
+			// later ones of both, while the version of dst stays
+			for _, key := range []string{"LastLearned", "LastClassified"} {
+				err := mergeTime(dtx, stx, key)
+				if err != nil {
+					return err
+				}
+			}
+
+			// mails keep the class they have been learned in first
+			return mergeBucket(dtx, stx, []string{"Learned"}, func(old, v []byte) ([]byte, error) {
+				if old != nil {
+					return old, nil
+				}
+				return v, nil
+			})
+		})
+	})
+}
+
+// mergeBucket merges every value of the bucket at path in src into the same
+// bucket in dst, which is created if required, using merge to combine the
+// values of keys held by both.
+func mergeBucket(dst, src *bolt.Tx, path []string, merge func(old, v []byte) ([]byte, error)) error {
+	s := bucket(src, path...)
+	if s == nil {
+		return nil
+	}
+
+	d, err := dst.CreateBucketIfNotExists([]byte(path[0]))
+	if err != nil {
+		return err
+	}
+	for _, name := range path[1:] {
+		d, err = d.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.ForEach(func(k, v []byte) error {
+		merged, err := merge(d.Get(k), v)
+		if err != nil {
+			return err
+		}
+
+		return d.Put(k, merged)
+	})
+}
+
+// mergeCounter returns the union of two serialized counters
+func mergeCounter(old, v []byte) ([]byte, error) {
+	if len(old) == 0 {
+		return append([]byte(nil), v...), nil
+	}
+
+	a, err := hllpp.Unmarshal(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hllpp.Unmarshal(v)
+	if err != nil {
+		return nil, err
+	}
+	err = a.Merge(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Marshal(), nil
+}
+
+// mergeDecayed returns the sum of two decayed shares, see Decay
+func mergeDecayed(old, v []byte) ([]byte, error) {
+	return encodeFloat(decodeFloat(old) + decodeFloat(v)), nil
+}
+
+// mergeTime records the time under key in the Meta bucket of src in dst, if
+// it is later than the one of dst
+func mergeTime(dst, src *bolt.Tx, key string) error {
+	s, err := getTime(src, key)
+	if err != nil {
+		return err
+	}
+	d, err := getTime(dst, key)
+	if err != nil {
+		return err
+	}
+	if !s.After(d) {
+		return nil
+	}
+
+	return setTime(dst, key, s)
+}
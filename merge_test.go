@@ -0,0 +1,103 @@
+package sisyphus_test
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/boltdb/bolt"
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Merge", func() {
+	Context("Merge two databases", func() {
+
+		var src *bolt.DB
+
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			src, err = OpenDatabase("test/merge.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			src.Close()
+			err = os.Remove("test/merge.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("sums the counts of both databases", func() {
+			mails, err := Maildir("test/Maildir").Index()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			// learn the good mail into one database and junk into the
+			// other, then compare with learning all of them into one
+			for _, m := range mails {
+				db := src
+				if !m.Junk {
+					db = dbs["test/Maildir"]
+				}
+				err = m.Learn(db, "test/Maildir")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			all, err := OpenDatabase("test/all.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Remove("test/all.db")
+			defer all.Close()
+			err = LearnBatch(all, "test/Maildir", func() (l []Mail) {
+				for _, m := range mails {
+					l = append(l, *m)
+				}
+				return l
+			}())
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = MergeDatabases(dbs["test/Maildir"], src)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var merged, want bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &merged)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ExportModel(all, &want)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(merged.String()).Should(Equal(want.String()))
+
+			// the mails learned remain known
+			for _, m := range mails {
+				learned, err := m.Learned(dbs["test/Maildir"])
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(learned).Should(BeTrue())
+			}
+		})
+
+		It("sums decayed counts", func() {
+			err = SetMailCount(dbs["test/Maildir"], 2, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "meeting", 2, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = Decay(dbs["test/Maildir"], 0.5)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = ImportModel(src, bytes.NewBufferString("word,good_count,junk_count\n,1.5,3\nmeeting,0.5,1\ncheap,0,2\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = MergeDatabases(dbs["test/Maildir"], src)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var out bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal("word,good_count,junk_count\n,2.5,3\ncheap,0,2\nmeeting,1.5,1\n"))
+		})
+
+		It("refuses to merge a database into itself", func() {
+			err = MergeDatabases(src, src)
+			Ω(err).Should(Equal(ErrMergeItself))
+		})
+	})
+})
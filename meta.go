@@ -0,0 +1,42 @@
+package sisyphus
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// metaBucket returns the bucket holding facts about the database itself,
+// such as when it was last learned into, creating it in databases that
+// predate it
+func metaBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	return tx.CreateBucketIfNotExists([]byte("Meta"))
+}
+
+// setTime records t under key in the Meta bucket
+func setTime(tx *bolt.Tx, key string, t time.Time) error {
+	b, err := metaBucket(tx)
+	if err != nil {
+		return err
+	}
+
+	raw, err := t.UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(key), raw)
+}
+
+// getTime returns the time recorded under key in the Meta bucket, or the zero
+// time if there is none
+func getTime(tx *bolt.Tx, key string) (t time.Time, err error) {
+	raw := get(tx.Bucket([]byte("Meta")), key)
+	if raw == nil {
+		return t, nil
+	}
+
+	err = t.UnmarshalText(raw)
+
+	return t, err
+}
@@ -0,0 +1,150 @@
+package sisyphus
+
+import (
+	"errors"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/boltdb/bolt"
+)
+
+// SchemaVersion is the version of the layout of the buckets of a database
+// written by this version of sisyphus. Databases written before the layout
+// was versioned count as version 0.
+const SchemaVersion = 1
+
+// ErrSchemaVersion is returned when a database has been written by a newer
+// version of sisyphus, whose layout cannot be read safely.
+var ErrSchemaVersion = errors.New("database has been written by a newer version of sisyphus")
+
+// migrations upgrade the layout of a database, each one from the version of
+// its index to the next. Once released, a migration must never change, as
+// databases may have been upgraded by it already; add a new one instead. New
+// databases are created with the current layout by createBuckets instead.
+var migrations = []func(tx *bolt.Tx) error{
+	// 0: buckets added before the layout was versioned, such as Decayed,
+	// are created in databases that predate them
+	func(tx *bolt.Tx) error {
+		return createPaths(tx, [][]string{
+			{"Statistics"},
+			{"Wordlists", "Good"},
+			{"Wordlists", "Junk"},
+			{"Unlearned", "Good"},
+			{"Unlearned", "Junk"},
+			{"Learned"},
+			{"Decayed", "Statistics"},
+			{"Decayed", "Good"},
+			{"Decayed", "Junk"},
+			{"Meta"},
+		})
+	},
+}
+
+// Migrate upgrades the layout of a database written by an older version of
+// sisyphus to SchemaVersion, in a single transaction, so that it is either
+// upgraded completely or not at all. A read-only database cannot be upgraded
+// and is only checked. It returns ErrSchemaVersion if the database is newer.
+func Migrate(db *bolt.DB) error {
+	var from int
+	var fresh bool
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		fresh = tx.Bucket([]byte("Statistics")) == nil
+		from, err = version(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if from > SchemaVersion {
+		return ErrSchemaVersion
+	}
+	if from == SchemaVersion || db.IsReadOnly() {
+		return nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if fresh {
+			err := createBuckets(tx)
+			if err != nil {
+				return err
+			}
+			return setVersion(tx, SchemaVersion)
+		}
+
+		for _, migrate := range migrations[from:] {
+			err := migrate(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return setVersion(tx, SchemaVersion)
+	})
+	if err != nil {
+		return err
+	}
+	if fresh {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"db":   db.Path(),
+		"from": from,
+		"to":   SchemaVersion,
+	}).Info("Upgraded database")
+
+	return nil
+}
+
+// version returns the schema version recorded in the Meta bucket
+func version(tx *bolt.Tx) (int, error) {
+	raw := get(tx.Bucket([]byte("Meta")), "Version")
+	if raw == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(raw))
+}
+
+// setVersion records the schema version v in the Meta bucket
+func setVersion(tx *bolt.Tx, v int) error {
+	b, err := metaBucket(tx)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte("Version"), []byte(strconv.Itoa(v)))
+}
+
+// createBuckets creates all buckets of the current layout that are missing
+func createBuckets(tx *bolt.Tx) error {
+	paths := append([][]string{}, buckets...)
+	paths = append(paths,
+		[]string{"Decayed", "Statistics"},
+		[]string{"Decayed", "Good"},
+		[]string{"Decayed", "Junk"},
+		[]string{"Meta"},
+	)
+
+	return createPaths(tx, paths)
+}
+
+// createPaths creates the buckets at paths that are missing, along with their
+// parents
+func createPaths(tx *bolt.Tx, paths [][]string) error {
+	for _, path := range paths {
+		b, err := tx.CreateBucketIfNotExists([]byte(path[0]))
+		if err != nil {
+			return err
+		}
+		for _, name := range path[1:] {
+			b, err = b.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package sisyphus_test
+
+import (
+	"os"
+
+	"github.com/boltdb/bolt"
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migrate", func() {
+	Context("Upgrade the layout of a database", func() {
+		AfterEach(func() {
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		// version returns the schema version recorded in db
+		version := func(db *bolt.DB) (v string) {
+			err := db.View(func(tx *bolt.Tx) error {
+				v = string(tx.Bucket([]byte("Meta")).Get([]byte("Version")))
+				return nil
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			return v
+		}
+
+		It("Record the current version in a new database", func() {
+			dbs, err := LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+
+			Ω(version(dbs["test/Maildir"])).Should(Equal("1"))
+			Ω(Check(dbs["test/Maildir"])).Should(Succeed())
+		})
+
+		It("Upgrade a database predating versioning and keep what has been learned", func() {
+			db, err := bolt.Open("test/Maildir/sisyphus.db", 0600, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = db.Update(func(tx *bolt.Tx) error {
+				s, err := tx.CreateBucket([]byte("Statistics"))
+				if err != nil {
+					return err
+				}
+				err = s.Put([]byte("Something"), []byte("learned"))
+				if err != nil {
+					return err
+				}
+				w, err := tx.CreateBucket([]byte("Wordlists"))
+				if err != nil {
+					return err
+				}
+				_, err = w.CreateBucket([]byte("Good"))
+				return err
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(db.Close()).Should(Succeed())
+
+			dbs, err := LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer CloseDatabases(dbs)
+
+			db = dbs["test/Maildir"]
+			Ω(version(db)).Should(Equal("1"))
+			Ω(Check(db)).Should(Succeed())
+			err = db.View(func(tx *bolt.Tx) error {
+				Ω(tx.Bucket([]byte("Statistics")).Get([]byte("Something"))).Should(Equal([]byte("learned")))
+				Ω(tx.Bucket([]byte("Decayed")).Bucket([]byte("Junk"))).ShouldNot(BeNil())
+				return nil
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Refuse a database written by a newer version", func() {
+			db, err := bolt.Open("test/Maildir/sisyphus.db", 0600, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte("Meta"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("Version"), []byte("999"))
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(db.Close()).Should(Succeed())
+
+			_, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).Should(Equal(ErrSchemaVersion))
+		})
+	})
+})
@@ -0,0 +1,315 @@
+package sisyphus
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/retailnext/hllpp"
+)
+
+// modelHeader is the first line of an exported model
+var modelHeader = []string{"word", "good_count", "junk_count"}
+
+// ExportModel writes the learned model to w as CSV, independent of the
+// database format: a header line followed by a line per word with the
+// numbers of good and junk mails it has been learned from, sorted by word. The
+// first line after the header has an empty word and holds the numbers of
+// good and junk mails learned. Counts take unlearned and decayed mails into
+// account, so they need not be whole numbers.
+func ExportModel(db *bolt.DB, w io.Writer) error {
+	out := csv.NewWriter(w)
+	err := out.Write(modelHeader)
+	if err != nil {
+		return err
+	}
+
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		p := tx.Bucket([]byte("Statistics"))
+		d := bucket(tx, "Decayed", "Statistics")
+		var totals [2]float64
+		for i, class := range []string{"Good", "Junk"} {
+			totals[i], err = effective(get(p, "Processed"+class), get(p, "Unlearned"+class), get(d, class))
+			if err != nil {
+				return err
+			}
+		}
+		err = out.Write([]string{"", formatCount(totals[0]), formatCount(totals[1])})
+		if err != nil {
+			return err
+		}
+
+		// a word may have been learned in one class only; words are
+		// sorted in the clear, keys map them to where they are stored
+		keys := make(map[string]string)
+		var words []string
+		for _, class := range []string{"Good", "Junk"} {
+			b := bucket(tx, "Wordlists", class)
+			if b == nil {
+				continue
+			}
+			err = b.ForEach(func(k, v []byte) error {
+				word, err := wordOf(string(k))
+				if err != nil {
+					return err
+				}
+				if _, ok := keys[word]; !ok {
+					keys[word] = string(k)
+					words = append(words, word)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		sort.Strings(words)
+
+		for _, word := range words {
+			key := keys[word]
+			var counts [2]float64
+			for i, class := range []string{"Good", "Junk"} {
+				counts[i], err = effective(get(bucket(tx, "Wordlists", class), key),
+					get(bucket(tx, "Unlearned", class), key),
+					get(bucket(tx, "Decayed", class), key))
+				if err != nil {
+					return err
+				}
+			}
+			if counts[0] == 0 && counts[1] == 0 {
+				continue
+			}
+
+			err = out.Write([]string{word, formatCount(counts[0]), formatCount(counts[1])})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
+
+// formatCount formats a count of an exported model, without decimals if it is
+// a whole number
+func formatCount(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// modelRow is a line of an imported model
+type modelRow struct {
+	word   string
+	counts [2]float64
+}
+
+// ImportModel reads a model written by ExportModel from r and adds its counts
+// to those of the database, which may be empty. Thus, a new installation can
+// be seeded from a known-good model, or the models of two users be merged.
+// The whole model is rejected if any line is malformed, and the error tells
+// the line.
+//
+// As counts are HyperLogLog sketches of mail keys, an imported count is added
+// as that many made-up keys, unique to the import; fractions are recorded as
+// decayed, see Decay.
+func ImportModel(db *bolt.DB, r io.Reader) error {
+	rows, err := readModel(r)
+	if err != nil {
+		return err
+	}
+
+	prefix := fmt.Sprintf("import/%d", time.Now().UnixNano())
+
+	return db.Update(func(tx *bolt.Tx) error {
+		p := tx.Bucket([]byte("Statistics"))
+		s, err := decayedBucket(tx, "Statistics")
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			for i, class := range []string{"Good", "Junk"} {
+				n := row.counts[i]
+				if n == 0 {
+					continue
+				}
+
+				// the totals are held by the line with an empty word
+				b, name, d, key := p, "Processed"+class, s, class
+				if row.word != "" {
+					b = bucket(tx, "Wordlists", class)
+					d, err = decayedBucket(tx, class)
+					if err != nil {
+						return err
+					}
+					name, key = wordKey(row.word), wordKey(row.word)
+				}
+
+				added, err := addKeys(b, name, prefix+"/"+name+"/"+class, int(math.Ceil(n)))
+				if err != nil {
+					return err
+				}
+
+				// the estimate of the sketch may be off by a few keys
+				err = d.Put([]byte(key), encodeFloat(decodeFloat(get(d, key))+float64(added)-n))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// readModel reads and validates the lines of a model written by ExportModel
+func readModel(r io.Reader) (rows []modelRow, err error) {
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = len(modelHeader)
+
+	header, err := in.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("line 1: missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range modelHeader {
+		if header[i] != field {
+			return nil, fmt.Errorf("line 1: header must be %q, not %q",
+				strings.Join(modelHeader, ","), strings.Join(header, ","))
+		}
+	}
+
+	seen := make(map[string]int)
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := in.FieldPos(0)
+
+		row := modelRow{word: record[0]}
+		if first, ok := seen[row.word]; ok {
+			return nil, fmt.Errorf("line %d: %q already given on line %d", line, row.word, first)
+		}
+		seen[row.word] = line
+
+		for i, field := range record[1:] {
+			n, err := strconv.ParseFloat(field, 64)
+			if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+				return nil, fmt.Errorf("line %d: %s must be a non-negative number, not %q",
+					line, modelHeader[i+1], field)
+			}
+			row.counts[i] = n
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// addKeys adds n made-up mail keys to the counter stored under name in bucket
+// b and returns by how much its count has grown
+func addKeys(b *bolt.Bucket, name, prefix string, n int) (added float64, err error) {
+	raw := b.Get([]byte(name))
+	c := hllpp.New()
+	if len(raw) > 0 {
+		c, err = hllpp.Unmarshal(raw)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	before := c.Count()
+	for i := 0; i < n; i++ {
+		c.Add([]byte(fmt.Sprintf("%s/%d", prefix, i)))
+	}
+
+	return float64(c.Count()) - float64(before), b.Put([]byte(name), c.Marshal())
+}
+
+// SetWordCount sets the numbers of good and junk mails a word has been learned
+// from, replacing whatever has been learned about it. Together with
+// SetMailCount, it builds a model with known counts, e.g. for testing.
+func SetWordCount(db *bolt.DB, word string, good, junk int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		key := wordKey(word)
+		_, err := removeWord(tx, key)
+		if err != nil {
+			return err
+		}
+
+		for class, n := range map[string]int{"Good": good, "Junk": junk} {
+			if n <= 0 {
+				continue
+			}
+			err = bucket(tx, "Wordlists", class).Put([]byte(key), counter(word+"/"+class, n))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// SetMailCount sets the numbers of good and junk mails learned, replacing the
+// counts of the mails actually learned, see SetWordCount.
+func SetMailCount(db *bolt.DB, good, junk int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		p := tx.Bucket([]byte("Statistics"))
+		d, err := decayedBucket(tx, "Statistics")
+		if err != nil {
+			return err
+		}
+
+		for class, n := range map[string]int{"Good": good, "Junk": junk} {
+			for _, key := range []string{"Processed" + class, "Unlearned" + class} {
+				err = p.Delete([]byte(key))
+				if err != nil {
+					return err
+				}
+			}
+			err = d.Delete([]byte(class))
+			if err != nil {
+				return err
+			}
+
+			if n <= 0 {
+				continue
+			}
+			err = p.Put([]byte("Processed"+class), counter(class, n))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// counter returns a serialized counter of n distinct made-up mail keys
+func counter(prefix string, n int) []byte {
+	c := hllpp.New()
+	for i := 0; i < n; i++ {
+		c.Add([]byte(fmt.Sprintf("%s/%d", prefix, i)))
+	}
+
+	return c.Marshal()
+}
@@ -0,0 +1,227 @@
+package sisyphus_test
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Model", func() {
+	Context("Build a model with known counts", func() {
+
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = SetMailCount(dbs["test/Maildir"], 10, 10)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for word, counts := range map[string][2]int{
+				"cheap":   {1, 3},
+				"meeting": {6, 1},
+				"offer":   {2, 5},
+				"agenda":  {4, 0},
+			} {
+				err = SetWordCount(dbs["test/Maildir"], word, counts[0], counts[1])
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Export the model as CSV", func() {
+			var out bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(`word,good_count,junk_count
+,10,10
+agenda,4,0
+cheap,1,3
+meeting,6,1
+offer,2,5
+`))
+		})
+
+		It("Export decayed counts", func() {
+			err = Decay(dbs["test/Maildir"], 0.5)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var out bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(ContainSubstring("\n,5,5\n"))
+			Ω(out.String()).Should(ContainSubstring("\nmeeting,3,0.5\n"))
+		})
+
+		It("Import an exported model into an empty database", func() {
+			var model bytes.Buffer
+			err = Decay(dbs["test/Maildir"], 0.5)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = ExportModel(dbs["test/Maildir"], &model)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			db, err := OpenDatabase("test/import.db")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Remove("test/import.db")
+			defer db.Close()
+
+			err = ImportModel(db, bytes.NewReader(model.Bytes()))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var out bytes.Buffer
+			err = ExportModel(db, &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(model.String()))
+		})
+
+		It("Sum the counts of an imported model", func() {
+			err = ImportModel(dbs["test/Maildir"], bytes.NewBufferString(`word,good_count,junk_count
+,2,1.5
+cheap,0,1.5
+viagra,0,2
+`))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			var out bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(Equal(`word,good_count,junk_count
+,12,11.5
+agenda,4,0
+cheap,1,4.5
+meeting,6,1
+offer,2,5
+viagra,0,2
+`))
+		})
+
+		It("Reject malformed models", func() {
+			for model, msg := range map[string]string{
+				"":                                  "line 1: missing header",
+				"word,good,junk\n":                  "line 1: header must be",
+				"word,good_count,junk_count\na,1\n": "line 2",
+				"word,good_count,junk_count\na,1,2\nb,x,2\n":   "line 3: good_count must be a non-negative number",
+				"word,good_count,junk_count\na,1,2\nb,1,-2\n":  "line 3: junk_count must be a non-negative number",
+				"word,good_count,junk_count\na,1,2\na,1,2\n":   "line 3: \"a\" already given on line 2",
+				"word,good_count,junk_count\na,1,2\nb,NaN,2\n": "line 3: good_count",
+			} {
+				err = ImportModel(dbs["test/Maildir"], bytes.NewBufferString(model))
+				Ω(err).Should(MatchError(ContainSubstring(msg)))
+			}
+
+			// nothing has been imported
+			var out bytes.Buffer
+			err = ExportModel(dbs["test/Maildir"], &out)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.String()).Should(HavePrefix("word,good_count,junk_count\n,10,10\nagenda,4,0\n"))
+		})
+
+		It("Count the mails and words set", func() {
+			gTotal, jTotal, gWords, jWords := Info(dbs["test/Maildir"])
+			Ω(gTotal).Should(Equal(uint64(10)))
+			Ω(jTotal).Should(Equal(uint64(10)))
+			Ω(gWords).Should(Equal(uint64(4)))
+			Ω(jWords).Should(Equal(uint64(3)))
+		})
+
+		It("Score a word by its counts", func() {
+			_, prob, err := Junk(dbs["test/Maildir"], []string{"cheap"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically("~", 0.75, 1e-9))
+
+			_, prob, err = Junk(dbs["test/Maildir"], []string{"agenda"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(0.0))
+		})
+
+		It("Smooth the probabilities of rarely seen words", func() {
+			body := "cheap agenda"
+			scores, _, err := Explain(dbs["test/Maildir"], Mail{
+				Body:    &body,
+				Options: Options{Smoothing: 1},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(scores).Should(HaveLen(2))
+
+			// (1*0.5 + 4*0.25)/(1+4) and (1*0.5 + 4*1)/(1+4) of being good
+			Ω(scores[0].Word).Should(Equal("agenda"))
+			Ω(scores[0].Probability).Should(BeNumerically("~", 0.1, 1e-9))
+			Ω(scores[1].Word).Should(Equal("cheap"))
+			Ω(scores[1].Probability).Should(BeNumerically("~", 0.7, 1e-9))
+		})
+
+		It("Combine the words using Fisher's method", func() {
+			body := "cheap offer"
+			_, prob, err := Explain(dbs["test/Maildir"], Mail{Body: &body})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically("~", 1-2/(4+3.5), 1e-9))
+
+			_, prob, err = Explain(dbs["test/Maildir"], Mail{
+				Body:    &body,
+				Options: Options{Method: MethodFisher},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically("~", 0.8050749995868641, 1e-9))
+		})
+
+		It("Combine certain words using Fisher's method", func() {
+			// agenda has only been seen in good mails
+			body := "agenda"
+			_, prob, err := Explain(dbs["test/Maildir"], Mail{
+				Body:    &body,
+				Options: Options{Method: MethodFisher},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(0.0))
+		})
+
+		It("Score a mail by its most interesting words", func() {
+			body := "cheap meeting agenda"
+			_, prob, err := Explain(dbs["test/Maildir"], Mail{
+				Body:    &body,
+				Options: Options{MaxTokens: -1},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(BeNumerically("~", 1-3/(4+7.0/6+1), 1e-9))
+
+			// agenda has only been seen in good mails
+			_, prob, err = Explain(dbs["test/Maildir"], Mail{
+				Body:    &body,
+				Options: Options{MaxTokens: 1},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(0.0))
+		})
+
+		It("Replace the counts of a word", func() {
+			err = SetWordCount(dbs["test/Maildir"], "agenda", 0, 2)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, prob, err := Junk(dbs["test/Maildir"], []string{"agenda"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(1.0))
+		})
+
+		It("Combine the words independently of their order", func() {
+			_, prob, err := Junk(dbs["test/Maildir"], []string{"cheap", "meeting", "offer"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for _, words := range [][]string{
+				{"meeting", "offer", "cheap"},
+				{"offer", "cheap", "meeting"},
+				{"offer", "meeting", "cheap"},
+			} {
+				_, p, err := Junk(dbs["test/Maildir"], words)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(p).Should(Equal(prob))
+			}
+		})
+	})
+})
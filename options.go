@@ -0,0 +1,265 @@
+package sisyphus
+
+import "strings"
+
+// DefaultThreshold is the probability above which a mail is filed as junk if
+// no other threshold is configured.
+const DefaultThreshold = 0.6
+
+// DefaultMinToken and DefaultMaxToken are the lengths of the shortest and the
+// longest words that are counted if no other lengths are configured.
+const (
+	DefaultMinToken = 4
+	DefaultMaxToken = 10
+)
+
+// DefaultMaxBody is the number of bytes of text read from the body of a mail
+// if no other number is configured.
+const DefaultMaxBody = 1 << 20
+
+// DefaultMaxTokens is the number of words a mail is scored by if no other
+// number is configured.
+const DefaultMaxTokens = 15
+
+// DefaultJunkFolder is the folder of a maildir junk is moved to if no other
+// folder is configured.
+const DefaultJunkFolder = ".Junk"
+
+// SmoothingProbability is the probability of a word being good assumed in the
+// absence of any evidence, i.e. undecided, towards which the probabilities of
+// rarely seen words are pulled, see Options.Smoothing.
+const SmoothingProbability = 0.5
+
+// MethodBayes and MethodFisher are the methods of combining the probabilities
+// of the words of a mail, see Options.Method.
+const (
+	MethodBayes  = "bayes"
+	MethodFisher = "fisher"
+)
+
+// DefaultHeaders are the headers that are tokenized if no other headers are
+// configured.
+var DefaultHeaders = []string{"Subject", "From", "Reply-To", "Return-Path", "X-Mailer"}
+
+// Options holds the tunables used during learning and classification. The
+// zero value applies the defaults.
+type Options struct {
+	// Threshold is the probability above which a mail is filed as junk. It
+	// must lie within (0,1); any other value selects DefaultThreshold.
+	Threshold float64
+
+	// KeepHTML disables the extraction of visible text and links from HTML
+	// mails, so that their whole markup, including style sheets, is handed
+	// to the tokenizer instead.
+	KeepHTML bool
+
+	// AuditLog is the path of a file every classification decision is
+	// appended to, see RecordDecision. No decisions are recorded if empty.
+	AuditLog string
+
+	// Redact replaces the words in explanations, and the senders and their
+	// rules in audit logs and log messages, by short hashes, see Redact.
+	// What is learned and how mails are classified stays the same.
+	Redact bool
+
+	// ExactTokens disables the Unicode NFKC normalization and lowercasing
+	// of words, so that e.g. "FREE", "Free" and "ｆｒｅｅ" are told apart.
+	ExactTokens bool
+
+	// StopWords are left out of the words of a mail, e.g. DefaultStopWords.
+	// This makes the database much smaller, but costs a little accuracy,
+	// particularly in languages where a stop word of another language
+	// means something else. No words are left out if nil.
+	StopWords []string
+
+	// MinToken and MaxToken are the lengths of the shortest and the
+	// longest words that are counted; shorter and longer ones rarely help.
+	// Zero selects DefaultMinToken and DefaultMaxToken, respectively.
+	MinToken, MaxToken int
+
+	// Bigrams adds the pairs of consecutive words, e.g. "wire transfer",
+	// to the words of a mail, which catches phrases at the cost of a
+	// database several times as big.
+	Bigrams bool
+
+	// MaxBody is the number of bytes of text read from the body of a
+	// mail; the rest is ignored, as more words rarely help, but huge mails
+	// take up a lot of memory. Zero selects DefaultMaxBody.
+	MaxBody int
+
+	// Headers are the names of the headers that are tokenized in addition
+	// to the body, see Mail.HeaderTokens. If nil, DefaultHeaders are used;
+	// an empty slice disables header tokens.
+	Headers []string
+
+	// Upstream enables the verdicts of upstream filters, see
+	// Mail.UpstreamVerdicts, which then weigh in as strong evidence when a
+	// mail is classified.
+	Upstream bool
+
+	// UpstreamHeaders are the names of the headers holding the verdicts of
+	// upstream filters. If nil, DefaultUpstreamHeaders are used.
+	UpstreamHeaders []string
+
+	// MinTraining is the number of mails that must have been learned of
+	// both, good and junk, before mails are filed as junk. Until then,
+	// classification is little better than guessing. Zero files junk from
+	// the first mail learned on.
+	MinTraining int
+
+	// Whitelist holds the senders whose mails are never junk. Their mails
+	// are not scored at all.
+	Whitelist SenderList
+
+	// Blacklist holds the senders whose mails are always junk. Their mails
+	// are not scored at all. The whitelist takes precedence.
+	Blacklist SenderList
+
+	// Smoothing is the strength of the evidence of a word's probability
+	// assumed in its absence, Robinson's s: the probability of a word seen
+	// in n mails is pulled towards SmoothingProbability with the weight of
+	// s made-up mails, so that words seen in a single class only do not
+	// decide the classification unless they have been seen often. One is
+	// a good start. Zero, the default, and negative values disable
+	// smoothing.
+	Smoothing float64
+
+	// MaxTokens is the number of words a mail is scored by: only those
+	// whose probabilities are farthest from undecided are combined, like in
+	// SpamBayes, as the many neutral words of a mail merely blur its score.
+	// Zero selects DefaultMaxTokens, a negative number scores by all words.
+	MaxTokens int
+
+	// Method is the method of combining the probabilities of the words of
+	// a mail into its probability of being junk: MethodBayes, the default,
+	// takes their harmonic mean, while MethodFisher combines them using
+	// Fisher's method, like SpamBayes, which is less thrown off by many
+	// correlated words. Any other value selects MethodBayes.
+	Method string
+
+	// SubjectWeight, FromWeight and BodyWeight are the weights the tokens
+	// of the subject, e.g. "subj:free", of the From header and of the
+	// body, respectively, are scored with: a token of weight 2 counts as if
+	// it appeared twice in the mail, e.g. as a junk word in a short
+	// subject tells more than one in a long body. The tokens of all other
+	// headers weigh 1. Zero and negative weights select 1. With
+	// MethodFisher, the total weight of a mail's tokens is rounded to a
+	// whole number.
+	SubjectWeight, FromWeight, BodyWeight float64
+
+	// JunkFolder is the folder of the maildir junk is moved to, e.g.
+	// ".Spam" in a Maildir++ layout. Empty selects DefaultJunkFolder.
+	JunkFolder string
+}
+
+// threshold returns the configured junk threshold or its default
+func (o Options) threshold() float64 {
+	if o.Threshold <= 0 || o.Threshold >= 1 {
+		return DefaultThreshold
+	}
+
+	return o.Threshold
+}
+
+// minToken returns the configured length of the shortest word or its default
+func (o Options) minToken() int {
+	if o.MinToken <= 0 {
+		return DefaultMinToken
+	}
+
+	return o.MinToken
+}
+
+// maxToken returns the configured length of the longest word or its default
+func (o Options) maxToken() int {
+	if o.MaxToken <= 0 {
+		return DefaultMaxToken
+	}
+
+	return o.MaxToken
+}
+
+// maxBody returns the configured number of bytes of text to read from the
+// body of a mail or its default
+func (o Options) maxBody() int {
+	if o.MaxBody <= 0 {
+		return DefaultMaxBody
+	}
+
+	return o.MaxBody
+}
+
+// smoothing returns the configured strength of smoothing, zero if disabled
+func (o Options) smoothing() float64 {
+	if o.Smoothing < 0 {
+		return 0
+	}
+
+	return o.Smoothing
+}
+
+// maxTokens returns the configured number of words to score by or its default
+func (o Options) maxTokens() int {
+	if o.MaxTokens == 0 {
+		return DefaultMaxTokens
+	}
+
+	return o.MaxTokens
+}
+
+// method returns the configured method of combining probabilities or its
+// default
+func (o Options) method() string {
+	if o.Method == MethodFisher {
+		return MethodFisher
+	}
+
+	return MethodBayes
+}
+
+// tokenWeight returns the weight a token is scored with, depending on where in
+// the mail it has been found, see Options.SubjectWeight
+func (o Options) tokenWeight(token string) float64 {
+	w := o.BodyWeight
+	switch {
+	case strings.HasPrefix(token, namespace("Subject")+":"):
+		w = o.SubjectWeight
+	case strings.HasPrefix(token, namespace("From")+":"):
+		w = o.FromWeight
+	case strings.Contains(token, ":"):
+		return 1
+	}
+	if w <= 0 {
+		return 1
+	}
+
+	return w
+}
+
+// junkFolder returns the configured folder junk is moved to or its default
+func (o Options) junkFolder() string {
+	if o.JunkFolder == "" {
+		return DefaultJunkFolder
+	}
+
+	return o.JunkFolder
+}
+
+// headers returns the configured headers to tokenize or their default
+func (o Options) headers() []string {
+	if o.Headers == nil {
+		return DefaultHeaders
+	}
+
+	return o.Headers
+}
+
+// upstreamHeaders returns the configured headers of upstream filters or their
+// default
+func (o Options) upstreamHeaders() []string {
+	if o.UpstreamHeaders == nil {
+		return DefaultUpstreamHeaders
+	}
+
+	return o.UpstreamHeaders
+}
@@ -0,0 +1,93 @@
+package sisyphus
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/boltdb/bolt"
+)
+
+// wordBuckets are the paths of all buckets holding the counts of words
+var wordBuckets = [][]string{
+	{"Wordlists", "Good"}, {"Wordlists", "Junk"},
+	{"Unlearned", "Good"}, {"Unlearned", "Junk"},
+	{"Decayed", "Good"}, {"Decayed", "Junk"},
+}
+
+// Prune removes the words that have been seen in fewer than minCount mails of
+// both classes together, such as random hashes or message IDs, which never
+// help classification but make up most of a busy database. It logs the number
+// of words removed and the bytes freed; as BoltDB files never shrink, the
+// space is only reclaimed by Compact.
+func Prune(db *bolt.DB, minCount int) (err error) {
+
+	var pruned, freed int
+	err = db.Update(func(tx *bolt.Tx) error {
+		totals := make(map[string]float64)
+		for _, class := range []string{"Good", "Junk"} {
+			w := bucket(tx, "Wordlists", class)
+			u := bucket(tx, "Unlearned", class)
+			d := bucket(tx, "Decayed", class)
+			if w == nil {
+				continue
+			}
+			err := w.ForEach(func(k, v []byte) error {
+				n, err := effective(v, get(u, string(k)), get(d, string(k)))
+				if err != nil {
+					return err
+				}
+				totals[string(k)] += n
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for word, n := range totals {
+			if n >= float64(minCount) {
+				continue
+			}
+
+			f, err := removeWord(tx, word)
+			if err != nil {
+				return err
+			}
+			pruned++
+			freed += f
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"minimum": minCount,
+		"pruned":  pruned,
+		"freed":   freed,
+	}).Info("Pruned rare words")
+
+	return nil
+}
+
+// removeWord deletes a word from all buckets holding its counts and returns
+// the number of bytes freed
+func removeWord(tx *bolt.Tx, word string) (freed int, err error) {
+	for _, path := range wordBuckets {
+		b := bucket(tx, path...)
+		v := get(b, word)
+		if v == nil {
+			continue
+		}
+
+		err = b.Delete([]byte(word))
+		if err != nil {
+			return freed, err
+		}
+		freed += len(word) + len(v)
+	}
+
+	return freed, nil
+}
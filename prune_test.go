@@ -0,0 +1,77 @@
+package sisyphus_test
+
+import (
+	"math"
+	"os"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Prune", func() {
+	Context("Prune rare words", func() {
+
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			for _, key := range []string{
+				"1488226337.M327822P8269.mail.carlostrub.ch,S=3620,W=3730",
+				"1488226337.M327824P8269.mail.carlostrub.ch,S=8044,W=8167:2,Sa",
+			} {
+				m = &Mail{
+					Key:  key,
+					Junk: true,
+				}
+				err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			m = &Mail{
+				Key: "1488230510.M141612P8565.mail.carlostrub.ch,S=5978,W=6119",
+			}
+			err = m.Learn(dbs["test/Maildir"], "test/Maildir")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Remove words seen in fewer mails than the minimum", func() {
+			_, jTotal, _, jWords := Info(dbs["test/Maildir"])
+
+			err = Prune(dbs["test/Maildir"], 2)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, j, _, jW := Info(dbs["test/Maildir"])
+			Ω(j).Should(Equal(jTotal))
+			Ω(jW).Should(BeNumerically("<", jWords))
+			Ω(jW).Should(BeNumerically(">", 0))
+
+			// "from" has been learned from both mails
+			answer, prob, err := Junk(dbs["test/Maildir"], []string{"from"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(1.0))
+			Ω(answer).Should(BeTrue())
+
+			// "herpes" has been learned from one mail only
+			_, prob, err = Junk(dbs["test/Maildir"], []string{"herpes"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(math.IsNaN(prob)).Should(BeTrue())
+		})
+
+		It("Keep all words if the minimum is one", func() {
+			_, _, _, jWords := Info(dbs["test/Maildir"])
+
+			err = Prune(dbs["test/Maildir"], 1)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, _, _, jW := Info(dbs["test/Maildir"])
+			Ω(jW).Should(Equal(jWords))
+		})
+	})
+})
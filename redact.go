@@ -0,0 +1,33 @@
+package sisyphus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Redact replaces a word, or a sender, by the first eight hexadecimal digits
+// of its SHA-256 hash, so that output made for humans, such as explanations
+// and audit logs, can be shared without the content of the mails. The
+// namespace of a header token, e.g. "subj:", is kept. Equal words yield equal
+// hashes, so that they can still be told apart; however, a common word can
+// be guessed by hashing it, too.
+func Redact(word string) string {
+	var ns string
+	if i := strings.Index(word, ":"); i >= 0 {
+		ns, word = word[:i+1], word[i+1:]
+	}
+	sum := sha256.Sum256([]byte(word))
+
+	return ns + hex.EncodeToString(sum[:4])
+}
+
+// redact returns s redacted by Redact if the options ask for it, and as it is
+// otherwise
+func (o Options) redact(s string) string {
+	if !o.Redact || s == "" {
+		return s
+	}
+
+	return Redact(s)
+}
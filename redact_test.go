@@ -0,0 +1,59 @@
+package sisyphus_test
+
+import (
+	"os"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redact", func() {
+	Context("Redact words", func() {
+		It("Replace a word by a short hash", func() {
+			Ω(Redact("herpes")).Should(HaveLen(8))
+			Ω(Redact("herpes")).Should(Equal(Redact("herpes")))
+			Ω(Redact("herpes")).ShouldNot(Equal(Redact("with")))
+			Ω(Redact("herpes")).ShouldNot(ContainSubstring("herpes"))
+		})
+
+		It("Keep the namespace of a header token", func() {
+			Ω(Redact("subj:herpes")).Should(Equal("subj:" + Redact("herpes")))
+		})
+	})
+
+	Context("Redact explanations", func() {
+		BeforeEach(func() {
+			dbs, err = LoadDatabases([]Maildir{"test/Maildir"})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = SetMailCount(dbs["test/Maildir"], 1, 1)
+			Ω(err).ShouldNot(HaveOccurred())
+			err = SetWordCount(dbs["test/Maildir"], "herpes", 0, 1)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+		AfterEach(func() {
+			CloseDatabases(dbs)
+
+			err = os.Remove("test/Maildir/sisyphus.db")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("Explain the same probabilities with the words redacted", func() {
+			subject := "herpes"
+			plain, plainProb, err := Explain(dbs["test/Maildir"], Mail{Subject: &subject})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			scores, prob, err := Explain(dbs["test/Maildir"], Mail{
+				Subject: &subject,
+				Options: Options{Redact: true},
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(prob).Should(Equal(plainProb))
+			Ω(scores).Should(HaveLen(1))
+			Ω(scores[0].Word).Should(Equal(Redact("herpes")))
+			Ω(scores[0].Probability).Should(Equal(plain[0].Probability))
+		})
+	})
+})
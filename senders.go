@@ -0,0 +1,85 @@
+package sisyphus
+
+import (
+	"bufio"
+	"io"
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// SenderList is a list of rules matching the senders of mails. A rule is
+// either an address, e.g. john@example.com, which matches this address only,
+// or a domain, e.g. example.com, which matches all addresses of the domain and
+// of its subdomains. Rules may contain the wildcards of path.Match, e.g.
+// *.example.com for the subdomains only or *@example.com. Case is ignored.
+type SenderList []string
+
+// ReadSenderList reads a sender list from r, which holds one rule per line.
+// Empty lines and lines starting with # are ignored.
+func ReadSenderList(r io.Reader) (l SenderList, err error) {
+	return readLines(r)
+}
+
+// readLines returns the lines read from r without surrounding spaces,
+// skipping empty lines and lines starting with #
+func readLines(r io.Reader) (lines []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// Match returns the first rule matching the address, if any
+func (l SenderList) Match(address string) (rule string, ok bool) {
+	address = strings.ToLower(address)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", false
+	}
+	domain := address[at+1:]
+
+	for _, rule := range l {
+		r := strings.ToLower(rule)
+		if strings.Contains(r, "@") {
+			if match(r, address) {
+				return rule, true
+			}
+			continue
+		}
+		if match(r, domain) || strings.HasSuffix(domain, "."+r) {
+			return rule, true
+		}
+	}
+
+	return "", false
+}
+
+// match reports whether s matches the pattern of a rule. Malformed patterns
+// match nothing.
+func match(pattern, s string) bool {
+	ok, err := path.Match(pattern, s)
+
+	return err == nil && ok
+}
+
+// Sender returns the address in the From header of the loaded mail, or an
+// empty string if there is none
+func (m *Mail) Sender() string {
+	if m.Header == nil {
+		return ""
+	}
+
+	a, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+
+	return a.Address
+}
@@ -0,0 +1,65 @@
+package sisyphus_test
+
+import (
+	"strings"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Senders", func() {
+	Context("Match senders against a list of rules", func() {
+		l := SenderList{"john@example.com", "Example.org"}
+
+		It("matches an address exactly", func() {
+			rule, ok := l.Match("John@Example.com")
+			Ω(ok).Should(BeTrue())
+			Ω(rule).Should(Equal("john@example.com"))
+
+			_, ok = l.Match("jane@example.com")
+			Ω(ok).Should(BeFalse())
+		})
+
+		It("matches a domain and its subdomains", func() {
+			rule, ok := l.Match("jane@example.org")
+			Ω(ok).Should(BeTrue())
+			Ω(rule).Should(Equal("Example.org"))
+
+			_, ok = l.Match("jane@news.example.org")
+			Ω(ok).Should(BeTrue())
+
+			_, ok = l.Match("jane@badexample.org")
+			Ω(ok).Should(BeFalse())
+		})
+
+		It("matches wildcards", func() {
+			w := SenderList{"*.example.net", "*@example.com"}
+
+			rule, ok := w.Match("jane@mail.example.net")
+			Ω(ok).Should(BeTrue())
+			Ω(rule).Should(Equal("*.example.net"))
+
+			_, ok = w.Match("jane@example.net")
+			Ω(ok).Should(BeFalse())
+
+			rule, ok = w.Match("jane@example.com")
+			Ω(ok).Should(BeTrue())
+			Ω(rule).Should(Equal("*@example.com"))
+		})
+
+		It("matches nothing without an address", func() {
+			_, ok := l.Match("")
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Context("Read a list of rules", func() {
+		It("skips empty lines and comments", func() {
+			l, err := ReadSenderList(strings.NewReader("# newsletters\nnews@example.com\n\n  example.org  \n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(l).Should(Equal(SenderList{"news@example.com", "example.org"}))
+		})
+	})
+})
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	junkMail = "Subject: cheap pills\n\nbuy cheap pills today\n"
+	goodMail = "Subject: meeting notes\n\nnotes from today's meeting\n"
+)
+
+// run runs sisyphus with args on the mail and returns its exit code
+func run(mail string, args ...string) int {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "SISYPHUS_TEST_MAIN=1", "SISYPHUS_LOG_LEVEL=fatal")
+	cmd.Stdin = strings.NewReader(mail)
+
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+	exit, ok := err.(*exec.ExitError)
+	Ω(ok).Should(BeTrue())
+
+	return exit.Sys().(syscall.WaitStatus).ExitStatus()
+}
+
+var _ = Describe("Classify", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "sisyphus")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		d := sisyphus.Maildir(dir)
+		dbs, err := sisyphus.LoadDatabases([]sisyphus.Maildir{d})
+		Ω(err).ShouldNot(HaveOccurred())
+		defer sisyphus.CloseDatabases(dbs)
+
+		junk := &sisyphus.Mail{Junk: true}
+		err = junk.LearnReader(dbs[d], strings.NewReader(junkMail))
+		Ω(err).ShouldNot(HaveOccurred())
+		good := &sisyphus.Mail{}
+		err = good.LearnReader(dbs[d], strings.NewReader(goodMail))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = sisyphus.Backup(dbs[d], d)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context("For procmail", func() {
+		It("Exit 1 for junk and 0 for good mails", func() {
+			Ω(run(junkMail, "classify", "--stdin", dir)).Should(Equal(1))
+			Ω(run(goodMail, "classify", "--stdin", dir)).Should(Equal(0))
+		})
+
+		It("Exit 0 for mails that cannot be classified for any reason", func() {
+			Ω(run(junkMail, "classify", "--stdin", dir, dir)).Should(Equal(0))
+			Ω(run(junkMail, "classify", "--stdin")).Should(Equal(0))
+			Ω(run(junkMail, "classify", "--stdin", filepath.Join(dir, "missing"))).Should(Equal(0))
+			Ω(run(junkMail, "classify", "--stdin", "--socket", filepath.Join(dir, "missing.sock"))).Should(Equal(0))
+			Ω(run(junkMail, "--config", filepath.Join(dir, "missing.yml"), "classify", "--stdin", dir)).Should(Equal(0))
+			Ω(run(junkMail, "--log-level", "none", "classify", "--stdin", dir)).Should(Equal(0))
+		})
+	})
+
+	It("Exit 1 for mails that cannot be classified otherwise", func() {
+		Ω(run(junkMail, "classify", dir, dir)).Should(Equal(1))
+		Ω(run(junkMail, "--config", filepath.Join(dir, "missing.yml"), "classify", dir)).Should(Equal(1))
+	})
+})
@@ -0,0 +1,1204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// defaultClassifyTimeout is the time after which classifying a new mail is
+// given up if no other timeout is configured
+const defaultClassifyTimeout = 30 * time.Second
+
+// defaultScanInterval is the interval between scans for new mails the watcher
+// has missed if no other interval is configured
+const defaultScanInterval = 15 * time.Minute
+
+// defaultTrashWeight is the weight mails of the trash folder are learned with
+// if no other weight is configured
+const defaultTrashWeight = 0.25
+
+// config holds all settings of sisyphus
+type config struct {
+	Maildirs []sisyphus.Maildir
+	Duration time.Duration
+	DryRun   bool
+	Workers  int
+	// BackupInterval is the minimum time between two backups of a
+	// database; it is backed up before every learning cycle if zero
+	BackupInterval time.Duration
+	// ClassifyTimeout is the time after which classifying a new mail is
+	// given up
+	ClassifyTimeout time.Duration
+	// ScanInterval is the interval at which the new mails of all maildirs
+	// are looked for, in case the watcher has missed them; there are no
+	// such scans if zero
+	ScanInterval time.Duration
+	// SharedDB is the path of a database shared among all maildirs, if any
+	SharedDB string
+	// RestoreDB tells whether a database that cannot be read at startup is
+	// replaced by its backup
+	RestoreDB bool
+	// Decay is the factor learned words are decayed by after every
+	// learning cycle; they do not decay if zero
+	Decay float64
+	// MetricsAddr is the address to serve metrics on, if any
+	MetricsAddr string
+	// WebhookURL is the URL notified of every mail filed as junk, if any
+	WebhookURL string
+	// Folders are the folders learned from, along with their labels
+	Folders sisyphus.Folders
+	// TrashFolder is the folder learned as junk with TrashWeight, if any
+	TrashFolder string
+	TrashWeight float64
+	Options     sisyphus.Options
+	// IMAP holds the IMAP server to classify mails on, if any
+	IMAP imapConfig
+	// Milter holds the settings of the milter, if any
+	Milter milterConfig
+	// Socket is the path of the Unix socket to classify mails sent to, if
+	// any
+	Socket string
+	// Overrides holds the settings that differ for individual maildirs
+	Overrides map[sisyphus.Maildir]override
+}
+
+// override holds the settings of a maildir that take precedence over the
+// global ones; zero values are not overridden
+type override struct {
+	Duration  time.Duration
+	Threshold float64
+}
+
+// databasePath returns the path of the database of maildir d, which is the
+// shared database if configured
+func (c config) databasePath(d sisyphus.Maildir) string {
+	if c.SharedDB != "" {
+		return c.SharedDB
+	}
+
+	return d.DatabasePath()
+}
+
+// backupOf returns the maildir whose backup holds the database of maildir d.
+// A shared database is backed up once, along with the first maildir.
+func (c config) backupOf(d sisyphus.Maildir) sisyphus.Maildir {
+	if c.SharedDB != "" && len(c.Maildirs) > 0 {
+		return c.Maildirs[0]
+	}
+
+	return d
+}
+
+// loadDatabases opens the databases of all maildirs, or the shared database
+// if configured
+func (c config) loadDatabases() (map[sisyphus.Maildir]*bolt.DB, error) {
+	if c.SharedDB != "" {
+		return sisyphus.LoadSharedDatabase(c.Maildirs, c.SharedDB)
+	}
+
+	return sisyphus.LoadDatabases(c.Maildirs)
+}
+
+// loadAvailableDatabases opens the databases of all maildirs like
+// loadDatabases, but leaves out the maildirs whose database cannot be opened,
+// see sisyphus.LoadAvailableDatabases. A shared database is needed by all
+// maildirs, so that it must be opened.
+func (c config) loadAvailableDatabases() (map[sisyphus.Maildir]*bolt.DB, error) {
+	if c.SharedDB != "" {
+		return sisyphus.LoadSharedDatabase(c.Maildirs, c.SharedDB)
+	}
+
+	dbs, _ := sisyphus.LoadAvailableDatabases(c.Maildirs, c.RestoreDB)
+
+	return dbs, nil
+}
+
+// loadReadOnlyDatabases opens the databases of all maildirs, or the shared
+// database if configured, read-only, falling back to their backups while
+// sisyphus is running
+func (c config) loadReadOnlyDatabases() (map[sisyphus.Maildir]*bolt.DB, error) {
+	if c.SharedDB != "" {
+		return sisyphus.LoadReadOnlySharedDatabase(c.Maildirs, c.SharedDB)
+	}
+
+	return sisyphus.LoadReadOnlyDatabases(c.Maildirs)
+}
+
+// loadLiveDatabases opens the databases of all maildirs, or the shared database
+// if configured, read-only like loadReadOnlyDatabases, but never falls back to
+// their backups. It returns sisyphus.ErrLocked while sisyphus is running.
+func (c config) loadLiveDatabases() (map[sisyphus.Maildir]*bolt.DB, error) {
+	dbs := make(map[sisyphus.Maildir]*bolt.DB)
+	if c.SharedDB != "" {
+		db, err := sisyphus.OpenReadOnly(c.SharedDB)
+		if err != nil {
+			return dbs, err
+		}
+		for _, d := range c.Maildirs {
+			dbs[d] = db
+		}
+		return dbs, nil
+	}
+
+	for _, d := range c.Maildirs {
+		db, err := sisyphus.OpenReadOnly(d.DatabasePath())
+		if err != nil {
+			return dbs, err
+		}
+		dbs[d] = db
+	}
+
+	return dbs, nil
+}
+
+// duration returns the learning interval of a maildir
+func (c config) duration(d sisyphus.Maildir) time.Duration {
+	if o := c.Overrides[d]; o.Duration != 0 {
+		return o.Duration
+	}
+
+	return c.Duration
+}
+
+// options returns the classification options of a maildir
+func (c config) options(d sisyphus.Maildir) sisyphus.Options {
+	opts := c.Options
+	if o := c.Overrides[d]; o.Threshold != 0 {
+		opts.Threshold = o.Threshold
+	}
+
+	return opts
+}
+
+// configFile is the layout of the YAML configuration file
+type configFile struct {
+	Dirs            []string `yaml:"dirs"`
+	Exclude         []string `yaml:"exclude"`
+	Duration        string   `yaml:"duration"`
+	DryRun          bool     `yaml:"dry_run"`
+	Threshold       float64  `yaml:"threshold"`
+	Smoothing       float64  `yaml:"smoothing"`
+	SubjectWeight   float64  `yaml:"subject_weight"`
+	FromWeight      float64  `yaml:"from_weight"`
+	BodyWeight      float64  `yaml:"body_weight"`
+	Method          string   `yaml:"method"`
+	MaxTokens       int      `yaml:"max_tokens"`
+	KeepHTML        bool     `yaml:"keep_html"`
+	ExactTokens     bool     `yaml:"exact_tokens"`
+	Bigrams         bool     `yaml:"bigrams"`
+	MaxBody         int      `yaml:"max_body"`
+	MinToken        int      `yaml:"min_token"`
+	MaxToken        int      `yaml:"max_token"`
+	StopWords       bool     `yaml:"stop_words"`
+	StopWordsFile   string   `yaml:"stop_words_file"`
+	Workers         int      `yaml:"workers"`
+	BackupInterval  string   `yaml:"backup_interval"`
+	BackupKeep      int      `yaml:"backup_keep"`
+	BackupCompress  bool     `yaml:"backup_compress"`
+	ClassifyTimeout string   `yaml:"classify_timeout"`
+	ScanInterval    string   `yaml:"scan_interval"`
+	MetricsAddr     string   `yaml:"metrics_addr"`
+	Socket          string   `yaml:"socket"`
+	WebhookURL      string   `yaml:"webhook_url"`
+	AuditLog        string   `yaml:"audit_log"`
+	Redact          bool     `yaml:"redact"`
+	SharedDB        string   `yaml:"shared_db"`
+	RestoreDB       bool     `yaml:"restore_db"`
+	DBDir           string   `yaml:"db_dir"`
+	BackupDir       string   `yaml:"backup_dir"`
+	DBKey           string   `yaml:"db_key"`
+	DBKeyFile       string   `yaml:"db_key_file"`
+	Decay           float64  `yaml:"decay"`
+	MinTraining     int      `yaml:"min_training"`
+	// Headers is a pointer in order to tell an empty list, which disables
+	// header tokens, from a missing one
+	Headers         *[]string `yaml:"headers"`
+	Upstream        bool      `yaml:"upstream"`
+	UpstreamHeaders []string  `yaml:"upstream_headers"`
+	Whitelist       []string  `yaml:"whitelist"`
+	WhitelistFile   string    `yaml:"whitelist_file"`
+	Blacklist       []string  `yaml:"blacklist"`
+	BlacklistFile   string    `yaml:"blacklist_file"`
+	JunkDir         string    `yaml:"junk_dir"`
+	GoodFolders     []string  `yaml:"good_folders"`
+	JunkFolders     []string  `yaml:"junk_folders"`
+	TrashFolder     string    `yaml:"trash_folder"`
+	TrashWeight     float64   `yaml:"trash_weight"`
+
+	IMAP struct {
+		Host     string `yaml:"host"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		Mailbox  string `yaml:"mailbox"`
+		Junk     string `yaml:"junk"`
+		Maildir  string `yaml:"maildir"`
+	} `yaml:"imap"`
+
+	Milter struct {
+		Addr    string  `yaml:"addr"`
+		Maildir string  `yaml:"maildir"`
+		Reject  float64 `yaml:"reject"`
+	} `yaml:"milter"`
+
+	// Maildirs holds settings of individual maildirs, keyed by their path
+	Maildirs map[string]struct {
+		Duration  string  `yaml:"duration"`
+		Threshold float64 `yaml:"threshold"`
+	} `yaml:"maildirs"`
+}
+
+// senderList returns the rules of the configuration file along with those of
+// the file of rules, whose path may be overridden by environment variable env
+func senderList(rules []string, path, env string) sisyphus.SenderList {
+	l := sisyphus.SenderList(rules)
+
+	p, ok := os.LookupEnv(env)
+	if ok {
+		path = p
+	}
+	if path == "" {
+		return l
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"file": path,
+		}).Fatal("Cannot read list of senders")
+	}
+	defer f.Close()
+
+	fromFile, err := sisyphus.ReadSenderList(f)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"file": path,
+		}).Fatal("Cannot read list of senders")
+	}
+
+	return append(l, fromFile...)
+}
+
+// readStopWords returns the stop words of the file at path
+func readStopWords(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"file": path,
+		}).Fatal("Cannot read stop words")
+	}
+	defer f.Close()
+
+	words, err := sisyphus.ReadStopWords(f)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"file": path,
+		}).Fatal("Cannot read stop words")
+	}
+
+	return words
+}
+
+// useDBKey sets the key the words in the databases are encrypted with, read
+// from keyFile if given. Nothing is encrypted without a key.
+func useDBKey(key, keyFile string) {
+	if keyFile != "" {
+		raw, err := ioutil.ReadFile(expandHome(keyFile))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"file": keyFile,
+			}).Fatal("Cannot read database key")
+		}
+		key = strings.TrimRight(string(raw), "\r\n")
+	}
+	if key != "" {
+		sisyphus.DatabaseKey = []byte(key)
+	}
+}
+
+// useDBDir sets the directories the databases of the maildirs and their
+// backups are kept in. Without them, they are kept in the maildirs.
+func useDBDir(dir, backupDir string) {
+	if dir != "" {
+		sisyphus.DatabaseDir = expandHome(dir)
+	}
+	if backupDir != "" {
+		sisyphus.BackupDir = expandHome(backupDir)
+	}
+}
+
+// readConfigFile parses the configuration file at path
+func readConfigFile(path string) (f configFile, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+
+	err = yaml.UnmarshalStrict(raw, &f)
+
+	return f, err
+}
+
+// readDirs reads a newline-separated list of maildirs, skipping empty lines
+func readDirs(r io.Reader) (dirs []string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Cannot read maildirs from standard input")
+	}
+
+	return dirs
+}
+
+// expandDirs expands a leading ~ to the home directory and glob patterns such
+// as /home/*/Maildir in a list of maildirs. Only matches that are maildirs,
+// i.e. that have a "cur" and a "new" directory, are kept; other entries are
+// left as they are.
+func expandDirs(dirs []string) (expanded []string) {
+	for _, val := range dirs {
+		val = expandHome(val)
+		if !strings.ContainsAny(val, "*?[") {
+			expanded = append(expanded, val)
+			continue
+		}
+
+		matches, err := filepath.Glob(val)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"pattern": val,
+			}).Fatal("Cannot expand pattern of maildirs")
+		}
+		if len(matches) == 0 {
+			log.WithFields(log.Fields{
+				"pattern": val,
+			}).Warning("Pattern does not match any maildir")
+		}
+
+		for _, m := range matches {
+			if !isMaildir(m) {
+				log.WithFields(log.Fields{
+					"dir": m,
+				}).Warning("Skipping match that is not a maildir")
+				continue
+			}
+			expanded = append(expanded, m)
+		}
+	}
+
+	return expanded
+}
+
+// excludeDirs removes the maildirs matching any of the given paths or glob
+// patterns, e.g. /home/shared/Maildir or /home/*/Maildir/.Archive, from dirs
+func excludeDirs(dirs, exclude []string) (kept []string) {
+	var patterns []string
+	for _, p := range exclude {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		patterns = append(patterns, filepath.Clean(expandHome(p)))
+	}
+
+	for _, d := range dirs {
+		excluded := false
+		for _, p := range patterns {
+			match, err := filepath.Match(p, filepath.Clean(d))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":     err,
+					"pattern": p,
+				}).Fatal("Cannot parse pattern of excluded maildirs")
+			}
+			if match {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			log.WithFields(log.Fields{
+				"dir": d,
+			}).Info("Excluding maildir")
+			continue
+		}
+		kept = append(kept, d)
+	}
+
+	return kept
+}
+
+// expandHome replaces a leading ~ of path by the home directory of the user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"dir": path,
+		}).Fatal("Cannot expand ~ to the home directory")
+	}
+
+	return filepath.Join(home, path[1:])
+}
+
+// resolveDir expands a leading ~ of the maildir at path and resolves symbolic
+// links, as events in a directory are missed when watching a link to it. A
+// maildir that cannot be resolved, e.g. as it does not exist yet, is left as
+// it is.
+func resolveDir(path string) sisyphus.Maildir {
+	if path == "" {
+		return ""
+	}
+
+	expanded := expandHome(path)
+	resolved, err := filepath.EvalSymlinks(expanded)
+	if err != nil {
+		return sisyphus.Maildir(expanded)
+	}
+	if resolved != filepath.Clean(path) {
+		log.WithFields(log.Fields{
+			"dir":      path,
+			"resolved": resolved,
+		}).Info("Resolved maildir")
+	}
+
+	return sisyphus.Maildir(resolved)
+}
+
+// isMaildir reports whether dir looks like a maildir
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setupLogging sets the format and level of the logs, as given by the
+// SISYPHUS_LOG_FORMAT and SISYPHUS_LOG_LEVEL environment variables
+func setupLogging(format, level string) error {
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(l)
+
+	return nil
+}
+
+// loadConfig reads the optional configuration file at path, applies the
+// environment variables on top of it and checks the validity of the result
+func loadConfig(path string) (cfg config) {
+
+	var f configFile
+	if path != "" {
+		var err error
+		f, err = readConfigFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"file": path,
+			}).Fatal("Cannot read configuration file")
+		}
+	}
+
+	// Environment variables override the configuration file
+	dirsRaw, ok := os.LookupEnv("SISYPHUS_DIRS")
+	switch {
+	case dirsRaw == "-":
+		f.Dirs = readDirs(os.Stdin)
+	case ok:
+		f.Dirs = strings.Split(dirsRaw, ",")
+	}
+
+	excludeRaw, ok := os.LookupEnv("SISYPHUS_EXCLUDE")
+	if ok {
+		f.Exclude = strings.Split(excludeRaw, ",")
+	}
+
+	for _, val := range excludeDirs(expandDirs(f.Dirs), f.Exclude) {
+		cfg.Maildirs = append(cfg.Maildirs, sisyphus.Maildir(val))
+	}
+	if len(cfg.Maildirs) == 0 {
+		log.Fatal("Neither environment variable SISYPHUS_DIRS nor dirs in the configuration file set, or all of them are excluded.")
+	}
+
+	// Create missing Maildirs
+	err := sisyphus.LoadMaildirs(cfg.Maildirs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Cannot load maildirs")
+	}
+	resolved := make(map[sisyphus.Maildir]bool)
+	maildirs := cfg.Maildirs[:0]
+	for _, d := range cfg.Maildirs {
+		r := resolveDir(string(d))
+		if resolved[r] {
+			log.WithFields(log.Fields{
+				"dir": string(d),
+			}).Warning("Skipping maildir configured more than once")
+			continue
+		}
+		resolved[r] = true
+		maildirs = append(maildirs, r)
+	}
+	cfg.Maildirs = maildirs
+
+	// Check duration configuration and set it to default value if
+	// not set
+	durationRaw, ok := os.LookupEnv("SISYPHUS_DURATION")
+	if ok {
+		f.Duration = durationRaw
+	}
+	if f.Duration == "" {
+		log.Info("Environment variable SISYPHUS_DURATION not set. Setting default value to 24h.")
+		f.Duration = "24h"
+	}
+	cfg.Duration, err = time.ParseDuration(f.Duration)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"duration": f.Duration,
+		}).Fatal("Cannot parse duration for learning intervals.")
+	}
+	if cfg.Duration <= 0 {
+		log.WithFields(log.Fields{
+			"duration": f.Duration,
+		}).Fatal("Duration for learning intervals must be positive, e.g. 12h.")
+	}
+
+	backupRaw, ok := os.LookupEnv("SISYPHUS_BACKUP_INTERVAL")
+	if ok {
+		f.BackupInterval = backupRaw
+	}
+	if f.BackupInterval != "" {
+		cfg.BackupInterval, err = time.ParseDuration(f.BackupInterval)
+		if err != nil || cfg.BackupInterval < 0 {
+			log.WithFields(log.Fields{
+				"interval": f.BackupInterval,
+			}).Fatal("Cannot parse interval between backups, e.g. 168h.")
+		}
+	}
+
+	// Compression and the number of timestamped backups apply to all
+	// databases
+	_, compress := os.LookupEnv("SISYPHUS_BACKUP_COMPRESS")
+	sisyphus.CompressBackups = f.BackupCompress || compress
+
+	keepRaw, ok := os.LookupEnv("SISYPHUS_BACKUP_KEEP")
+	if !ok && f.BackupKeep != 0 {
+		keepRaw, ok = strconv.Itoa(f.BackupKeep), true
+	}
+	if ok {
+		keep, err := strconv.Atoi(keepRaw)
+		if err != nil || keep < 0 {
+			log.WithFields(log.Fields{
+				"keep": keepRaw,
+			}).Warning("Number of backups kept must not be negative. Keeping the latest backup only.")
+		} else {
+			sisyphus.BackupKeep = keep
+		}
+	}
+
+	cfg.ClassifyTimeout = defaultClassifyTimeout
+	timeoutRaw, ok := os.LookupEnv("SISYPHUS_CLASSIFY_TIMEOUT")
+	if ok {
+		f.ClassifyTimeout = timeoutRaw
+	}
+	if f.ClassifyTimeout != "" {
+		cfg.ClassifyTimeout, err = time.ParseDuration(f.ClassifyTimeout)
+		if err != nil || cfg.ClassifyTimeout <= 0 {
+			log.WithFields(log.Fields{
+				"timeout": f.ClassifyTimeout,
+			}).Fatal("Cannot parse timeout for classifying a mail, e.g. 30s.")
+		}
+	}
+
+	cfg.ScanInterval = defaultScanInterval
+	scanRaw, ok := os.LookupEnv("SISYPHUS_SCAN_INTERVAL")
+	if ok {
+		f.ScanInterval = scanRaw
+	}
+	if f.ScanInterval != "" {
+		cfg.ScanInterval, err = time.ParseDuration(f.ScanInterval)
+		if err != nil || cfg.ScanInterval < 0 {
+			log.WithFields(log.Fields{
+				"interval": f.ScanInterval,
+			}).Fatal("Cannot parse interval between scans for new mails, e.g. 15m.")
+		}
+	}
+
+	_, dryRun := os.LookupEnv("SISYPHUS_DRY_RUN")
+	cfg.DryRun = f.DryRun || dryRun
+
+	// Check threshold configuration and fall back to the default value if
+	// not set or invalid
+	cfg.Options.Threshold = sisyphus.DefaultThreshold
+	thresholdRaw, ok := os.LookupEnv("SISYPHUS_THRESHOLD")
+	if !ok && f.Threshold != 0 {
+		thresholdRaw, ok = strconv.FormatFloat(f.Threshold, 'g', -1, 64), true
+	}
+	if ok {
+		threshold, err := strconv.ParseFloat(thresholdRaw, 64)
+		if err != nil || threshold <= 0 || threshold >= 1 {
+			log.WithFields(log.Fields{
+				"threshold": thresholdRaw,
+			}).Warning("Threshold must lie within (0,1). Setting default value to 0.6.")
+		} else {
+			cfg.Options.Threshold = threshold
+		}
+	}
+
+	// Check the smoothing and disable it if it is invalid
+	smoothingRaw, ok := os.LookupEnv("SISYPHUS_SMOOTHING")
+	if !ok && f.Smoothing != 0 {
+		smoothingRaw, ok = strconv.FormatFloat(f.Smoothing, 'g', -1, 64), true
+	}
+	if ok && smoothingRaw != "" {
+		smoothing, err := strconv.ParseFloat(smoothingRaw, 64)
+		if err != nil || smoothing < 0 || math.IsInf(smoothing, 0) || math.IsNaN(smoothing) {
+			log.WithFields(log.Fields{
+				"smoothing": smoothingRaw,
+			}).Warning("Smoothing must be a non-negative number. Disabling smoothing.")
+		} else {
+			cfg.Options.Smoothing = smoothing
+		}
+	}
+
+	// Check the weights of the words by where they appear and ignore
+	// invalid ones
+	for _, w := range []struct {
+		env    string
+		file   float64
+		weight *float64
+	}{
+		{"SISYPHUS_SUBJECT_WEIGHT", f.SubjectWeight, &cfg.Options.SubjectWeight},
+		{"SISYPHUS_FROM_WEIGHT", f.FromWeight, &cfg.Options.FromWeight},
+		{"SISYPHUS_BODY_WEIGHT", f.BodyWeight, &cfg.Options.BodyWeight},
+	} {
+		weightRaw, ok := os.LookupEnv(w.env)
+		if !ok && w.file != 0 {
+			weightRaw, ok = strconv.FormatFloat(w.file, 'g', -1, 64), true
+		}
+		if !ok || weightRaw == "" {
+			continue
+		}
+		weight, err := strconv.ParseFloat(weightRaw, 64)
+		if err != nil || weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+			log.WithFields(log.Fields{
+				"weight": weightRaw,
+				"env":    w.env,
+			}).Warning("Weight must be a positive number. Setting default value to 1.")
+			continue
+		}
+		*w.weight = weight
+	}
+
+	// Check the method of combining probabilities
+	method := f.Method
+	if env, ok := os.LookupEnv("SISYPHUS_METHOD"); ok {
+		method = env
+	}
+	switch method {
+	case "", sisyphus.MethodBayes, sisyphus.MethodFisher:
+		cfg.Options.Method = method
+	default:
+		log.WithFields(log.Fields{
+			"method": method,
+		}).Warning("Method must be bayes or fisher. Setting default value to bayes.")
+	}
+
+	// Check the decay factor and disable decay if it is invalid
+	decayRaw, ok := os.LookupEnv("SISYPHUS_DECAY")
+	if !ok && f.Decay != 0 {
+		decayRaw, ok = strconv.FormatFloat(f.Decay, 'g', -1, 64), true
+	}
+	if ok && decayRaw != "" {
+		decay, err := strconv.ParseFloat(decayRaw, 64)
+		if err != nil || decay <= 0 || decay >= 1 {
+			log.WithFields(log.Fields{
+				"decay": decayRaw,
+			}).Warning("Decay factor must lie within (0,1). Learned words will not decay.")
+		} else {
+			cfg.Decay = decay
+		}
+	}
+
+	// Check the minimum of mails to learn before filing junk
+	minRaw, ok := os.LookupEnv("SISYPHUS_MIN_TRAINING")
+	if !ok && f.MinTraining != 0 {
+		minRaw, ok = strconv.Itoa(f.MinTraining), true
+	}
+	if ok {
+		min, err := strconv.Atoi(minRaw)
+		if err != nil || min < 0 {
+			log.WithFields(log.Fields{
+				"minimum": minRaw,
+			}).Warning("Minimum of mails learned must not be negative. Filing junk from the first mail learned on.")
+		} else {
+			cfg.Options.MinTraining = min
+		}
+	}
+
+	// Check the number of learning workers and default to one per CPU
+	cfg.Workers = runtime.GOMAXPROCS(0)
+	workersRaw, ok := os.LookupEnv("SISYPHUS_WORKERS")
+	if !ok && f.Workers != 0 {
+		workersRaw, ok = strconv.Itoa(f.Workers), true
+	}
+	if ok {
+		workers, err := strconv.Atoi(workersRaw)
+		if err != nil || workers <= 0 {
+			log.WithFields(log.Fields{
+				"workers": workersRaw,
+			}).Warning("Number of workers must be positive. Setting default value to the number of CPUs.")
+		} else {
+			cfg.Workers = workers
+		}
+	}
+
+	cfg.Socket = f.Socket
+	socket, ok := os.LookupEnv("SISYPHUS_SOCKET")
+	if ok {
+		cfg.Socket = socket
+	}
+	cfg.Socket = expandHome(cfg.Socket)
+
+	cfg.MetricsAddr = f.MetricsAddr
+	metricsAddr, ok := os.LookupEnv("SISYPHUS_METRICS_ADDR")
+	if ok {
+		cfg.MetricsAddr = metricsAddr
+	}
+
+	cfg.WebhookURL = f.WebhookURL
+	webhookURL, ok := os.LookupEnv("SISYPHUS_WEBHOOK_URL")
+	if ok {
+		cfg.WebhookURL = webhookURL
+	}
+
+	cfg.SharedDB = f.SharedDB
+	sharedDB, ok := os.LookupEnv("SISYPHUS_SHARED_DB")
+	if ok {
+		cfg.SharedDB = sharedDB
+	}
+
+	_, restoreDB := os.LookupEnv("SISYPHUS_RESTORE_DB")
+	cfg.RestoreDB = f.RestoreDB || restoreDB
+
+	// The key encrypting the words in the databases applies to all of
+	// them, including backups
+	dbKey, ok := os.LookupEnv("SISYPHUS_DB_KEY")
+	if ok {
+		f.DBKey = dbKey
+	}
+	dbKeyFile, ok := os.LookupEnv("SISYPHUS_DB_KEY_FILE")
+	if ok {
+		f.DBKeyFile = dbKeyFile
+	}
+	useDBKey(f.DBKey, f.DBKeyFile)
+
+	dbDir, ok := os.LookupEnv("SISYPHUS_DB_DIR")
+	if ok {
+		f.DBDir = dbDir
+	}
+	backupDir, ok := os.LookupEnv("SISYPHUS_BACKUP_DIR")
+	if ok {
+		f.BackupDir = backupDir
+	}
+	useDBDir(f.DBDir, f.BackupDir)
+	for _, d := range cfg.Maildirs {
+		for _, dir := range []string{sisyphus.DatabaseDir, sisyphus.BackupDir} {
+			if dir != "" && d.HoldsMail(dir) {
+				log.WithFields(log.Fields{
+					"dir":     dir,
+					"maildir": string(d),
+				}).Fatal("Databases and backups must not be kept within cur, new or tmp of a maildir or its folders.")
+			}
+		}
+	}
+
+	cfg.Options.AuditLog = f.AuditLog
+	auditLog, ok := os.LookupEnv("SISYPHUS_AUDIT_LOG")
+	if ok {
+		cfg.Options.AuditLog = auditLog
+	}
+
+	_, redact := os.LookupEnv("SISYPHUS_REDACT")
+	cfg.Options.Redact = f.Redact || redact
+
+	if f.Headers != nil {
+		cfg.Options.Headers = *f.Headers
+	}
+	headersRaw, ok := os.LookupEnv("SISYPHUS_HEADERS")
+	if ok {
+		cfg.Options.Headers = []string{}
+		if headersRaw != "" {
+			cfg.Options.Headers = strings.Split(headersRaw, ",")
+		}
+	}
+
+	_, upstream := os.LookupEnv("SISYPHUS_UPSTREAM")
+	cfg.Options.Upstream = f.Upstream || upstream
+	cfg.Options.UpstreamHeaders = f.UpstreamHeaders
+	upstreamHeadersRaw, ok := os.LookupEnv("SISYPHUS_UPSTREAM_HEADERS")
+	if ok && upstreamHeadersRaw != "" {
+		cfg.Options.UpstreamHeaders = strings.Split(upstreamHeadersRaw, ",")
+	}
+
+	_, keepHTML := os.LookupEnv("SISYPHUS_KEEP_HTML")
+	cfg.Options.KeepHTML = f.KeepHTML || keepHTML
+
+	_, exactTokens := os.LookupEnv("SISYPHUS_EXACT_TOKENS")
+	cfg.Options.ExactTokens = f.ExactTokens || exactTokens
+
+	_, bigrams := os.LookupEnv("SISYPHUS_BIGRAMS")
+	cfg.Options.Bigrams = f.Bigrams || bigrams
+
+	// Check the number of bytes of text to read from a mail
+	maxBodyRaw, ok := os.LookupEnv("SISYPHUS_MAX_BODY")
+	if !ok && f.MaxBody != 0 {
+		maxBodyRaw, ok = strconv.Itoa(f.MaxBody), true
+	}
+	if ok {
+		maxBody, err := strconv.Atoi(maxBodyRaw)
+		if err != nil || maxBody <= 0 {
+			log.WithFields(log.Fields{
+				"bytes": maxBodyRaw,
+			}).Warning("Number of bytes of text to read must be positive. Setting default value to 1048576.")
+		} else {
+			cfg.Options.MaxBody = maxBody
+		}
+	}
+
+	// Check the number of words to score a mail by
+	maxTokensRaw, ok := os.LookupEnv("SISYPHUS_MAX_TOKENS")
+	if !ok && f.MaxTokens != 0 {
+		maxTokensRaw, ok = strconv.Itoa(f.MaxTokens), true
+	}
+	if ok {
+		maxTokens, err := strconv.Atoi(maxTokensRaw)
+		if err != nil || maxTokens == 0 {
+			log.WithFields(log.Fields{
+				"tokens": maxTokensRaw,
+			}).Warning("Number of words to score by must not be zero. Setting default value to 15.")
+		} else {
+			cfg.Options.MaxTokens = maxTokens
+		}
+	}
+
+	// Check the lengths of the words to count and fall back to the default
+	// values if not set or invalid
+	for _, t := range []struct {
+		env string
+		val int
+		dst *int
+	}{
+		{"SISYPHUS_MIN_TOKEN", f.MinToken, &cfg.Options.MinToken},
+		{"SISYPHUS_MAX_TOKEN", f.MaxToken, &cfg.Options.MaxToken},
+	} {
+		raw, ok := os.LookupEnv(t.env)
+		if !ok && t.val != 0 {
+			raw, ok = strconv.Itoa(t.val), true
+		}
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			log.WithFields(log.Fields{
+				"length": raw,
+			}).Warning("Length of words must be positive. Setting default value.")
+			continue
+		}
+		*t.dst = n
+	}
+	minToken, maxToken := cfg.Options.MinToken, cfg.Options.MaxToken
+	if minToken == 0 {
+		minToken = sisyphus.DefaultMinToken
+	}
+	if maxToken == 0 {
+		maxToken = sisyphus.DefaultMaxToken
+	}
+	if minToken > maxToken {
+		log.WithFields(log.Fields{
+			"min": minToken,
+			"max": maxToken,
+		}).Warning("Shortest words must not be longer than the longest ones. Setting default values to 4 and 10.")
+		cfg.Options.MinToken, cfg.Options.MaxToken = 0, 0
+	}
+
+	// A file of stop words replaces the built-in list
+	_, stopWords := os.LookupEnv("SISYPHUS_STOP_WORDS")
+	if f.StopWords || stopWords {
+		cfg.Options.StopWords = sisyphus.DefaultStopWords
+	}
+	stopWordsFile, ok := os.LookupEnv("SISYPHUS_STOP_WORDS_FILE")
+	if ok {
+		f.StopWordsFile = stopWordsFile
+	}
+	if f.StopWordsFile != "" {
+		cfg.Options.StopWords = readStopWords(f.StopWordsFile)
+	}
+
+	cfg.Options.Whitelist = senderList(f.Whitelist, f.WhitelistFile, "SISYPHUS_WHITELIST")
+	cfg.Options.Blacklist = senderList(f.Blacklist, f.BlacklistFile, "SISYPHUS_BLACKLIST")
+
+	// Junk is moved to a folder of its own in every maildir
+	cfg.Options.JunkFolder = f.JunkDir
+	junkDir, ok := os.LookupEnv("SISYPHUS_JUNK_DIR")
+	if ok {
+		cfg.Options.JunkFolder = junkDir
+	}
+	junk := filepath.Clean(cfg.Options.JunkFolder)
+	if cfg.Options.JunkFolder == "" || filepath.IsAbs(junk) || junk == "." || junk == ".." ||
+		strings.HasPrefix(junk, ".."+string(filepath.Separator)) {
+		if cfg.Options.JunkFolder != "" {
+			log.WithFields(log.Fields{
+				"folder": cfg.Options.JunkFolder,
+			}).Warning("Junk folder must lie within the maildirs. Setting default value to .Junk.")
+		}
+		junk = sisyphus.DefaultJunkFolder
+	}
+	cfg.Options.JunkFolder = junk
+	for _, d := range cfg.Maildirs {
+		err := d.CreateFolder(junk)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"dir":    string(d),
+				"folder": junk,
+			}).Fatal("Cannot create junk folder")
+		}
+	}
+
+	// The inbox is always learned as good and the junk folder as junk, the
+	// other folders as configured
+	goodFolders, ok := os.LookupEnv("SISYPHUS_GOOD_FOLDERS")
+	if ok {
+		f.GoodFolders = []string{}
+		if goodFolders != "" {
+			f.GoodFolders = strings.Split(goodFolders, ",")
+		}
+	}
+	junkFolders, ok := os.LookupEnv("SISYPHUS_JUNK_FOLDERS")
+	if ok {
+		f.JunkFolders = []string{}
+		if junkFolders != "" {
+			f.JunkFolders = strings.Split(junkFolders, ",")
+		}
+	}
+	cfg.Folders = sisyphus.Folders{"": false}
+	f.JunkFolders = append(f.JunkFolders, junk)
+	for _, folder := range f.GoodFolders {
+		cfg.Folders[folder] = false
+	}
+	for _, folder := range f.JunkFolders {
+		if isJunk, ok := cfg.Folders[folder]; ok && !isJunk {
+			log.WithFields(log.Fields{
+				"folder": folder,
+			}).Fatal("Folder cannot hold both good and junk mails")
+		}
+		cfg.Folders[folder] = true
+	}
+
+	// The trash folder is learned as junk, but only with a reduced weight,
+	// as deleted mails are not necessarily junk
+	cfg.TrashFolder = f.TrashFolder
+	trashFolder, ok := os.LookupEnv("SISYPHUS_TRASH_FOLDER")
+	if ok {
+		cfg.TrashFolder = trashFolder
+	}
+	if cfg.TrashFolder != "" {
+		if _, ok := cfg.Folders[cfg.TrashFolder]; ok {
+			log.WithFields(log.Fields{
+				"folder": cfg.TrashFolder,
+			}).Fatal("Trash folder cannot be learned as good or junk as well")
+		}
+		cfg.Folders[cfg.TrashFolder] = true
+	}
+
+	cfg.TrashWeight = defaultTrashWeight
+	if f.TrashWeight != 0 {
+		cfg.TrashWeight = f.TrashWeight
+	}
+	trashWeightRaw, ok := os.LookupEnv("SISYPHUS_TRASH_WEIGHT")
+	if ok {
+		cfg.TrashWeight, err = strconv.ParseFloat(trashWeightRaw, 64)
+		if err != nil {
+			cfg.TrashWeight = -1
+		}
+	}
+	if cfg.TrashWeight <= 0 || cfg.TrashWeight >= 1 {
+		log.WithFields(log.Fields{
+			"weight": cfg.TrashWeight,
+		}).Warning("Weight of trashed mails must lie within (0,1). Setting default value to 0.25.")
+		cfg.TrashWeight = defaultTrashWeight
+	}
+
+	// Check the IMAP settings, which are only used if a host is set
+	for env, val := range map[string]*string{
+		"SISYPHUS_IMAP_HOST":     &f.IMAP.Host,
+		"SISYPHUS_IMAP_USER":     &f.IMAP.User,
+		"SISYPHUS_IMAP_PASSWORD": &f.IMAP.Password,
+		"SISYPHUS_IMAP_MAILBOX":  &f.IMAP.Mailbox,
+		"SISYPHUS_IMAP_JUNK":     &f.IMAP.Junk,
+		"SISYPHUS_IMAP_MAILDIR":  &f.IMAP.Maildir,
+	} {
+		raw, ok := os.LookupEnv(env)
+		if ok {
+			*val = raw
+		}
+	}
+	cfg.IMAP = imapConfig{
+		Host:     f.IMAP.Host,
+		User:     f.IMAP.User,
+		Password: f.IMAP.Password,
+		Mailbox:  f.IMAP.Mailbox,
+		Junk:     f.IMAP.Junk,
+		Maildir:  resolveDir(f.IMAP.Maildir),
+	}
+	if cfg.IMAP.Mailbox == "" {
+		cfg.IMAP.Mailbox = "INBOX"
+	}
+	if cfg.IMAP.Junk == "" {
+		cfg.IMAP.Junk = "Junk"
+	}
+	if cfg.IMAP.Maildir == "" {
+		cfg.IMAP.Maildir = cfg.Maildirs[0]
+	}
+	if cfg.IMAP.Host != "" {
+		known := false
+		for _, m := range cfg.Maildirs {
+			known = known || m == cfg.IMAP.Maildir
+		}
+		if !known {
+			log.WithFields(log.Fields{
+				"maildir": string(cfg.IMAP.Maildir),
+			}).Fatal("The maildir whose database classifies IMAP mails is not configured.")
+		}
+	}
+
+	// Check the milter settings, which are only used if an address is set
+	cfg.Milter.Addr = f.Milter.Addr
+	milterAddr, ok := os.LookupEnv("SISYPHUS_MILTER_ADDR")
+	if ok {
+		cfg.Milter.Addr = milterAddr
+	}
+	cfg.Milter.Maildir = resolveDir(f.Milter.Maildir)
+	milterMaildir, ok := os.LookupEnv("SISYPHUS_MILTER_MAILDIR")
+	if ok {
+		cfg.Milter.Maildir = resolveDir(milterMaildir)
+	}
+	if cfg.Milter.Maildir == "" {
+		cfg.Milter.Maildir = cfg.Maildirs[0]
+	}
+	rejectRaw, ok := os.LookupEnv("SISYPHUS_MILTER_REJECT")
+	if !ok && f.Milter.Reject != 0 {
+		rejectRaw, ok = strconv.FormatFloat(f.Milter.Reject, 'g', -1, 64), true
+	}
+	if ok {
+		reject, err := strconv.ParseFloat(rejectRaw, 64)
+		if err != nil || reject <= 0 || reject >= 1 {
+			log.WithFields(log.Fields{
+				"reject": rejectRaw,
+			}).Warning("Probability to reject junk at must lie within (0,1). Rejecting nothing.")
+		} else {
+			cfg.Milter.Reject = reject
+		}
+	}
+	if cfg.Milter.Addr != "" {
+		known := false
+		for _, m := range cfg.Maildirs {
+			known = known || m == cfg.Milter.Maildir
+		}
+		if !known {
+			log.WithFields(log.Fields{
+				"maildir": string(cfg.Milter.Maildir),
+			}).Fatal("The maildir whose database classifies in the milter is not configured.")
+		}
+	}
+
+	// Check the settings of individual maildirs
+	cfg.Overrides = make(map[sisyphus.Maildir]override)
+	for path, val := range f.Maildirs {
+		d := resolveDir(path)
+		known := false
+		for _, m := range cfg.Maildirs {
+			known = known || m == d
+		}
+		if !known {
+			log.WithFields(log.Fields{
+				"maildir": path,
+			}).Warning("Ignoring settings of a maildir that is not configured")
+			continue
+		}
+
+		var o override
+		if val.Duration != "" {
+			o.Duration, err = time.ParseDuration(val.Duration)
+			if err != nil || o.Duration <= 0 {
+				log.WithFields(log.Fields{
+					"maildir":  path,
+					"duration": val.Duration,
+				}).Fatal("Duration for learning intervals must be positive, e.g. 12h.")
+			}
+		}
+		if val.Threshold != 0 {
+			if val.Threshold < 0 || val.Threshold >= 1 {
+				log.WithFields(log.Fields{
+					"maildir":   path,
+					"threshold": val.Threshold,
+				}).Warning("Threshold must lie within (0,1). Using the global threshold.")
+			} else {
+				o.Threshold = val.Threshold
+			}
+		}
+		cfg.Overrides[d] = o
+	}
+
+	return cfg
+
+}
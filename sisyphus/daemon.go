@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// daemonEnv is set in the environment of the process started in the
+// background by daemonize, so that it does not start yet another one
+const daemonEnv = "SISYPHUS_DAEMONIZED"
+
+// errRunning is returned when the PID file belongs to a sisyphus that is still
+// running
+var errRunning = errors.New("sisyphus is already running")
+
+// daemonized reports whether this process has been started in the background
+// by daemonize
+func daemonized() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// writePIDFile writes the ID of this process to the file at path, so that init
+// scripts can stop it later. It refuses to overwrite the PID file of a process
+// still running, but replaces stale ones left behind by a crash.
+func writePIDFile(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+		if err == nil && pid != os.Getpid() && running(pid) {
+			return fmt.Errorf("%v with PID %d", errRunning, pid)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
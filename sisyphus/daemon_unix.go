@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonize starts sisyphus once more with the same arguments, but detached
+// from the terminal in a session of its own, and returns its process ID. The
+// output of the new process is appended to the file at logFile, or discarded
+// if empty.
+func daemonize(logFile string) (pid int, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		cmd.Stdout = f
+		cmd.Stderr = f
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+
+	pid = cmd.Process.Pid
+
+	return pid, cmd.Process.Release()
+}
+
+// running reports whether a process with the given ID exists
+func running(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// daemonize is not supported on Windows, where sisyphus is run as a service
+// instead
+func daemonize(logFile string) (pid int, err error) {
+	return 0, errors.New("daemon mode is not supported on Windows")
+}
+
+// running reports whether a process with the given ID exists
+func running(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// sample is a mail whose class is known
+type sample struct {
+	path string
+	junk bool
+}
+
+// evaluation counts the verdicts on known mails, junk being the positive class
+type evaluation struct {
+	truePositives, falsePositives int
+	trueNegatives, falseNegatives int
+}
+
+// add counts the verdict on a known mail
+func (e *evaluation) add(junk, verdict bool) {
+	switch {
+	case junk && verdict:
+		e.truePositives++
+	case junk:
+		e.falseNegatives++
+	case verdict:
+		e.falsePositives++
+	default:
+		e.trueNegatives++
+	}
+}
+
+// ratio returns n/d, or NaN if d is zero
+func ratio(n, d int) float64 {
+	if d == 0 {
+		return math.NaN()
+	}
+
+	return float64(n) / float64(d)
+}
+
+// precision returns the share of junk among the mails filed as junk
+func (e evaluation) precision() float64 {
+	return ratio(e.truePositives, e.truePositives+e.falsePositives)
+}
+
+// recall returns the share of junk filed as junk
+func (e evaluation) recall() float64 {
+	return ratio(e.truePositives, e.truePositives+e.falseNegatives)
+}
+
+// falsePositiveRate returns the share of good mails filed as junk
+func (e evaluation) falsePositiveRate() float64 {
+	return ratio(e.falsePositives, e.falsePositives+e.trueNegatives)
+}
+
+// accuracy returns the share of mails filed correctly
+func (e evaluation) accuracy() float64 {
+	return ratio(e.truePositives+e.trueNegatives,
+		e.truePositives+e.falsePositives+e.trueNegatives+e.falseNegatives)
+}
+
+// evaluate measures the quality of classification by k-fold cross-validation
+// over the mails in the directories good and junk: the mails are split into k
+// folds, and each fold is classified with a database learned from all the
+// others
+func evaluate(opts sisyphus.Options, good, junk []string, k int) (e evaluation, err error) {
+	var samples []sample
+	for _, path := range mailFiles(good) {
+		samples = append(samples, sample{path, false})
+	}
+	for _, path := range mailFiles(junk) {
+		samples = append(samples, sample{path, true})
+	}
+	if k < 2 || k > len(samples) {
+		return e, errors.New("number of folds must lie between 2 and the number of mails")
+	}
+
+	// Decisions on known mails are not worth recording
+	opts.AuditLog = ""
+
+	for fold := 0; fold < k; fold++ {
+		err = evaluateFold(&e, opts, samples, fold, k)
+		if err != nil {
+			return e, err
+		}
+	}
+
+	return e, nil
+}
+
+// evaluateFold classifies the mails of one fold with a temporary database
+// learned from the mails of all other folds
+func evaluateFold(e *evaluation, opts sisyphus.Options, samples []sample, fold, k int) error {
+	db, err := sisyphus.OpenTempDatabase()
+	if err != nil {
+		return err
+	}
+	defer sisyphus.CloseTempDatabase(db)
+
+	// samples are dealt to folds in turn, so each gets its share of good
+	// and junk
+	for i, s := range samples {
+		if i%k == fold {
+			continue
+		}
+		err = learnFile(db, opts, s.path, s.junk)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"mail": s.path,
+			}).Error("Cannot learn mail, skipping it")
+		}
+	}
+
+	for i, s := range samples {
+		if i%k != fold {
+			continue
+		}
+		c, err := classifyFile(db, opts, s.path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"mail": s.path,
+			}).Error("Cannot classify mail, skipping it")
+			continue
+		}
+		e.add(s.junk, c.Junk)
+	}
+
+	return nil
+}
+
+// classifyFile classifies the mail in the file at path
+func classifyFile(db *bolt.DB, opts sisyphus.Options, path string) (c sisyphus.Classification, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	m := sisyphus.Mail{
+		Key:     path,
+		Options: opts,
+	}
+
+	return m.ClassifyReader(db, f)
+}
+
+// print writes the counts and measures of an evaluation to w
+func (e evaluation) print(w io.Writer) {
+	t := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(t, "junk filed as junk\t%d\n", e.truePositives)
+	fmt.Fprintf(t, "junk kept\t%d\n", e.falseNegatives)
+	fmt.Fprintf(t, "good filed as junk\t%d\n", e.falsePositives)
+	fmt.Fprintf(t, "good kept\t%d\n", e.trueNegatives)
+	fmt.Fprintf(t, "precision\t%.4f\n", e.precision())
+	fmt.Fprintf(t, "recall\t%.4f\n", e.recall())
+	fmt.Fprintf(t, "false positive rate\t%.4f\n", e.falsePositiveRate())
+	fmt.Fprintf(t, "accuracy\t%.4f\n", e.accuracy())
+	t.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// healthcheck checks that the database of every maildir can be opened and
+// contains all buckets, and reports whether all of them are fine. A database
+// held by a running sisyphus cannot be opened, so its backup, written by the
+// very same process, is checked instead.
+func healthcheck(cfg config) (healthy bool) {
+	healthy = true
+	for _, d := range cfg.Maildirs {
+		path := cfg.databasePath(d)
+		err := checkDatabase(path)
+		if err == sisyphus.ErrLocked {
+			err = sisyphus.VerifyBackup(cfg.backupOf(d))
+			path = cfg.backupOf(d).LatestBackup()
+		}
+		if err != nil {
+			healthy = false
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+				"db":      path,
+			}).Error("Database is unhealthy")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"maildir": string(d),
+			"db":      path,
+		}).Info("Database is healthy")
+	}
+
+	return healthy
+}
+
+// checkDatabase opens the database at path read-only and checks it with
+// sisyphus.Check. It returns sisyphus.ErrLocked if the database is in use.
+func checkDatabase(path string) error {
+	db, err := sisyphus.OpenReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return sisyphus.Check(db)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// imapConfig holds the settings of an IMAP server whose new mails are
+// classified
+type imapConfig struct {
+	// Host is the address of the server, e.g. imap.example.com:993. The
+	// connection is always secured by TLS.
+	Host           string
+	User, Password string
+	// Mailbox is watched for new mails, which are moved to the Junk
+	// mailbox if classified as junk
+	Mailbox, Junk string
+	// Maildir is the maildir whose database is used for classification
+	Maildir sisyphus.Maildir
+}
+
+// watchIMAP classifies the mails arriving in the configured IMAP mailbox
+// until ctx is cancelled. Lost connections are established again.
+func watchIMAP(ctx context.Context, cfg config, db *bolt.DB) {
+	for {
+		err := idleIMAP(ctx, cfg, db)
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithFields(log.Fields{
+			"err":  err,
+			"host": cfg.IMAP.Host,
+		}).Error("Lost connection to IMAP server, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// idleIMAP connects to the IMAP server and waits for new mails with IDLE,
+// classifying them as they arrive. It returns when ctx is cancelled or the
+// connection fails.
+func idleIMAP(ctx context.Context, cfg config, db *bolt.DB) error {
+	c, err := client.DialTLS(cfg.IMAP.Host, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	err = c.Login(cfg.IMAP.User, cfg.IMAP.Password)
+	if err != nil {
+		return err
+	}
+
+	mbox, err := c.Select(cfg.IMAP.Mailbox, false)
+	if err != nil {
+		return err
+	}
+
+	// Only mails arriving from now on are classified, just like in the
+	// maildirs
+	next := mbox.UidNext
+
+	// The client blocks until its updates are read, so they are read all
+	// the time and merely tell whether the mailbox has changed
+	updates := make(chan client.Update, 16)
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	c.Updates = updates
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case u := <-updates:
+				if _, ok := u.(*client.MailboxUpdate); !ok {
+					continue
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"host":    cfg.IMAP.Host,
+		"mailbox": cfg.IMAP.Mailbox,
+	}).Info("Watching IMAP mailbox")
+
+	for {
+		next, err = classifyIMAP(c, cfg, db, next)
+		if err != nil {
+			return err
+		}
+
+		stop := make(chan struct{})
+		idled := make(chan error, 1)
+		go func() {
+			idled <- c.Idle(stop, nil)
+		}()
+
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-idled
+			return nil
+		case <-changed:
+			close(stop)
+			err = <-idled
+			if err != nil {
+				return err
+			}
+		case err = <-idled:
+			return err
+		}
+	}
+}
+
+// classifyIMAP classifies all unseen mails of the selected mailbox from UID
+// next on and moves junk to the Junk mailbox. It returns the UID following
+// the mails classified.
+func classifyIMAP(c *client.Client, cfg config, db *bolt.DB, next uint32) (uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(next, 0)
+	// Mails that have been seen or deleted have already been handled by
+	// the user and are left alone
+	criteria.WithoutFlags = []string{imap.SeenFlag, imap.DeletedFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return next, err
+	}
+
+	// "n:*" always matches the last mail, even if it is older than n
+	seqset := new(imap.SeqSet)
+	for _, uid := range uids {
+		if uid >= next {
+			seqset.AddNum(uid)
+		}
+	}
+	if seqset.Empty() {
+		return next, nil
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, 16)
+	fetched := make(chan error, 1)
+	go func() {
+		fetched <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, messages)
+	}()
+
+	junk := new(imap.SeqSet)
+	for msg := range messages {
+		if msg.Uid >= next {
+			next = msg.Uid + 1
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+
+		m := sisyphus.Mail{
+			Key:     fmt.Sprintf("%s/%d", cfg.IMAP.Mailbox, msg.Uid),
+			Options: cfg.options(cfg.IMAP.Maildir),
+		}
+		result, err := m.ClassifyReader(db, body)
+		if err != nil {
+			classificationErrors.Inc()
+			log.WithFields(log.Fields{
+				"err":  err,
+				"mail": m.Key,
+			}).Error("Classify mail")
+			continue
+		}
+		if !result.Junk {
+			mailsClassified.WithLabelValues("good").Inc()
+			continue
+		}
+		mailsClassified.WithLabelValues("junk").Inc()
+		notify(cfg.WebhookURL, cfg.IMAP.Maildir, m.Key, result)
+		junk.AddNum(msg.Uid)
+	}
+	err = <-fetched
+	if err != nil {
+		return next, err
+	}
+
+	if junk.Empty() {
+		return next, nil
+	}
+
+	var dryRun string
+	if cfg.DryRun {
+		dryRun = "-- dry run (nothing happened to these mails!)"
+	} else {
+		// Junk is marked as seen when moved, just like in the maildirs
+		err = c.UidStore(junk, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+		if err != nil {
+			return next, err
+		}
+		err = c.UidMove(junk, cfg.IMAP.Junk)
+		if err != nil {
+			return next, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"mails": junk.String(),
+		"to":    cfg.IMAP.Junk,
+	}).Info("Moved to Junk folder" + dryRun)
+
+	return next, nil
+}
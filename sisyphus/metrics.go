@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+var (
+	mailsClassified = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sisyphus_mails_classified_total",
+			Help: "Number of new mails classified, by class.",
+		},
+		[]string{"class"},
+	)
+
+	classificationErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sisyphus_classification_errors_total",
+			Help: "Number of new mails that could not be classified.",
+		},
+	)
+
+	learningDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sisyphus_learning_duration_seconds",
+			Help: "Duration of the last learning cycle, by maildir.",
+		},
+		[]string{"maildir"},
+	)
+
+	mailsLearnedDesc = prometheus.NewDesc(
+		"sisyphus_mails_learned",
+		"Number of mails learned, by maildir and class.",
+		[]string{"maildir", "class"},
+		nil,
+	)
+
+	lastLearnedDesc = prometheus.NewDesc(
+		"sisyphus_last_learned_timestamp_seconds",
+		"Time a mail was last learned, by maildir.",
+		[]string{"maildir"},
+		nil,
+	)
+
+	lastClassifiedDesc = prometheus.NewDesc(
+		"sisyphus_last_classified_timestamp_seconds",
+		"Time a mail was last classified, by maildir.",
+		[]string{"maildir"},
+		nil,
+	)
+)
+
+// infoCollector exports the statistics of all databases at the time they
+// are scraped
+type infoCollector struct {
+	dbs map[sisyphus.Maildir]*bolt.DB
+}
+
+// Describe implements prometheus.Collector
+func (c infoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mailsLearnedDesc
+	ch <- lastLearnedDesc
+	ch <- lastClassifiedDesc
+}
+
+// Collect implements prometheus.Collector. The times are left out until a
+// mail has been learned or classified, respectively.
+func (c infoCollector) Collect(ch chan<- prometheus.Metric) {
+	for d, db := range c.dbs {
+		s, err := sisyphus.Statistics(db)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot read statistics")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(mailsLearnedDesc, prometheus.GaugeValue, float64(s.GTotal), string(d), "good")
+		ch <- prometheus.MustNewConstMetric(mailsLearnedDesc, prometheus.GaugeValue, float64(s.JTotal), string(d), "junk")
+		if !s.LastLearned.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastLearnedDesc, prometheus.GaugeValue, float64(s.LastLearned.Unix()), string(d))
+		}
+		if !s.LastClassified.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastClassifiedDesc, prometheus.GaugeValue, float64(s.LastClassified.Unix()), string(d))
+		}
+	}
+}
+
+// healthz answers 200 if all databases pass sisyphus.Check and 503 otherwise,
+// so that a supervisor can tell whether sisyphus is alive and well
+func healthz(dbs map[sisyphus.Maildir]*bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for d, db := range dbs {
+			err := sisyphus.Check(db)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":     err,
+					"maildir": string(d),
+				}).Error("Database is unhealthy")
+				http.Error(w, string(d)+": "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serveMetrics exposes the metrics on addr at /metrics, along with the health
+// of the databases at /healthz, until ctx is cancelled. It returns once the
+// server has been shut down.
+func serveMetrics(ctx context.Context, addr string, dbs map[sisyphus.Maildir]*bolt.DB) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		mailsClassified,
+		classificationErrors,
+		learningDuration,
+		infoCollector{dbs: dbs},
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", healthz(dbs))
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	// Shut down the server gracefully, i.e. wait for running scrapes to
+	// finish, before the databases are closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		err := srv.Shutdown(context.Background())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("Cannot shut down metrics server")
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"addr": addr,
+	}).Info("Serving metrics")
+
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"addr": addr,
+		}).Error("Cannot serve metrics")
+	}
+	<-done
+
+	return
+}
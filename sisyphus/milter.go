@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/emersion/go-milter"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// milterMaxSize is the number of bytes of a mail that are classified by the
+// milter; the rest of larger mails is ignored
+const milterMaxSize = 4 << 20
+
+// milterConfig holds the settings of the milter
+type milterConfig struct {
+	// Addr is the address to listen on, e.g. localhost:8890 or
+	// unix:/var/run/sisyphus.sock
+	Addr string
+	// Maildir is the maildir whose database is used for classification
+	Maildir sisyphus.Maildir
+	// Reject is the probability above which junk is rejected rather than
+	// merely marked by headers. Nothing is rejected if zero.
+	Reject float64
+}
+
+// scoringMilter classifies the mails passing an MTA, adds the verdict as
+// headers and rejects obvious junk. A new one is used for every connection.
+type scoringMilter struct {
+	milter.NoOpMilter
+	cfg config
+	db  *bolt.DB
+	raw bytes.Buffer
+}
+
+// MailFrom starts a new mail, as a connection may carry several of them
+func (s *scoringMilter) MailFrom(from string, m *milter.Modifier) (milter.Response, error) {
+	s.raw.Reset()
+
+	return milter.RespContinue, nil
+}
+
+// Header collects the header of a mail
+func (s *scoringMilter) Header(name, value string, m *milter.Modifier) (milter.Response, error) {
+	s.write(name + ": " + value + "\r\n")
+
+	return milter.RespContinue, nil
+}
+
+// Headers ends the header of a mail
+func (s *scoringMilter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	s.write("\r\n")
+
+	return milter.RespContinue, nil
+}
+
+// BodyChunk collects the body of a mail
+func (s *scoringMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
+	s.write(string(chunk))
+
+	return milter.RespContinue, nil
+}
+
+// Body classifies the collected mail
+func (s *scoringMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	defer s.raw.Reset()
+
+	mail := sisyphus.Mail{
+		Key:     "milter",
+		Options: s.cfg.options(s.cfg.Milter.Maildir),
+	}
+	c, err := mail.ClassifyReader(s.db, bytes.NewReader(s.raw.Bytes()))
+	if err != nil {
+		classificationErrors.Inc()
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Classify mail")
+		return milter.RespAccept, nil
+	}
+	if c.Junk {
+		mailsClassified.WithLabelValues("junk").Inc()
+	} else {
+		mailsClassified.WithLabelValues("good").Inc()
+	}
+
+	if s.cfg.Milter.Reject != 0 && c.Probability > s.cfg.Milter.Reject {
+		log.WithFields(log.Fields{
+			"probability": c.Probability,
+		}).Info("Rejected junk")
+		return milter.RespReject, nil
+	}
+
+	for _, h := range verdictHeaders(c) {
+		err = m.AddHeader(h[0], h[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return milter.RespAccept, nil
+}
+
+// write collects up to milterMaxSize bytes of a mail
+func (s *scoringMilter) write(data string) {
+	if s.raw.Len()+len(data) > milterMaxSize {
+		data = data[:milterMaxSize-s.raw.Len()]
+	}
+	s.raw.WriteString(data)
+}
+
+// serveMilter runs the milter on the configured address until ctx is
+// cancelled
+func serveMilter(ctx context.Context, cfg config, db *bolt.DB) {
+	network, addr := "tcp", cfg.Milter.Addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"addr": cfg.Milter.Addr,
+		}).Error("Cannot serve milter")
+		return
+	}
+
+	srv := milter.Server{
+		NewMilter: func() milter.Milter {
+			return &scoringMilter{cfg: cfg, db: db}
+		},
+		Actions:  milter.OptAddHeader,
+		Protocol: milter.OptNoConnect | milter.OptNoHelo | milter.OptNoRcptTo,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.WithFields(log.Fields{
+		"addr": cfg.Milter.Addr,
+	}).Info("Serving milter")
+
+	err = srv.Serve(ln)
+	if err != nil && err != milter.ErrServerClosed {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"addr": cfg.Milter.Addr,
+		}).Error("Cannot serve milter")
+	}
+
+	return
+}
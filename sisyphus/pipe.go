@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// pipe reads a raw mail from in, classifies it against the backup database
+// of maildir d and writes it to out with the verdict added as X-Sisyphus-Score
+// and X-Sisyphus-Junk headers. If the mail cannot be classified, it is written
+// unchanged, so no mail is lost on the way to its mailbox.
+func pipe(d sisyphus.Maildir, opts sisyphus.Options, in io.Reader, out io.Writer) error {
+	raw, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	var header string
+	c, err := classifyRaw(d, opts, raw)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":     err,
+			"maildir": string(d),
+		}).Error("Cannot classify mail, passing it on unchanged")
+	} else {
+		// keep the line endings of the mail
+		eol := "\n"
+		if bytes.Contains(raw, []byte("\r\n")) {
+			eol = "\r\n"
+		}
+
+		for _, h := range verdictHeaders(c) {
+			header += h[0] + ": " + h[1] + eol
+		}
+	}
+
+	_, err = io.WriteString(out, header)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(raw)
+
+	return err
+}
+
+// verdictHeaders returns the names and values of the headers telling the
+// verdict on a mail. The score is left out if nothing is known about the
+// mail's words.
+func verdictHeaders(c sisyphus.Classification) (h [][2]string) {
+	if !math.IsNaN(c.Probability) {
+		h = append(h, [2]string{"X-Sisyphus-Score", fmt.Sprintf("%.4f", c.Probability)})
+	}
+
+	verdict := "NO"
+	if c.Junk {
+		verdict = "YES"
+	}
+
+	return append(h, [2]string{"X-Sisyphus-Junk", verdict})
+}
+
+// classifyRaw classifies a raw mail against the backup database of maildir d.
+// The backup is opened read-only, so that any number of mails can be classified
+// at the same time and while sisyphus is running.
+func classifyRaw(d sisyphus.Maildir, opts sisyphus.Options, raw []byte) (c sisyphus.Classification, err error) {
+	db, err := sisyphus.OpenReadOnly(d.LatestBackup())
+	if err != nil {
+		return c, err
+	}
+	defer db.Close()
+
+	m := sisyphus.Mail{
+		Key:     "stdin",
+		Options: opts,
+	}
+
+	return m.ClassifyReader(db, bytes.NewReader(raw))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// repeatInterval is the interval at which an error or warning logged over and
+// over again, e.g. for a misconfigured maildir, is logged once more, along
+// with the number of times it has been left out since
+const repeatInterval = 5 * time.Minute
+
+// repeatLimiter wraps the formatter of the log in order to leave out errors
+// and warnings repeated within repeatInterval. Messages differing in any field
+// but the time are not repeated.
+type repeatLimiter struct {
+	log.Formatter
+	interval time.Duration
+
+	mu      sync.Mutex
+	repeats map[string]*repeat
+}
+
+// repeat tracks a message that has been logged. Entries are reused by the
+// logger, so the message is kept rather than its entry.
+type repeat struct {
+	level   log.Level
+	message string
+	fields  log.Fields
+	logged  time.Time
+	omitted int // times left out since
+}
+
+// limitRepeats wraps the formatter of the standard logger in a repeatLimiter
+func limitRepeats(interval time.Duration) *repeatLimiter {
+	l := &repeatLimiter{
+		Formatter: log.StandardLogger().Formatter,
+		interval:  interval,
+		repeats:   make(map[string]*repeat),
+	}
+	log.SetFormatter(l)
+
+	return l
+}
+
+// Format formats the entry by the wrapped formatter, unless it is repeated
+// within the interval, in which case it is left out
+func (l *repeatLimiter) Format(e *log.Entry) ([]byte, error) {
+	// summaries and informational messages are never left out
+	if _, ok := e.Data["repeated"]; ok || e.Level > log.WarnLevel {
+		return l.Formatter.Format(e)
+	}
+
+	key := repeatKey(e)
+	l.mu.Lock()
+	r, ok := l.repeats[key]
+	if ok && e.Time.Sub(r.logged) < l.interval {
+		r.omitted++
+		l.mu.Unlock()
+		return nil, nil
+	}
+	if !ok {
+		r = &repeat{level: e.Level, message: e.Message, fields: log.Fields{}}
+		for k, v := range e.Data {
+			r.fields[k] = v
+		}
+		l.repeats[key] = r
+	}
+	omitted := r.omitted
+	r.logged, r.omitted = e.Time, 0
+	l.mu.Unlock()
+
+	if omitted > 0 {
+		summary := e.WithField("repeated", omitted)
+		summary.Time, summary.Level, summary.Message = e.Time, e.Level, e.Message
+		e = summary
+	}
+
+	return l.Formatter.Format(e)
+}
+
+// run logs a summary of the messages left out for an interval at every
+// interval until ctx is cancelled, and once more at the end
+func (l *repeatLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			l.summarize(time.Time{})
+			return
+		case now := <-ticker.C:
+			l.summarize(now)
+		}
+	}
+}
+
+// summarize logs how often each message not logged for an interval before now
+// has been left out since, which counts as logging it again. Messages that
+// have not been left out are forgotten. A zero now summarizes all messages.
+func (l *repeatLimiter) summarize(now time.Time) {
+	var summaries []repeat
+	l.mu.Lock()
+	for key, r := range l.repeats {
+		if !now.IsZero() && now.Sub(r.logged) < l.interval {
+			continue
+		}
+		if r.omitted == 0 {
+			delete(l.repeats, key)
+			continue
+		}
+		summaries = append(summaries, *r)
+		r.logged, r.omitted = now, 0
+	}
+	l.mu.Unlock()
+
+	// the logger calls Format, so it must not be called with l.mu held
+	for _, r := range summaries {
+		e := log.WithFields(r.fields).WithField("repeated", r.omitted)
+		switch r.level {
+		case log.WarnLevel:
+			e.Warning(r.message)
+		default:
+			e.Error(r.message)
+		}
+	}
+}
+
+// repeatKey identifies a message by its level, text and fields
+func repeatKey(e *log.Entry) string {
+	fields := make([]string, 0, len(e.Data))
+	for k, v := range e.Data {
+		fields = append(fields, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(fields)
+
+	return e.Level.String() + " " + e.Message + " " + strings.Join(fields, " ")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// newMails returns the mails waiting in the "new" directory of any folder of
+// a maildir, leaving out the junk folder
+func newMails(d sisyphus.Maildir, junk string) (mails []sisyphus.Mail, err error) {
+	err = filepath.Walk(string(d), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		if isJunkFolder(d, junk, path) {
+			return filepath.SkipDir
+		}
+		switch info.Name() {
+		case "cur", "tmp":
+			return filepath.SkipDir
+		case "new":
+		default:
+			return nil
+		}
+
+		folder, err := filepath.Rel(string(d), filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if folder == "." {
+			folder = ""
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			mails = append(mails, sisyphus.Mail{
+				Key:    f.Name(),
+				Folder: folder,
+			})
+		}
+
+		return filepath.SkipDir
+	})
+
+	return mails, err
+}
+
+// report prints how the new mails of a slice of maildirs would be classified
+// and where they would be moved to, without touching any of them
+func report(cfg config, dbs map[sisyphus.Maildir]*bolt.DB) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MAIL\tJUNK PROBABILITY\tDESTINATION")
+
+	for _, d := range cfg.Maildirs {
+		mails, err := newMails(d, cfg.Options.JunkFolder)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot read new mails")
+			continue
+		}
+
+		opts := cfg.options(d)
+		// Decisions that are not put into effect are not worth recording
+		opts.AuditLog = ""
+		for _, m := range mails {
+			path := filepath.Join(string(d), m.Folder, "new", m.Key)
+
+			m.DryRun = true
+			m.Options = opts
+			c, err := m.Classify(dbs[d], d)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"mail": path,
+				}).Error("Cannot classify mail")
+				continue
+			}
+
+			switch {
+			case c.Skipped:
+				fmt.Fprintf(w, "%s\t-\tskipped, already seen or trashed\n", path)
+			case c.Junk:
+				fmt.Fprintf(w, "%s\t%.4f\t%s\n", path, c.Probability, c.Destination)
+			default:
+				fmt.Fprintf(w, "%s\t%.4f\tstays in %s\n", path, c.Probability, filepath.Dir(path))
+			}
+		}
+	}
+	w.Flush()
+
+	return
+}
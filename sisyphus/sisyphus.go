@@ -2,10 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -20,6 +28,9 @@ var (
 	version string
 )
 
+// learnChunkSize is the number of mails handed to a learning worker at once
+const learnChunkSize = 100
+
 func main() {
 
 	// Define App
@@ -43,14 +54,334 @@ func main() {
 	app.ExtraInfo = func() map[string]string {
 		return map[string]string{
 			"ENVIRONMENT VARIABLES": `For configuration, set the following environment
-  variables:
+  variables. They override the respective settings of the configuration file.
   
+  SISYPHUS_CONFIG:   Path to a YAML configuration file, e.g.
+
+                     dirs:
+                       - /home/JohnDoe/Maildir
+                     exclude:
+                       - /home/shared/Maildir
+                     duration: 12h
+                     backup_interval: 168h
+                     backup_keep: 7
+                     backup_compress: true
+                     classify_timeout: 30s
+                     scan_interval: 15m
+                     dry_run: false
+                     threshold: 0.6
+                     smoothing: 1
+                     subject_weight: 2
+                     from_weight: 1
+                     body_weight: 1
+                     method: fisher
+                     max_tokens: 15
+                     min_training: 50
+                     keep_html: false
+                     exact_tokens: false
+                     max_body: 1048576
+                     min_token: 4
+                     max_token: 10
+                     bigrams: false
+                     stop_words: true
+                     stop_words_file: /usr/local/etc/sisyphus/stopwords
+                     workers: 4
+                     metrics_addr: localhost:9090
+                     socket: /var/run/sisyphus/classify.sock
+                     webhook_url: https://hooks.example.com/sisyphus
+                     audit_log: /var/log/sisyphus.jsonl
+                     redact: true
+                     shared_db: /var/db/sisyphus.db
+                     restore_db: false
+                     db_dir: ~/.local/share/sisyphus
+                     backup_dir: /var/backups/sisyphus
+                     db_key_file: /usr/local/etc/sisyphus/db.key
+                     decay: 0.95
+                     headers: [Subject, From, Reply-To]
+                     upstream: true
+                     upstream_headers: [X-Spam-Flag, X-Rspamd-Score]
+                     whitelist: [news@example.com, example.org]
+                     whitelist_file: /usr/local/etc/sisyphus/whitelist
+                     blacklist: ["*.example.net"]
+                     blacklist_file: /usr/local/etc/sisyphus/blacklist
+                     junk_dir: .Junk
+                     good_folders: [.Archive, .Sent]
+                     junk_folders: [.Spam]
+                     trash_folder: .Trash
+                     trash_weight: 0.25
+                     imap:
+                       host: imap.example.com:993
+                       user: JohnDoe
+                       password: secret
+                       mailbox: INBOX
+                       junk: Junk
+                       maildir: /home/JohnDoe/Maildir
+                     milter:
+                       addr: localhost:8890
+                       maildir: /home/JohnDoe/Maildir
+                       reject: 0.99
+                     maildirs:
+                       /home/JohnDoe/Maildir:
+                         duration: 1h
+                         threshold: 0.9
+
+  SISYPHUS_LOG_FORMAT: Format of the logs, either text or json, e.g. for log
+                     aggregators. Default is set to text.
+
+  SISYPHUS_LOG_LEVEL: Least severe level of the logs written, i.e. debug,
+                     info, warning, error or fatal. Default is set to info.
+
   SISYPHUS_DIRS:     Comma-separated list of maildirs,
-                     e.g. ./Maildir,/home/JohnDoe/Maildir
+                     e.g. ./Maildir,/home/JohnDoe/Maildir. Patterns such as
+                     /home/*/Maildir are expanded to all matching maildirs,
+                     ~/Maildir to the home directory, and symbolic links to
+                     the directories they point to. If set to -, a
+                     newline-separated list is read from standard input.
+
+  SISYPHUS_EXCLUDE:  Comma-separated list of maildirs, or patterns such as
+                     /home/*/Maildir/.Archive, to leave out of SISYPHUS_DIRS,
+                     e.g. /home/shared/Maildir.
 
   SISYPHUS_DURATION: Interval between learning periods, e.g. 12h. Default is set to 24h.
 
+  SISYPHUS_BACKUP_INTERVAL: Minimum interval between backups of the databases,
+                     e.g. 168h. Default is set to back up before every learning
+                     period.
+
+  SISYPHUS_BACKUP_KEEP: Number of older backups kept of each database along
+                     with the latest one, e.g. 7, named after the time they
+                     have been written at, so that a database can be rolled
+                     back to before a bad training, see "restore --list".
+                     Older ones are pruned. Default is set to 0, i.e. every
+                     backup replaces the previous one.
+
+  SISYPHUS_BACKUP_COMPRESS: If set, backups are compressed with gzip and get
+                     the suffix .gz, which saves much space for large
+                     databases. Backups are read and restored either way,
+                     whichever has been written last. Default is set to no
+                     compression.
+
+  SISYPHUS_CLASSIFY_TIMEOUT: Time after which classifying a new mail is given
+                     up, e.g. 1m, leaving the mail in new. This keeps
+                     malformed or enormous mails from stalling sisyphus.
+                     Default is set to 30s.
+
+  SISYPHUS_SCAN_INTERVAL: Interval between scans for new mails that have not
+                     been classified, e.g. 1h, in case the directory watcher
+                     has missed them. New mails are also looked for at
+                     startup and when the watcher reports lost events. 0
+                     disables the periodic scans. Default is set to 15m.
+
   SISYPHUS_DRY_RUN : If set, sisyphus will not move any mails around.
+
+  SISYPHUS_THRESHOLD: Probability above which a mail is filed as junk, e.g.
+                     0.9 to only catch obvious junk. Must lie within (0,1).
+                     Default is set to 0.6.
+
+  SISYPHUS_SMOOTHING: Strength with which the probabilities of rarely seen words
+                     are pulled towards 0.5, in made-up mails (Robinson's s,
+                     with x = 0.5), e.g. 1. Keeps words seen in only one class
+                     from dominating the score. Default is set to 0, i.e. no
+                     smoothing.
+
+  SISYPHUS_SUBJECT_WEIGHT, SISYPHUS_FROM_WEIGHT, SISYPHUS_BODY_WEIGHT: Weights
+                     the words of the subject, of the From header and of the
+                     body are scored with, e.g. 2 to count words of the
+                     subject twice, as junk words in a short subject tell
+                     more than in a long body. Words of other headers weigh
+                     1. Default is set to 1 each.
+
+  SISYPHUS_METHOD:   Method of combining the probabilities of the words of a
+                     mail, either bayes (their harmonic mean) or fisher
+                     (Fisher's chi-square combination, as used by SpamBayes),
+                     which is less thrown off by many correlated words.
+                     Default is set to bayes.
+
+  SISYPHUS_MAX_TOKENS: Number of words a mail is scored by, e.g. 30. Only the
+                     words whose probabilities are farthest from 0.5 are
+                     combined, as neutral words merely blur the score; -1
+                     scores by all words. Default is set to 15.
+
+  SISYPHUS_MIN_TRAINING: Number of mails that must have been learned of both,
+                     good and junk, before mails are filed as junk, e.g. 50.
+                     Until then, junk is left in new. Default is set to 0.
+
+  SISYPHUS_KEEP_HTML: If set, sisyphus will not extract the visible text from
+                     HTML mails, but learn and classify their whole markup.
+
+  SISYPHUS_EXACT_TOKENS: If set, words are learned and classified exactly as
+                     they are written. By default, they are normalized to
+                     Unicode NFKC and lowercased, so that e.g. FREE, Free and
+                     ｆｒｅｅ count as one word. Relearn after changing this.
+
+  SISYPHUS_MAX_BODY: Number of bytes of text read from the body of a mail, the
+                     rest is ignored. This keeps huge mails from taking up a
+                     lot of memory. Default is set to 1048576.
+
+  SISYPHUS_MIN_TOKEN: Length of the shortest words that are counted, e.g. 3.
+                     Default is set to 4.
+
+  SISYPHUS_MAX_TOKEN: Length of the longest words that are counted, e.g. 15.
+                     Longer ones are mostly encoded data. Default is set to 10.
+
+  SISYPHUS_BIGRAMS:  If set, pairs of consecutive words such as "wire transfer"
+                     are learned and classified along with the words. This
+                     catches phrases, but makes the databases several times as
+                     big; see the prune command to keep them small.
+
+  SISYPHUS_STOP_WORDS: If set, common English words such as "that" or "with"
+                     are left out. This makes the databases much smaller, but
+                     costs a little accuracy, particularly in other languages.
+
+  SISYPHUS_STOP_WORDS_FILE: Path of a file listing the stop words to leave out
+                     instead of the English ones, one per line.
+
+  SISYPHUS_HEADERS:  Comma-separated list of headers whose words are learned
+                     along with the body, e.g. Subject,From. Set it to an empty
+                     value to ignore all headers. Default is set to
+                     Subject,From,Reply-To,Return-Path,X-Mailer.
+
+  SISYPHUS_UPSTREAM: If set, the verdicts of upstream filters such as
+                     SpamAssassin or Rspamd weigh in as strong evidence when
+                     classifying, e.g. "X-Spam-Flag: YES" or a score of 5 or
+                     more in "X-Rspamd-Score".
+
+  SISYPHUS_UPSTREAM_HEADERS: Comma-separated list of headers holding the
+                     verdicts of upstream filters. Default is set to
+                     X-Spam-Flag,X-Spam-Status,X-Spam,X-Rspamd-Score.
+
+  SISYPHUS_WHITELIST: Path of a file listing the senders whose mails are never
+                     junk, one per line, in addition to whitelist in the
+                     configuration file. A line holds either an address, e.g.
+                     news@example.com, or a domain, e.g. example.org, which
+                     includes its subdomains.
+
+  SISYPHUS_BLACKLIST: Path of a file listing the senders whose mails are always
+                     junk, in addition to blacklist in the configuration file,
+                     in the format of SISYPHUS_WHITELIST. Rules may contain
+                     wildcards, e.g. *.example.net or *@example.net.
+
+  SISYPHUS_GOOD_FOLDERS: Comma-separated list of folders whose mails are
+                     learned as good along with those of the inbox, e.g.
+                     .Archive,.Sent. Default is set to the inbox only.
+
+  SISYPHUS_JUNK_DIR: Folder of each maildir junk is moved to and learned
+                     from, e.g. .Spam. Default is set to .Junk.
+
+  SISYPHUS_JUNK_FOLDERS: Comma-separated list of folders whose mails are
+                     learned as junk along with those of the junk folder,
+                     e.g. .Spam,.Bulk. Mails in any other folder are not
+                     learned. Default is set to the junk folder only.
+
+  SISYPHUS_TRASH_FOLDER: If set, the mails of this folder, e.g. .Trash, are
+                     learned as junk, but with a reduced weight, as deleted
+                     mails are often but not always unwanted.
+
+  SISYPHUS_TRASH_WEIGHT: Weight the mails of the trash folder are learned
+                     with, compared to those of the junk folder. Must lie
+                     within (0,1). Default is set to 0.25.
+
+  SISYPHUS_WORKERS:  Number of mails learned concurrently, across all
+                     maildirs. Default is set to the number of CPUs.
+
+  SISYPHUS_METRICS_ADDR: If set, sisyphus run serves Prometheus metrics on
+                     this address at /metrics, e.g. localhost:9090, and the
+                     health of its databases at /healthz. The metrics
+                     sisyphus_last_learned_timestamp_seconds and
+                     sisyphus_last_classified_timestamp_seconds tell when a
+                     maildir was last learned and classified, e.g. to alert
+                     if learning has stalled.
+
+  SISYPHUS_SOCKET:   If set, sisyphus run classifies the mails sent to a Unix
+                     socket at this path, e.g. /var/run/sisyphus/classify.sock,
+                     by sisyphus classify --socket, keeping the databases
+                     open. This is much faster than opening a database for
+                     every mail, e.g. from procmail. The socket is open to
+                     the group of sisyphus. It also tells sisyphus stats --live
+                     the current statistics, which cannot be read from the
+                     databases while sisyphus is running.
+
+  SISYPHUS_WEBHOOK_URL: If set, sisyphus run posts every mail it files as junk
+                     to this URL as JSON, with its maildir, key, score and
+                     sender, e.g. for chat notifications.
+
+  SISYPHUS_SHARED_DB: Path of a database shared among all maildirs, so that
+                     junk learned in one of them is recognized in all others.
+                     It is backed up once, along with the first maildir.
+                     Default is set to a database of each maildir of its own.
+
+  SISYPHUS_RESTORE_DB: If set, sisyphus run replaces a database that cannot be
+                     read at startup, e.g. because it is corrupt, by its
+                     backup, once the backup has been verified. The database
+                     replaced is kept with the suffix .pre-restore. Maildirs
+                     whose database still cannot be opened, or is in use by
+                     another process, are skipped with an error either way.
+
+  SISYPHUS_DB_DIR:   Directory the databases of the maildirs and their backups
+                     are kept in, e.g. ~/.local/share/sisyphus, instead of the
+                     maildirs themselves, where they may confuse IMAP servers
+                     such as Dovecot. Each database is named after its
+                     maildir. Existing databases are not moved; see "stats"
+                     for where a database is read from. Default is set to the
+                     maildirs.
+
+  SISYPHUS_BACKUP_DIR: Directory the backups of the databases are written to,
+                     e.g. /var/backups/sisyphus. Neither this directory nor
+                     the one of the databases may lie within cur, new or tmp
+                     of a maildir or of its folders, where they would be
+                     mistaken for mails.
+                     Default is set to the directory of the databases.
+
+  SISYPHUS_DB_KEY:   If set, the words learned are encrypted with this key in
+                     all databases and their backups, so that the tokens of
+                     senders and subjects cannot be read from the files. Use a
+                     long random key, e.g. from "openssl rand -hex 32", and
+                     keep it: without it, an encrypted database cannot be
+                     used. A database that already holds words in the clear
+                     is refused; forget it without the key first.
+                     Default is set to no encryption.
+
+  SISYPHUS_DB_KEY_FILE: Path of a file holding the key, instead of
+                     SISYPHUS_DB_KEY.
+
+  SISYPHUS_DECAY:    Factor the counts of learned words are multiplied by
+                     after every learning period, e.g. 0.95, so that old junk
+                     fades and words falling below one are removed. Must lie
+                     within (0,1). Default is set to no decay.
+
+  SISYPHUS_AUDIT_LOG: If set, every classification decision is appended to
+                     this file as a line of JSON.
+
+  SISYPHUS_REDACT:   If set, the words explained and the senders in audit
+                     logs and log messages are replaced by short hashes, so
+                     that they can be shared without the content of the
+                     mails. What is learned is left as it is.
+
+  SISYPHUS_IMAP_HOST: If set, sisyphus run also classifies the new mails of
+                     this IMAP server, e.g. imap.example.com:993, connecting
+                     with TLS. Junk is moved to another mailbox.
+
+  SISYPHUS_IMAP_USER, SISYPHUS_IMAP_PASSWORD: Credentials for the IMAP server.
+
+  SISYPHUS_IMAP_MAILBOX: IMAP mailbox watched for new mails. Default is set to
+                     INBOX.
+
+  SISYPHUS_IMAP_JUNK: IMAP mailbox junk is moved to. Default is set to Junk.
+
+  SISYPHUS_IMAP_MAILDIR: Maildir whose database classifies the IMAP mails.
+                     Default is set to the first maildir.
+
+  SISYPHUS_MILTER_ADDR: If set, sisyphus run also serves as a milter for
+                     Postfix or Sendmail on this address, e.g. localhost:8890
+                     or unix:/var/run/sisyphus.sock. It adds the headers
+                     X-Sisyphus-Score and X-Sisyphus-Junk to passing mails.
+
+  SISYPHUS_MILTER_MAILDIR: Maildir whose database classifies in the milter.
+                     Default is set to the first maildir.
+
+  SISYPHUS_MILTER_REJECT: Probability above which the milter rejects junk,
+                     e.g. 0.99. Must lie within (0,1). Default is set to
+                     reject nothing.
 			`,
 		}
 	}
@@ -80,13 +411,101 @@ COPYRIGHT:
   {{.Copyright}}
 `
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "read the configuration from a YAML `FILE`",
+			EnvVar: "SISYPHUS_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "write logs as text or json",
+			EnvVar: "SISYPHUS_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "info",
+			Usage:  "write logs of this level and above, i.e. debug, info, warning, error or fatal",
+			EnvVar: "SISYPHUS_LOG_LEVEL",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if classifiesStdin(c.Args()) {
+			passAsGood()
+		}
+
+		err := setupLogging(c.GlobalString("log-format"), c.GlobalString("log-level"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Fatal("Cannot set up logging")
+		}
+
+		// Commands without a configuration need the key of encrypted
+		// databases, too
+		useDBKey(os.Getenv("SISYPHUS_DB_KEY"), os.Getenv("SISYPHUS_DB_KEY_FILE"))
+		useDBDir(os.Getenv("SISYPHUS_DB_DIR"), os.Getenv("SISYPHUS_BACKUP_DIR"))
+		_, sisyphus.CompressBackups = os.LookupEnv("SISYPHUS_BACKUP_COMPRESS")
+
+		return nil
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:    "run",
 			Aliases: []string{"u"},
 			Usage:   "run sisyphus",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "relearn",
+					Usage: "learn all mails again at startup, even those already learned",
+				},
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "learn and classify the new mails a single time, then exit, e.g. from cron",
+				},
+				cli.BoolFlag{
+					Name:  "daemon",
+					Usage: "detach from the terminal and run in the background",
+				},
+				cli.StringFlag{
+					Name:   "pid-file",
+					Usage:  "write the process ID to `FILE`, which is removed on shutdown",
+					EnvVar: "SISYPHUS_PID_FILE",
+				},
+				cli.StringFlag{
+					Name:   "log-file",
+					Usage:  "append the log of the background process to `FILE`, see --daemon; it is discarded otherwise",
+					EnvVar: "SISYPHUS_LOG_FILE",
+				},
+			},
 			Action: func(c *cli.Context) {
 
+				if c.Bool("daemon") && !daemonized() {
+					pid, err := daemonize(c.String("log-file"))
+					if err != nil {
+						log.WithFields(log.Fields{
+							"err": err,
+						}).Fatal("Cannot start in the background")
+					}
+					log.WithFields(log.Fields{
+						"pid": pid,
+					}).Info("Started in the background")
+					return
+				}
+
+				if c.String("pid-file") != "" {
+					err := writePIDFile(c.String("pid-file"))
+					if err != nil {
+						log.WithFields(log.Fields{
+							"err":  err,
+							"file": c.String("pid-file"),
+						}).Fatal("Cannot write PID file")
+					}
+					defer os.Remove(c.String("pid-file"))
+				}
+
 				fmt.Print(`
 
 
@@ -104,63 +523,193 @@ COPYRIGHT:
 
 `)
 
-				maildirs := loadConfig()
+				cfg := loadConfig(c.GlobalString("config"))
 
-				// Open all databases
-				dbs, err := sisyphus.LoadDatabases(maildirs)
+				// Open all databases. Maildirs whose database cannot
+				// be opened are left out, so that the others are still
+				// filtered.
+				dbs, err := cfg.loadAvailableDatabases()
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
 					}).Fatal("Cannot load databases")
 				}
 				defer sisyphus.CloseDatabases(dbs)
+				var available []sisyphus.Maildir
+				for _, d := range cfg.Maildirs {
+					if dbs[d] != nil {
+						available = append(available, d)
+					}
+				}
+				if len(available) == 0 {
+					log.Fatal("Cannot load the database of any maildir")
+				}
+				cfg.Maildirs = available
 
-				// Learn at startup and regular intervals
-				go func() {
-					for {
-						duration, err := time.ParseDuration(os.Getenv("SISYPHUS_DURATION"))
-						if err != nil {
-							log.Fatal("Cannot parse duration for learning intervals.")
+				// Stop learning and classifying on SIGINT and SIGTERM,
+				// such that the databases are closed cleanly
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+				var wg sync.WaitGroup
+
+				// A shared database is only backed up and decayed
+				// along with the first of its maildirs, not once per
+				// maildir
+				first := make(map[sisyphus.Maildir]bool)
+				seen := make(map[*bolt.DB]bool)
+				for _, d := range cfg.Maildirs {
+					first[d] = !seen[dbs[d]]
+					seen[dbs[d]] = true
+				}
+
+				if c.Bool("once") {
+					go func() {
+						select {
+						case sig := <-signals:
+							log.WithFields(log.Fields{
+								"signal": sig,
+							}).Info("Shutting down")
+							cancel()
+						case <-ctx.Done():
 						}
+					}()
+					runOnce(ctx, cfg, dbs, first, c.Bool("relearn"))
+					return
+				}
 
-						backup(maildirs, dbs)
-						learn(maildirs, dbs)
-						time.Sleep(duration)
-					}
+				// Keep errors repeated over and over again, e.g. for
+				// a misconfigured maildir, from flooding the log
+				limiter := limitRepeats(repeatInterval)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					limiter.run(ctx)
 				}()
 
-				// Classify whenever a mail arrives in "new"
-				watcher, err := fsnotify.NewWatcher()
+				// Learn at startup and at regular intervals, which may
+				// differ between maildirs, with no more workers at once
+				// than configured for all of them
+				slots := make(chan struct{}, cfg.Workers)
+				for _, d := range cfg.Maildirs {
+					wg.Add(1)
+					go func(d sisyphus.Maildir) {
+						defer wg.Done()
+						relearn := c.Bool("relearn")
+						var lastBackup time.Time
+						for {
+							start := time.Now()
+							if first[d] && start.Sub(lastBackup) >= cfg.BackupInterval {
+								backup([]sisyphus.Maildir{d}, dbs)
+								lastBackup = start
+							}
+							learn(ctx, cfg, []sisyphus.Maildir{d}, dbs, relearn, slots)
+							if first[d] {
+								decay(cfg, d, dbs[d])
+							}
+							learningDuration.WithLabelValues(string(d)).Set(time.Since(start).Seconds())
+							relearn = false
+
+							select {
+							case <-ctx.Done():
+								return
+							case <-time.After(cfg.duration(d)):
+							}
+						}
+					}(d)
+				}
+
+				// Classify whenever a mail arrives in "new" of any folder
+				watcher, err := newWatcher(cfg.Maildirs, cfg.Options.JunkFolder)
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
 					}).Fatal("Cannot setup directory watcher")
 				}
 				defer watcher.Close()
+				settler := newSettler(ctx.Done())
+
+				// Look for the new mails the watcher has missed: those
+				// delivered while sisyphus was down, those lost when
+				// the events of the kernel overflowed, and any others
+				// at regular intervals. Mails handled are tracked, so
+				// that they are not classified again.
+				startup := make(chan struct{}, 1)
+				var scans <-chan time.Time
+				if cfg.ScanInterval > 0 {
+					ticker := time.NewTicker(cfg.ScanInterval)
+					defer ticker.Stop()
+					scans = ticker.C
+				}
+				classified := make(map[string]bool)
+				scan := func() {
+					present := make(map[string]bool)
+					for _, path := range newMailPaths(cfg) {
+						present[path] = true
+						if !classified[path] {
+							settler.add(path)
+						}
+					}
+					// mails that are no longer new are forgotten
+					for path := range classified {
+						if !present[path] {
+							delete(classified, path)
+						}
+					}
+				}
 
-				done := make(chan bool)
+				wg.Add(1)
 				go func() {
+					defer wg.Done()
 					for {
 						select {
+						case <-ctx.Done():
+							return
 						case event := <-watcher.Events:
+							if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+								watcher.removed(filepath.Clean(event.Name))
+							}
 							if event.Op&fsnotify.Create == fsnotify.Create {
-								path := strings.Split(event.Name, "/new/")
-
-								_, dryRun := os.LookupEnv("SISYPHUS_DRY_RUN")
-								m := sisyphus.Mail{
-									Key:    path[1],
-									DryRun: dryRun,
+								// Watch new subfolders
+								info, err := os.Stat(event.Name)
+								if err == nil && info.IsDir() {
+									err = watcher.watch(event.Name)
+									if err != nil {
+										log.WithFields(log.Fields{
+											"err": err,
+											"dir": event.Name,
+										}).Error("Cannot watch directory")
+									}
+									continue
 								}
-
-								err = m.Classify(dbs[sisyphus.Maildir(path[0])], sisyphus.Maildir(path[0]))
-								if err != nil {
+							}
+							if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+								_, _, _, ok := locate(cfg.Maildirs, event.Name)
+								if !ok {
 									log.WithFields(log.Fields{
-										"err": err,
-									}).Error("Classify mail")
+										"file": event.Name,
+									}).Debug("Skip file that is no new mail of any maildir")
+									continue
 								}
 
+								// Wait for the mail to be written
+								// completely
+								settler.add(event.Name)
 							}
+						case path := <-settler.ready:
+							classifyNew(ctx, cfg, dbs, path, &wg)
+							classified[path] = true
+						case <-startup:
+							scan()
+						case <-scans:
+							scan()
 						case err := <-watcher.Errors:
+							if err == fsnotify.ErrEventOverflow {
+								log.Warning("Directory watcher lost events, looking for new mails")
+								scan()
+								continue
+							}
 							log.WithFields(log.Fields{
 								"err": err,
 							}).Error("Problem with directory watcher")
@@ -168,143 +717,1333 @@ COPYRIGHT:
 					}
 				}()
 
-				for _, val := range maildirs {
-					err = watcher.Add(filepath.Join(string(val), "new"))
+				for _, val := range cfg.Maildirs {
+					err = watcher.watch(string(val))
 					if err != nil {
 						log.WithFields(log.Fields{
 							"err": err,
-							"dir": filepath.Join(string(val), "new"),
+							"dir": string(val),
 						}).Error("Cannot watch directory")
 					}
 				}
+				startup <- struct{}{}
+
+				// Classify the mails of an IMAP server, if configured
+				if cfg.IMAP.Host != "" && dbs[cfg.IMAP.Maildir] == nil {
+					log.WithFields(log.Fields{
+						"maildir": string(cfg.IMAP.Maildir),
+					}).Error("Database of maildir not loaded, not watching IMAP")
+				} else if cfg.IMAP.Host != "" {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						watchIMAP(ctx, cfg, dbs[cfg.IMAP.Maildir])
+					}()
+				}
+
+				// Classify the mails passing an MTA, if configured
+				if cfg.Milter.Addr != "" && dbs[cfg.Milter.Maildir] == nil {
+					log.WithFields(log.Fields{
+						"maildir": string(cfg.Milter.Maildir),
+					}).Error("Database of maildir not loaded, not serving milter")
+				} else if cfg.Milter.Addr != "" {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						serveMilter(ctx, cfg, dbs[cfg.Milter.Maildir])
+					}()
+				}
+
+				// Classify the mails sent to the socket, if configured
+				if cfg.Socket != "" {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						serveSocket(ctx, cfg, dbs)
+					}()
+				}
+
+				// Expose metrics, if configured
+				if cfg.MetricsAddr != "" {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						serveMetrics(ctx, cfg.MetricsAddr, dbs)
+					}()
+				}
+
+				sig := <-signals
+				log.WithFields(log.Fields{
+					"signal": sig,
+				}).Info("Shutting down")
 
-				<-done
+				// Wait for learning, classification and the metrics server
+				// to finish before the watcher and databases are closed
+				cancel()
+				wg.Wait()
 			},
 		},
 		{
 			Name:    "stats",
 			Aliases: []string{"i"},
 			Usage:   "show statistics",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print statistics as JSON",
+				},
+				cli.BoolFlag{
+					Name:  "live",
+					Usage: "read the current statistics from a running sisyphus through its socket, see SISYPHUS_SOCKET, or from the databases themselves, never their backups",
+				},
+			},
 			Action: func(c *cli.Context) {
 
-				maildirs := loadConfig()
+				cfg := loadConfig(c.GlobalString("config"))
 
-				// Open all backup databases
-				dbs, err := sisyphus.LoadBackupDatabases(maildirs)
+				// A running sisyphus keeps others out of its databases,
+				// but tells their statistics through its socket
+				if c.Bool("live") && cfg.Socket != "" {
+					stats, err := statsSocket(cfg.Socket)
+					if err == nil {
+						printStats(stats, c.Bool("json"))
+						return
+					}
+					log.WithFields(log.Fields{
+						"err":    err,
+						"socket": cfg.Socket,
+					}).Debug("Cannot read statistics from socket, reading the databases")
+				}
+
+				// Open all databases read-only, or their backups if
+				// sisyphus is running
+				load := cfg.loadReadOnlyDatabases
+				if c.Bool("live") {
+					load = cfg.loadLiveDatabases
+				}
+				dbs, err := load()
+				if err == sisyphus.ErrLocked {
+					log.Fatal("Databases are in use by a running sisyphus, which tells their current statistics only if SISYPHUS_SOCKET is set; please omit --live to read their backups")
+				}
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
-					}).Fatal("Cannot load backup databases")
+					}).Fatal("Cannot load databases")
 				}
 				defer sisyphus.CloseDatabases(dbs)
 
-				for _, db := range dbs {
-					gTotal, jTotal, gWords, jWords := sisyphus.Info(db)
+				stats, err := collectStats(cfg.Maildirs, dbs)
+				if err != nil {
 					log.WithFields(log.Fields{
-						"good mails learned":   gTotal,
-						"junk mails learned":   jTotal,
-						"number of good words": gWords,
-						"number of junk words": jWords,
-					}).Info("Statistics")
+						"err": err,
+					}).Fatal("Cannot read statistics")
 				}
+				printStats(stats, c.Bool("json"))
 			},
 		},
-	}
+		{
+			Name:      "forget",
+			Aliases:   []string{"f"},
+			Usage:     "forget everything learned, for one or all maildirs",
+			ArgsUsage: "[maildir]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "do not ask for confirmation",
+				},
+			},
+			Action: func(c *cli.Context) {
 
-	app.Run(os.Args)
-}
+				var cfg config
+				if c.NArg() > 0 {
+					cfg.Maildirs = []sisyphus.Maildir{sisyphus.Maildir(c.Args().First())}
+					_, cfg.DryRun = os.LookupEnv("SISYPHUS_DRY_RUN")
+					cfg.SharedDB = os.Getenv("SISYPHUS_SHARED_DB")
+				} else {
+					cfg = loadConfig(c.GlobalString("config"))
+				}
 
-// learn invokes the learning process for a slice of maildirs
-func learn(maildirs []sisyphus.Maildir, dbs map[sisyphus.Maildir]*bolt.DB) {
-	mails, err := sisyphus.LoadMails(maildirs)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Fatal("Cannot load mails")
-	}
-	for _, d := range maildirs {
-		db := dbs[d]
-		m := mails[d]
-		for _, val := range m {
-			err := val.Learn(db, d)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err":  err,
-					"mail": val.Key,
-				}).Warning("Cannot learn mail")
-			}
-		}
-	}
-	log.Info("All mails learned")
+				forget(cfg, c.Bool("yes"))
+			},
+		},
+		{
+			Name:      "compact",
+			Aliases:   []string{"c"},
+			Usage:     "reclaim unused space in the databases, for one or all maildirs",
+			ArgsUsage: "[maildir]",
+			Action: func(c *cli.Context) {
 
-	return
-}
+				var cfg config
+				if c.NArg() > 0 {
+					cfg.Maildirs = []sisyphus.Maildir{sisyphus.Maildir(c.Args().First())}
+					cfg.SharedDB = os.Getenv("SISYPHUS_SHARED_DB")
+				} else {
+					cfg = loadConfig(c.GlobalString("config"))
+				}
 
-// backup creates a backup copy of the existing database
-func backup(maildirs []sisyphus.Maildir, dbs map[sisyphus.Maildir]*bolt.DB) {
-	for _, d := range maildirs {
-		db := dbs[d]
+				compact(cfg, cfg.Maildirs)
+			},
+		},
+		{
+			Name:      "prune",
+			Usage:     "remove words seen in only a few mails and compact the databases, for one or all maildirs",
+			ArgsUsage: "[maildir]",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "min",
+					Value: 2,
+					Usage: "minimum number of mails a word must have been seen in to be kept",
+				},
+			},
+			Action: func(c *cli.Context) {
 
-		backup, err := os.Create(filepath.Join(string(d), "sisyphus.db.backup"))
+				var cfg config
+				if c.NArg() > 0 {
+					cfg.Maildirs = []sisyphus.Maildir{sisyphus.Maildir(c.Args().First())}
+					cfg.SharedDB = os.Getenv("SISYPHUS_SHARED_DB")
+				} else {
+					cfg = loadConfig(c.GlobalString("config"))
+				}
 
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Backup creation")
-		}
-		defer backup.Close()
+				prune(cfg, c.Int("min"))
+			},
+		},
+		{
+			Name:  "train",
+			Usage: "learn all mails in folders or mboxes of known good and junk mails, e.g. to get started",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "good",
+					Usage: "folder or mbox of good mails, may be given several times",
+				},
+				cli.StringSliceFlag{
+					Name:  "junk",
+					Usage: "folder or mbox of junk mails, may be given several times",
+				},
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "database to learn the mails into, e.g. ./Maildir/sisyphus.db",
+				},
+			},
+			Action: func(c *cli.Context) {
 
-		w := bufio.NewWriter(backup)
+				if c.String("db") == "" {
+					log.Fatal("Please provide the database to learn the mails into.")
+				}
 
-		err = db.View(func(tx *bolt.Tx) error {
-			_, err := tx.WriteTo(w)
-			return err
-		})
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Backup creation")
-		}
+				// The configuration is optional, it only provides the
+				// options of learning
+				var cfg config
+				_, ok := os.LookupEnv("SISYPHUS_DIRS")
+				if ok || c.GlobalString("config") != "" {
+					cfg = loadConfig(c.GlobalString("config"))
+				}
 
-		w.Flush()
-	}
+				db, err := sisyphus.OpenDatabase(c.String("db"))
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load database")
+				}
+				defer db.Close()
 
-	log.Info("All databases backed up successfully.")
+				train(db, cfg.Options, c.StringSlice("good"), c.StringSlice("junk"))
+			},
+		},
+		{
+			Name:  "evaluate",
+			Usage: "measure the quality of classification by cross-validation over folders of known good and junk mails",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "good",
+					Usage: "folder of good mails, may be given several times",
+				},
+				cli.StringSliceFlag{
+					Name:  "junk",
+					Usage: "folder of junk mails, may be given several times",
+				},
+				cli.IntFlag{
+					Name:  "folds",
+					Value: 5,
+					Usage: "number of folds the mails are split into",
+				},
+			},
+			Action: func(c *cli.Context) {
 
-	return
-}
+				// The configuration is optional, it only provides the
+				// options of learning and classifying
+				var cfg config
+				_, ok := os.LookupEnv("SISYPHUS_DIRS")
+				if ok || c.GlobalString("config") != "" {
+					cfg = loadConfig(c.GlobalString("config"))
+				}
 
-// loadConfig checks the validity of the environment variables and
-// loads the maildirs
-func loadConfig() []sisyphus.Maildir {
+				// Every mail is learned and classified several times,
+				// which is not worth logging
+				log.SetLevel(log.ErrorLevel)
 
-	dirsRaw, ok := os.LookupEnv("SISYPHUS_DIRS")
-	if !ok {
-		log.Fatal("Environment variable SISYPHUS_DIRS not set.")
-	}
-	dirsSplit := strings.Split(dirsRaw, ",")
+				e, err := evaluate(cfg.Options, c.StringSlice("good"), c.StringSlice("junk"), c.Int("folds"))
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot evaluate")
+				}
+				e.print(os.Stdout)
+			},
+		},
+		{
+			Name:      "corpus",
+			Usage:     "generate a synthetic corpus of good and junk mails made up of random words, e.g. for benchmarks",
+			ArgsUsage: "[<maildir>]",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "good",
+					Value: 100,
+					Usage: "number of good mails",
+				},
+				cli.IntFlag{
+					Name:  "junk",
+					Value: 100,
+					Usage: "number of junk mails",
+				},
+				cli.IntFlag{
+					Name:  "vocabulary",
+					Value: sisyphus.DefaultCorpusVocabulary,
+					Usage: "number of words each class draws its mails from",
+				},
+				cli.Float64Flag{
+					Name:  "overlap",
+					Value: 0.5,
+					Usage: "share of the vocabulary both classes have in common, within [0,1]",
+				},
+				cli.IntFlag{
+					Name:  "words",
+					Value: sisyphus.DefaultCorpusWords,
+					Usage: "number of words of the body of each mail",
+				},
+				cli.Int64Flag{
+					Name:  "seed",
+					Value: 1,
+					Usage: "seed of the random words; equal seeds generate equal corpora",
+				},
+			},
+			Action: func(c *cli.Context) {
 
-	var maildirs []sisyphus.Maildir
-	for i := 0; i < len(dirsSplit); i++ {
-		maildirs = append(maildirs, sisyphus.Maildir(dirsSplit[i]))
-	}
+				if c.NArg() > 1 {
+					log.Fatal("Please provide at most one maildir.")
+				}
+				d := sisyphus.Maildir(c.Args().First())
+				if d == "" {
+					dir, err := ioutil.TempDir("", "sisyphus-corpus")
+					if err != nil {
+						log.WithFields(log.Fields{
+							"err": err,
+						}).Fatal("Cannot create maildir")
+					}
+					d = sisyphus.Maildir(dir)
+				}
 
-	// Create missing Maildirs
-	err := sisyphus.LoadMaildirs(maildirs)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Fatal("Cannot load maildirs")
-	}
+				corpus := sisyphus.Corpus{
+					Good:       c.Int("good"),
+					Junk:       c.Int("junk"),
+					Vocabulary: c.Int("vocabulary"),
+					Overlap:    c.Float64("overlap"),
+					Words:      c.Int("words"),
+					Seed:       c.Int64("seed"),
+				}
+				keys, err := corpus.Generate(d)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":     err,
+						"maildir": string(d),
+					}).Fatal("Cannot generate corpus")
+				}
 
-	// Check duration configuration and set it to default value if
-	// not set
-	_, ok = os.LookupEnv("SISYPHUS_DURATION")
-	if !ok {
-		log.Info("Environment variable SISYPHUS_DURATION not set. Setting default value to 24h.")
-		os.Setenv("SISYPHUS_DURATION", "24h")
-	}
+				log.WithFields(log.Fields{
+					"maildir": string(d),
+					"mails":   len(keys),
+				}).Info("Generated corpus")
+				// e.g. for sisyphus evaluate --good <maildir>/cur
+				// --junk <maildir>/.Junk/cur
+				fmt.Println(string(d))
+			},
+		},
+		{
+			Name:      "pipe",
+			Aliases:   []string{"p"},
+			Usage:     "classify a mail read from standard input and write it to standard output with the verdict added as headers",
+			ArgsUsage: "<maildir>",
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 1 {
+					log.Fatal("Please provide the maildir whose database to use.")
+				}
+				d := sisyphus.Maildir(c.Args().First())
+
+				// The configuration is optional, as an MDA may run this
+				// without any environment
+				var cfg config
+				_, ok := os.LookupEnv("SISYPHUS_DIRS")
+				if ok || c.GlobalString("config") != "" {
+					cfg = loadConfig(c.GlobalString("config"))
+				}
+
+				err := pipe(cfg.backupOf(d), cfg.options(d), os.Stdin, os.Stdout)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot pass on mail")
+				}
+			},
+		},
+		{
+			Name:      "classify",
+			Usage:     "classify a mail read from standard input and print the verdict as headers",
+			ArgsUsage: "[<maildir>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "maildir",
+					Usage: "maildir whose database to use, instead of the argument",
+				},
+				cli.StringFlag{
+					Name:  "socket",
+					Usage: "socket of a running sisyphus to classify the mail by, see SISYPHUS_SOCKET",
+				},
+				cli.BoolFlag{
+					Name:  "stdin",
+					Usage: "print only the score and exit 1 for junk and 0 for good mails, e.g. for procmail; mails that cannot be classified for any reason, including a wrong configuration or arguments, pass as good",
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.Bool("stdin") {
+					defer func() {
+						if r := recover(); r != nil {
+							log.WithFields(log.Fields{
+								"err": r,
+							}).Error("Cannot classify mail, passing it as good")
+							os.Exit(0)
+						}
+					}()
+				}
 
-	return maildirs
+				if c.NArg() > 1 || c.NArg() == 1 && c.String("maildir") != "" {
+					log.Fatal("Please provide at most one maildir.")
+				}
+				d := sisyphus.Maildir(c.Args().First())
+				if c.String("maildir") != "" {
+					d = sisyphus.Maildir(c.String("maildir"))
+				}
+				if d == "" && c.String("socket") == "" {
+					log.Fatal("Please provide the maildir whose database to use, or a socket.")
+				}
+
+				raw, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot read mail")
+				}
 
+				var v sisyphus.Classification
+				if c.String("socket") != "" {
+					v, err = classifySocket(c.String("socket"), d, raw)
+				} else {
+					// The configuration is optional, as an MDA
+					// may run this without any environment
+					var cfg config
+					_, ok := os.LookupEnv("SISYPHUS_DIRS")
+					if ok || c.GlobalString("config") != "" {
+						cfg = loadConfig(c.GlobalString("config"))
+					}
+					v, err = classifyRaw(cfg.backupOf(d), cfg.options(d), raw)
+				}
+
+				// procmail can only tell whether the command
+				// succeeded, so errors must not look like junk
+				if c.Bool("stdin") {
+					if err != nil {
+						log.WithFields(log.Fields{
+							"err": err,
+						}).Error("Cannot classify mail, passing it as good")
+						return
+					}
+					fmt.Printf("%.4f\n", v.Probability)
+					if v.Junk {
+						os.Exit(1)
+					}
+					return
+				}
+
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot classify mail")
+				}
+
+				for _, h := range verdictHeaders(v) {
+					fmt.Println(h[0] + ": " + h[1])
+				}
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "show the version, the commit built from and the version of Go",
+			Action: func(c *cli.Context) {
+				printVersion(os.Stdout)
+			},
+		},
+		{
+			Name:  "healthcheck",
+			Usage: "check that the databases can be opened and are complete, exiting non-zero otherwise",
+			Action: func(c *cli.Context) {
+
+				cfg := loadConfig(c.GlobalString("config"))
+
+				if !healthcheck(cfg) {
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "replace the database of a maildir with its backup",
+			ArgsUsage: "<maildir>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "list",
+					Usage: "list the timestamped backups instead, the oldest first",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "restore the timestamped backup of `TIME`, as listed, instead of the latest one",
+				},
+			},
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 1 {
+					log.Fatal("Please provide a maildir.")
+				}
+				d := sisyphus.Maildir(c.Args().First())
+
+				if c.Bool("list") {
+					paths, err := d.Backups()
+					if err != nil {
+						log.WithFields(log.Fields{
+							"err":     err,
+							"maildir": string(d),
+						}).Fatal("Cannot list backups")
+					}
+					for _, path := range paths {
+						fmt.Println(backupTime(d, path))
+					}
+					return
+				}
+
+				path := d.LatestBackup()
+				if c.String("from") != "" {
+					paths, err := d.Backups()
+					if err != nil {
+						log.WithFields(log.Fields{
+							"err":     err,
+							"maildir": string(d),
+						}).Fatal("Cannot list backups")
+					}
+					path = ""
+					for _, p := range paths {
+						if backupTime(d, p) == c.String("from") {
+							path = p
+						}
+					}
+					if path == "" {
+						log.WithFields(log.Fields{
+							"maildir": string(d),
+							"from":    c.String("from"),
+						}).Fatal("No backup of this time, see --list")
+					}
+				}
+				err := sisyphus.RestoreBackupFile(d, path)
+				if err == sisyphus.ErrLocked {
+					log.WithFields(log.Fields{
+						"maildir": string(d),
+					}).Fatal("Database is in use, please stop sisyphus before restoring")
+				}
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":     err,
+						"maildir": string(d),
+					}).Fatal("Cannot restore database")
+				}
+
+				log.WithFields(log.Fields{
+					"maildir":  string(d),
+					"backup":   path,
+					"previous": d.DatabasePath() + ".pre-restore",
+				}).Info("Restored database from backup")
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "write the learned words of a maildir to standard output as CSV",
+			ArgsUsage: "<maildir>",
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 1 {
+					log.Fatal("Please provide a maildir.")
+				}
+				d := sisyphus.Maildir(c.Args().First())
+
+				// Open the database read-only, or its backup if
+				// sisyphus is running
+				dbs, err := sisyphus.LoadReadOnlyDatabases([]sisyphus.Maildir{d})
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load databases")
+				}
+				defer sisyphus.CloseDatabases(dbs)
+
+				err = sisyphus.ExportModel(dbs[d], os.Stdout)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":     err,
+						"maildir": string(d),
+					}).Fatal("Cannot export model")
+				}
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "add the counts of a model written by export to a database",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "database to import the model into, e.g. ./Maildir/sisyphus.db",
+				},
+			},
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 1 {
+					log.Fatal("Please provide the file of the model.")
+				}
+				if c.String("db") == "" {
+					log.Fatal("Please provide the database to import the model into.")
+				}
+
+				f, err := os.Open(c.Args().First())
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot open model")
+				}
+				defer f.Close()
+
+				db, err := sisyphus.OpenDatabase(c.String("db"))
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load database")
+				}
+				defer db.Close()
+
+				err = sisyphus.ImportModel(db, f)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":  err,
+						"file": c.Args().First(),
+					}).Fatal("Cannot import model")
+				}
+
+				log.WithFields(log.Fields{
+					"file": c.Args().First(),
+					"db":   c.String("db"),
+				}).Info("Imported model")
+			},
+		},
+		{
+			Name:      "merge",
+			Usage:     "add everything learned in another database to a database",
+			ArgsUsage: "<database>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "db",
+					Usage: "database to merge the other one into, e.g. ./Maildir/sisyphus.db",
+				},
+			},
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 1 {
+					log.Fatal("Please provide the database to merge.")
+				}
+				if c.String("db") == "" {
+					log.Fatal("Please provide the database to merge into.")
+				}
+
+				// The database would wait for itself forever
+				a, errA := os.Stat(c.Args().First())
+				b, errB := os.Stat(c.String("db"))
+				if errA == nil && errB == nil && os.SameFile(a, b) {
+					log.Fatal(sisyphus.ErrMergeItself)
+				}
+
+				src, err := sisyphus.OpenReadOnly(c.Args().First())
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":  err,
+						"file": c.Args().First(),
+					}).Fatal("Cannot load database to merge")
+				}
+				defer src.Close()
+
+				dst, err := sisyphus.OpenDatabase(c.String("db"))
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load database")
+				}
+				defer dst.Close()
+
+				err = sisyphus.MergeDatabases(dst, src)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":  err,
+						"file": c.Args().First(),
+					}).Fatal("Cannot merge databases")
+				}
+
+				log.WithFields(log.Fields{
+					"file": c.Args().First(),
+					"db":   c.String("db"),
+				}).Info("Merged databases")
+			},
+		},
+		{
+			Name:      "explain",
+			Aliases:   []string{"e"},
+			Usage:     "explain the classification of a mail",
+			ArgsUsage: "<maildir> <key>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "n",
+					Value: 10,
+					Usage: "number of words to show",
+				},
+			},
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 2 {
+					log.Fatal("Please provide a maildir and the key of a mail.")
+				}
+				d := sisyphus.Maildir(c.Args().Get(0))
+
+				cfg := loadConfig(c.GlobalString("config"))
+
+				// Open the database read-only, or its backup if
+				// sisyphus is running
+				dbs, err := sisyphus.LoadReadOnlyDatabases([]sisyphus.Maildir{d})
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load databases")
+				}
+				defer sisyphus.CloseDatabases(dbs)
+
+				explain(dbs[d], d, c.Args().Get(1), cfg.options(d), c.Int("n"))
+			},
+		},
+		{
+			Name:      "top",
+			Usage:     "show the words learned that indicate junk, or good mails, the most",
+			ArgsUsage: "<maildir>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "junk",
+					Usage: "show the words indicating junk (default)",
+				},
+				cli.BoolFlag{
+					Name:  "good",
+					Usage: "show the words indicating good mails",
+				},
+				cli.IntFlag{
+					Name:  "n",
+					Value: 20,
+					Usage: "number of words to show",
+				},
+				cli.IntFlag{
+					Name:  "min",
+					Value: 5,
+					Usage: "number of mails a word must have been learned from at least",
+				},
+			},
+			Action: func(c *cli.Context) {
+
+				if c.NArg() != 1 {
+					log.Fatal("Please provide a maildir.")
+				}
+				if c.Bool("junk") && c.Bool("good") {
+					log.Fatal("Please provide either --junk or --good.")
+				}
+				d := sisyphus.Maildir(c.Args().First())
+
+				cfg := loadConfig(c.GlobalString("config"))
+
+				// Open the database read-only, or its backup if
+				// sisyphus is running
+				dbs, err := sisyphus.LoadReadOnlyDatabases([]sisyphus.Maildir{d})
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load databases")
+				}
+				defer sisyphus.CloseDatabases(dbs)
+
+				top(dbs[d], cfg.options(d), !c.Bool("good"), c.Int("n"), c.Int("min"))
+			},
+		},
+		{
+			Name:      "report",
+			Aliases:   []string{"r"},
+			Usage:     "show how the new mails would be classified, without moving any of them",
+			ArgsUsage: "[maildir]",
+			Action: func(c *cli.Context) {
+
+				cfg := loadConfig(c.GlobalString("config"))
+				if c.NArg() > 0 {
+					cfg.Maildirs = []sisyphus.Maildir{sisyphus.Maildir(c.Args().First())}
+				}
+
+				// Open all databases read-only, or their backups if
+				// sisyphus is running
+				dbs, err := cfg.loadReadOnlyDatabases()
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Fatal("Cannot load databases")
+				}
+				defer sisyphus.CloseDatabases(dbs)
+
+				report(cfg, dbs)
+			},
+		},
+	}
+
+	app.Run(os.Args)
+}
+
+// backupTime returns the time the timestamped backup of maildir d at path has
+// been written at, as listed by restore --list, whether it is compressed or not
+func backupTime(d sisyphus.Maildir, path string) string {
+	base := strings.TrimSuffix(d.BackupPath(), ".gz") + "."
+
+	return strings.TrimSuffix(strings.TrimPrefix(path, base), ".gz")
+}
+
+// classifiesStdin reports whether the arguments following the global flags
+// run classify --stdin
+func classifiesStdin(args []string) bool {
+	if len(args) == 0 || args[0] != "classify" {
+		return false
+	}
+	for _, a := range args[1:] {
+		switch a {
+		case "--":
+			return false
+		case "-stdin", "--stdin", "-stdin=true", "--stdin=true":
+			return true
+		}
+	}
+
+	return false
+}
+
+// passAsGood makes fatal errors exit 0 rather than 1, which procmail would
+// take for junk, see classify --stdin
+func passAsGood() {
+	log.RegisterExitHandler(func() {
+		os.Exit(0)
+	})
+}
+
+// learn invokes the learning process for a slice of maildirs, using a pool
+// of workers that each learn a chunk of mails in a batch. A worker holds one
+// of the slots while learning, which are shared by concurrent calls, so that
+// no more chunks are learned at once than there are slots. Mails that have
+// already been learned are skipped unless relearn is set. Chunks not yet
+// started are dropped when ctx is cancelled, and chunks being learned are
+// stopped after the mail at hand. The mails are read while they
+// are learned, so only the chunks being learned are held in memory.
+func learn(ctx context.Context, cfg config, maildirs []sisyphus.Maildir, dbs map[sisyphus.Maildir]*bolt.DB, relearn bool, slots chan struct{}) {
+	type job struct {
+		d     sisyphus.Maildir
+		mails []sisyphus.Mail
+	}
+	jobs := make(chan job)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				slots <- struct{}{}
+				err := sisyphus.LearnBatchContext(ctx, dbs[j.d], j.d, j.mails)
+				<-slots
+				if err == context.Canceled {
+					continue
+				}
+				if err != nil {
+					log.WithFields(log.Fields{
+						"err":     err,
+						"maildir": string(j.d),
+					}).Warning("Cannot learn mails")
+				}
+			}
+		}()
+	}
+
+	// queue returns false if learning has been cancelled
+	queue := func(j job) bool {
+		select {
+		case jobs <- j:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	cancelled := false
+	for _, d := range maildirs {
+		var chunk []sisyphus.Mail
+		err := d.WalkFolders(cfg.Folders, func(val *sisyphus.Mail) error {
+			val.Options = cfg.options(d)
+			val.Relearn = relearn
+			if cfg.TrashFolder != "" && val.Folder == cfg.TrashFolder {
+				val.Weight = cfg.TrashWeight
+			}
+			chunk = append(chunk, *val)
+			if len(chunk) < learnChunkSize {
+				return nil
+			}
+			if !queue(job{d: d, mails: chunk}) {
+				return context.Canceled
+			}
+			chunk = nil
+			return nil
+		})
+		if err == nil && len(chunk) > 0 && !queue(job{d: d, mails: chunk}) {
+			err = context.Canceled
+		}
+		if err == context.Canceled {
+			cancelled = true
+			break
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot load mails")
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if cancelled {
+		log.Info("Learning cancelled")
+		return
+	}
+
+	log.Info("All mails learned")
+
+	return
+}
+
+// decay lets the learning of a maildir fade as configured
+func decay(cfg config, d sisyphus.Maildir, db *bolt.DB) {
+	if cfg.Decay == 0 {
+		return
+	}
+
+	err := sisyphus.Decay(db, cfg.Decay)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":     err,
+			"maildir": string(d),
+		}).Error("Cannot decay learned words")
+	}
+}
+
+// runOnce backs up the databases, learns all maildirs and classifies the mails
+// waiting in new a single time, for setups that run sisyphus from cron rather
+// than as a daemon. Of maildirs sharing a database, only the first one as told
+// by first decays it. It returns early when ctx is cancelled.
+func runOnce(ctx context.Context, cfg config, dbs map[sisyphus.Maildir]*bolt.DB, first map[sisyphus.Maildir]bool, relearn bool) {
+	backup(cfg.Maildirs, dbs)
+	learn(ctx, cfg, cfg.Maildirs, dbs, relearn, make(chan struct{}, cfg.Workers))
+	for _, d := range cfg.Maildirs {
+		if first[d] {
+			decay(cfg, d, dbs[d])
+		}
+	}
+
+	var retries sync.WaitGroup
+	for _, path := range newMailPaths(cfg) {
+		if ctx.Err() != nil {
+			break
+		}
+		classifyNew(ctx, cfg, dbs, path, &retries)
+	}
+	retries.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	log.Info("All new mails classified")
+}
+
+// statistics of a maildir as printed by the stats command
+type statistics struct {
+	Maildir        string     `json:"maildir"`
+	DB             string     `json:"db"`
+	GTotal         uint64     `json:"gTotal"`
+	JTotal         uint64     `json:"jTotal"`
+	GWords         uint64     `json:"gWords"`
+	JWords         uint64     `json:"jWords"`
+	Tokens         uint64     `json:"tokens"`
+	Size           int64      `json:"size"`
+	LastLearned    *time.Time `json:"lastLearned"`
+	LastClassified *time.Time `json:"lastClassified"`
+}
+
+// collectStats reads the statistics of a slice of maildirs
+func collectStats(maildirs []sisyphus.Maildir, dbs map[sisyphus.Maildir]*bolt.DB) ([]statistics, error) {
+	stats := []statistics{}
+	for _, d := range maildirs {
+		info, err := sisyphus.Statistics(dbs[d])
+		if err != nil {
+			return stats, fmt.Errorf("maildir %s: %v", d, err)
+		}
+
+		s := statistics{
+			Maildir: string(d),
+			DB:      dbs[d].Path(),
+			GTotal:  info.GTotal,
+			JTotal:  info.JTotal,
+			GWords:  info.GWords,
+			JWords:  info.JWords,
+			Tokens:  info.Tokens,
+			Size:    info.Size,
+		}
+		// null until a mail has been learned or classified
+		if !info.LastLearned.IsZero() {
+			s.LastLearned = &info.LastLearned
+		}
+		if !info.LastClassified.IsZero() {
+			s.LastClassified = &info.LastClassified
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, nil
+}
+
+// printStats prints statistics as log lines or, if asJSON is set, as a JSON
+// array
+func printStats(stats []statistics, asJSON bool) {
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(stats)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Fatal("Cannot print statistics")
+		}
+		return
+	}
+
+	for _, s := range stats {
+		fields := log.Fields{
+			"maildir":              s.Maildir,
+			"db":                   s.DB,
+			"good mails learned":   s.GTotal,
+			"junk mails learned":   s.JTotal,
+			"number of good words": s.GWords,
+			"number of junk words": s.JWords,
+			"number of words":      s.Tokens,
+			"database size":        s.Size,
+			"last learned":         time.Time{},
+			"last classified":      time.Time{},
+		}
+		if s.LastLearned != nil {
+			fields["last learned"] = *s.LastLearned
+		}
+		if s.LastClassified != nil {
+			fields["last classified"] = *s.LastClassified
+		}
+		log.WithFields(fields).Info("Statistics")
+	}
+}
+
+// forget clears the databases of the configured maildirs after asking for
+// confirmation
+func forget(cfg config, yes bool) {
+	maildirs, dryRun := cfg.Maildirs, cfg.DryRun
+	dbs, err := cfg.loadDatabases()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Cannot load databases")
+	}
+	defer sisyphus.CloseDatabases(dbs)
+
+	stdin := bufio.NewReader(os.Stdin)
+
+	for _, d := range maildirs {
+		gTotal, jTotal, gWords, jWords := sisyphus.Info(dbs[d])
+		fields := log.Fields{
+			"maildir":              string(d),
+			"good mails learned":   gTotal,
+			"junk mails learned":   jTotal,
+			"number of good words": gWords,
+			"number of junk words": jWords,
+		}
+
+		if dryRun {
+			log.WithFields(fields).Info("Would forget -- dry run (nothing happened to this database!)")
+			continue
+		}
+
+		if !yes {
+			fmt.Printf("Forget everything learned for %s? [y/N] ", d)
+			answer, _ := stdin.ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			if answer != "y" && answer != "yes" {
+				log.WithFields(fields).Info("Not forgotten")
+				continue
+			}
+		}
+
+		err = sisyphus.Reset(dbs[d])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot forget")
+			continue
+		}
+
+		log.WithFields(fields).Info("Forgotten")
+	}
+
+	return
+}
+
+// prune removes the rare words from the databases of all maildirs and
+// compacts them to reclaim the space freed. A database shared among maildirs
+// is pruned once.
+func prune(cfg config, minCount int) {
+	var pruned []sisyphus.Maildir
+	done := make(map[string]bool)
+	for _, d := range cfg.Maildirs {
+		path := cfg.databasePath(d)
+		if done[path] {
+			continue
+		}
+		done[path] = true
+
+		// missing databases are not created
+		_, err := os.Stat(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot prune database")
+			continue
+		}
+
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+		if err == bolt.ErrTimeout {
+			log.WithFields(log.Fields{
+				"maildir": string(d),
+			}).Error("Database is in use, please stop sisyphus before pruning")
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot prune database")
+			continue
+		}
+
+		err = sisyphus.Prune(db, minCount)
+		db.Close()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot prune database")
+			continue
+		}
+		pruned = append(pruned, d)
+	}
+
+	compact(cfg, pruned)
+}
+
+// compact compacts the databases of a slice of maildirs and reports their
+// sizes before and after. A database shared among maildirs is compacted once.
+func compact(cfg config, maildirs []sisyphus.Maildir) {
+	done := make(map[string]bool)
+	for _, d := range maildirs {
+		path := cfg.databasePath(d)
+		if done[path] {
+			continue
+		}
+		done[path] = true
+
+		before, err := os.Stat(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot compact database")
+			continue
+		}
+
+		err = sisyphus.CompactFile(path)
+		if err == sisyphus.ErrLocked {
+			log.WithFields(log.Fields{
+				"maildir": string(d),
+			}).Error("Database is in use, please stop sisyphus before compacting")
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot compact database")
+			continue
+		}
+
+		after, err := os.Stat(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot compact database")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"maildir":     string(d),
+			"db":          path,
+			"size before": before.Size(),
+			"size after":  after.Size(),
+		}).Info("Compacted")
+	}
+}
+
+// interval formats the confidence interval of the junk probability of a word,
+// which is wide for words learned from few mails
+func interval(t sisyphus.TokenScore) string {
+	low, high := t.Interval()
+	if math.IsNaN(low) {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.2f-%.2f", low, high)
+}
+
+// top prints the n words indicating junk, or good mails if junk is unset, the
+// most, among those learned from at least min mails
+func top(db *bolt.DB, opts sisyphus.Options, junk bool, n, min int) {
+	scores, err := sisyphus.TopWords(db, opts, junk, n, min)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Cannot list words")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "WORD\tJUNK PROBABILITY\t95% INTERVAL\tGOOD\tJUNK")
+	for _, t := range scores {
+		fmt.Fprintf(w, "%s\t%.4f\t%s\t%d\t%d\n", t.Word, t.Probability, interval(t), t.Good, t.Junk)
+	}
+	w.Flush()
+
+	return
+}
+
+// explain prints the n words contributing most to the classification of a
+// mail, which may be located in any of the maildir's folders
+func explain(db *bolt.DB, d sisyphus.Maildir, key string, opts sisyphus.Options, n int) {
+	var m sisyphus.Mail
+	var err error
+	for _, folder := range []sisyphus.Mail{{New: true}, {}, {Junk: true}} {
+		m = folder
+		m.Key = key
+		m.Options = opts
+		err = m.Load(d)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"mail": key,
+		}).Fatal("Cannot load mail")
+	}
+
+	scores, prob, err := sisyphus.Explain(db, m)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"mail": key,
+		}).Fatal("Cannot explain mail")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "WORD\tJUNK PROBABILITY\t95% INTERVAL\tGOOD\tJUNK")
+	for i, t := range scores {
+		if i >= n {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%.4f\t%s\t%d\t%d\n", t.Word, t.Probability, interval(t), t.Good, t.Junk)
+	}
+	w.Flush()
+
+	fmt.Printf("\nProbability of being junk: %.4f (threshold %.2f)\n", prob, opts.Threshold)
+
+	return
+}
+
+// backup creates and verifies a backup copy of the existing databases. A
+// database shared among maildirs is backed up once, along with the first of
+// them, see config.backupOf.
+func backup(maildirs []sisyphus.Maildir, dbs map[sisyphus.Maildir]*bolt.DB) {
+	ok := true
+	done := make(map[*bolt.DB]bool)
+	for _, d := range maildirs {
+		if done[dbs[d]] {
+			continue
+		}
+		done[dbs[d]] = true
+
+		err := sisyphus.Backup(dbs[d], d)
+		if err != nil {
+			ok = false
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Backup creation")
+		}
+	}
+
+	if ok {
+		log.Info("All databases backed up successfully.")
+	}
+
+	return
 }
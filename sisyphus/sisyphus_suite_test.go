@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// TestMain runs sisyphus instead of the tests if SISYPHUS_TEST_MAIN is set, so
+// that the tests can run the command and check how it exits
+func TestMain(m *testing.M) {
+	if os.Getenv("SISYPHUS_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestSisyphus(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sisyphus Command Suite")
+}
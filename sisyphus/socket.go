@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// socketMaxSize is the number of bytes of a mail that are classified through
+// the socket; the rest of larger mails is ignored
+const socketMaxSize = 4 << 20
+
+// socketTimeout is the time a client of the socket has to send its mail and
+// read the verdict
+const socketTimeout = 30 * time.Second
+
+// The socket speaks a line-based protocol: a client sends the path of the
+// maildir whose database classifies, or an empty line for the first maildir,
+// followed by the raw mail, and closes its side of the connection. The server
+// answers with a single line, either "OK <probability> <YES|NO>" or
+// "ERROR <message>", and closes the connection. A client sending the line
+// "STATS" instead of a maildir, and nothing more, is answered "OK" followed by
+// the statistics of all maildirs as JSON, as printed by stats --json.
+
+// serveSocket classifies the mails sent to the Unix socket at path against the
+// databases of the maildirs, which are kept open, until ctx is cancelled
+func serveSocket(ctx context.Context, cfg config, dbs map[sisyphus.Maildir]*bolt.DB) {
+	// a socket left behind by a previous run is replaced
+	info, err := os.Lstat(cfg.Socket)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(cfg.Socket)
+	}
+
+	ln, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"socket": cfg.Socket,
+		}).Error("Cannot serve socket")
+		return
+	}
+	defer ln.Close()
+
+	// the socket is open to the group, e.g. of the MDA
+	err = os.Chmod(cfg.Socket, 0660)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"socket": cfg.Socket,
+		}).Warning("Cannot set permissions of socket")
+	}
+
+	maildirs := make(map[string]sisyphus.Maildir)
+	for _, d := range cfg.Maildirs {
+		abs, err := filepath.Abs(string(d))
+		if err == nil {
+			maildirs[abs] = d
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	log.WithFields(log.Fields{
+		"socket": cfg.Socket,
+	}).Info("Serving socket")
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithFields(log.Fields{
+					"err":    err,
+					"socket": cfg.Socket,
+				}).Error("Cannot serve socket")
+			}
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(socketTimeout))
+
+			fmt.Fprintln(conn, answerSocket(conn, cfg, dbs, maildirs))
+		}()
+	}
+}
+
+// answerSocket classifies the mail a client sends and returns the line to
+// answer with
+func answerSocket(conn io.Reader, cfg config, dbs map[sisyphus.Maildir]*bolt.DB, maildirs map[string]sisyphus.Maildir) string {
+	r := bufio.NewReader(io.LimitReader(conn, socketMaxSize))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "ERROR " + err.Error()
+	}
+	// the mail is read completely before answering, so that the client
+	// gets to read the answer
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "ERROR " + err.Error()
+	}
+
+	if strings.TrimSpace(line) == "STATS" {
+		stats, err := collectStats(cfg.Maildirs, dbs)
+		if err != nil {
+			return "ERROR " + err.Error()
+		}
+		raw, err := json.Marshal(stats)
+		if err != nil {
+			return "ERROR " + err.Error()
+		}
+		return "OK " + string(raw)
+	}
+
+	d := cfg.Maildirs[0]
+	if name := strings.TrimSpace(line); name != "" {
+		var ok bool
+		d, ok = maildirs[name]
+		if !ok {
+			return "ERROR unknown maildir " + name
+		}
+	}
+
+	m := sisyphus.Mail{
+		Key:     "socket",
+		Options: cfg.options(d),
+	}
+	c, err := m.ClassifyReader(dbs[d], bytes.NewReader(raw))
+	if err != nil {
+		classificationErrors.Inc()
+		log.WithFields(log.Fields{
+			"err":     err,
+			"maildir": string(d),
+		}).Error("Classify mail")
+		return "ERROR " + err.Error()
+	}
+
+	verdict := "NO"
+	if c.Junk {
+		verdict = "YES"
+		mailsClassified.WithLabelValues("junk").Inc()
+	} else {
+		mailsClassified.WithLabelValues("good").Inc()
+	}
+
+	return fmt.Sprintf("OK %s %s", strconv.FormatFloat(c.Probability, 'f', 4, 64), verdict)
+}
+
+// classifySocket sends the raw mail to the socket at path to be classified
+// against the database of maildir d, or of the first maildir of the server if
+// d is empty, and returns the verdict
+func classifySocket(path string, d sisyphus.Maildir, raw []byte) (c sisyphus.Classification, err error) {
+	conn, err := net.DialTimeout("unix", path, socketTimeout)
+	if err != nil {
+		return c, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socketTimeout))
+
+	// the server may run elsewhere in the file system
+	var name string
+	if d != "" {
+		name, err = filepath.Abs(string(resolveDir(string(d))))
+		if err != nil {
+			return c, err
+		}
+	}
+
+	// larger mails would not be read to their end
+	if max := socketMaxSize - len(name) - 1; len(raw) > max {
+		raw = raw[:max]
+	}
+
+	_, err = fmt.Fprintf(conn, "%s\n", name)
+	if err == nil {
+		_, err = conn.Write(raw)
+	}
+	if err != nil {
+		return c, err
+	}
+	err = conn.(*net.UnixConn).CloseWrite()
+	if err != nil {
+		return c, err
+	}
+
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return c, err
+	}
+
+	return parseAnswer(strings.TrimSpace(answer))
+}
+
+// statsSocket asks the running sisyphus serving the socket at path for the
+// current statistics of its maildirs
+func statsSocket(path string) (stats []statistics, err error) {
+	conn, err := net.DialTimeout("unix", path, socketTimeout)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socketTimeout))
+
+	_, err = fmt.Fprintln(conn, "STATS")
+	if err == nil {
+		err = conn.(*net.UnixConn).CloseWrite()
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return stats, err
+	}
+	answer = strings.TrimSpace(answer)
+	if strings.HasPrefix(answer, "ERROR ") {
+		return stats, errors.New(strings.TrimPrefix(answer, "ERROR "))
+	}
+	if !strings.HasPrefix(answer, "OK ") {
+		return stats, fmt.Errorf("unexpected answer of socket: %q", answer)
+	}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(answer, "OK ")), &stats)
+
+	return stats, err
+}
+
+// parseAnswer parses the answer of the socket to a classification
+func parseAnswer(answer string) (c sisyphus.Classification, err error) {
+	if strings.HasPrefix(answer, "ERROR ") {
+		return c, errors.New(strings.TrimPrefix(answer, "ERROR "))
+	}
+
+	fields := strings.Fields(answer)
+	if len(fields) != 3 || fields[0] != "OK" {
+		return c, fmt.Errorf("unexpected answer of socket: %q", answer)
+	}
+	c.Probability, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return c, fmt.Errorf("unexpected answer of socket: %q", answer)
+	}
+	c.Junk = fields[2] == "YES"
+
+	return c, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// mailFiles returns the paths of all files in a slice of directories and
+// their subdirectories. Directories that cannot be read are logged and left
+// out.
+func mailFiles(dirs []string) (paths []string) {
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				paths = append(paths, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"dir": dir,
+			}).Error("Cannot walk directory")
+		}
+	}
+
+	return paths
+}
+
+// train learns every mail in the directories good and junk, and all their
+// subdirectories, with the respective label and reports the number of mails
+// learned per label. Files that are mboxes are split into their mails.
+func train(db *bolt.DB, opts sisyphus.Options, good, junk []string) {
+	fields := log.Fields{}
+	for _, label := range []struct {
+		name string
+		dirs []string
+		junk bool
+	}{
+		{"good", good, false},
+		{"junk", junk, true},
+	} {
+		var learned, failed int
+		for _, path := range mailFiles(label.dirs) {
+			l, f, err := trainFile(db, opts, path, label.junk)
+			if err != nil {
+				l, f = 0, 1
+			}
+			learned += l
+			failed += f
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"mail": path,
+				}).Warning("Cannot learn mail, skipping it")
+			}
+		}
+
+		fields[label.name+" mails learned"] = learned
+		fields[label.name+" mails failed"] = failed
+	}
+
+	log.WithFields(fields).Info("Trained")
+}
+
+// trainFile learns the mail in the file at path, or all mails if it is an
+// mbox, and returns the numbers of mails learned and skipped
+func trainFile(db *bolt.DB, opts sisyphus.Options, path string, junk bool) (learned, failed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if !sisyphus.IsMbox(r) {
+		return 1, 0, learnFile(db, opts, path, junk)
+	}
+
+	m := sisyphus.Mail{
+		Junk:    junk,
+		Options: opts,
+	}
+
+	return m.LearnMbox(db, r)
+}
+
+// learnFile learns the mail in the file at path
+func learnFile(db *bolt.DB, opts sisyphus.Options, path string, junk bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m := sisyphus.Mail{
+		Junk:    junk,
+		Options: opts,
+	}
+
+	return m.LearnReader(db, f)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// printVersion writes the version of sisyphus to w, along with the revision
+// and time of the commit it has been built from, if known, and the version
+// of Go it has been built with
+func printVersion(w io.Writer) {
+	v := version
+	if v == "" {
+		v = "unknown"
+	}
+	fmt.Fprintf(w, "sisyphus %s\n", v)
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var revision, committed, modified string
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.time":
+				committed = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					modified = " (modified)"
+				}
+			}
+		}
+		if revision != "" {
+			fmt.Fprintf(w, "revision %s%s\n", revision, modified)
+		}
+		if committed != "" {
+			fmt.Fprintf(w, "built from commit of %s\n", committed)
+		}
+	}
+
+	fmt.Fprintf(w, "%s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// retryInterval is the time between attempts to watch a removed maildir again
+const retryInterval = 10 * time.Second
+
+// settleInterval is the time a new mail must stay unchanged before it is
+// classified, so that mails still being written are not classified
+const settleInterval = 500 * time.Millisecond
+
+// settler coalesces the events of files being written and reports each file
+// once its size has not changed for settleInterval
+type settler struct {
+	mu      sync.Mutex
+	pending map[string]*settling
+	// ready receives the paths of settled files
+	ready chan string
+	// done stops sending to ready once closed, e.g. on shutdown
+	done <-chan struct{}
+}
+
+// settling is a file waiting to settle
+type settling struct {
+	timer *time.Timer
+	size  int64
+}
+
+// newSettler creates a settler that stops reporting files once done is closed
+func newSettler(done <-chan struct{}) *settler {
+	return &settler{
+		pending: make(map[string]*settling),
+		ready:   make(chan string, 64),
+		done:    done,
+	}
+}
+
+// add starts waiting for the file at path to settle, or waits anew if it is
+// already waiting
+func (s *settler) add(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.pending[path]; ok {
+		p.timer.Reset(settleInterval)
+		return
+	}
+
+	p := &settling{size: -1}
+	p.timer = time.AfterFunc(settleInterval, func() { s.check(path, p) })
+	s.pending[path] = p
+}
+
+// check reports the file at path as ready if its size has not changed since
+// the last check, and waits another interval otherwise. Files that have gone
+// away, e.g. have been moved by the mail client, are dropped.
+func (s *settler) check(path string, p *settling) {
+	info, err := os.Stat(path)
+
+	s.mu.Lock()
+	// the timer may have been reset by add just after it fired, which
+	// checks a file again that has been reported already
+	if s.pending[path] != p {
+		s.mu.Unlock()
+		return
+	}
+	if err == nil && info.Size() != p.size {
+		p.size = info.Size()
+		p.timer.Reset(settleInterval)
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, path)
+	s.mu.Unlock()
+
+	if err == nil {
+		select {
+		case s.ready <- path:
+		case <-s.done:
+		}
+	}
+}
+
+// classifyAttempts is how often classifying a new mail is attempted before
+// giving up, and classifyBackoff the time waited after the first failure,
+// which doubles with every further one
+const (
+	classifyAttempts = 4
+	classifyBackoff  = 100 * time.Millisecond
+)
+
+// retryable reports whether classifying a new mail failed before the mail
+// could be read, because it is missing or still empty. A mail delivered to
+// tmp may not have been moved to new completely when it is classified first.
+// Mails that fail later, e.g. junk that cannot be moved, are never attempted
+// again, as their decision has been recorded already.
+func retryable(err error) bool {
+	if e, ok := err.(*os.PathError); ok && e.Op == "open" {
+		return os.IsNotExist(e)
+	}
+
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// classifyNew classifies the new mail at path and updates the metrics. A mail
+// that cannot be read yet, see retryable, is attempted again in the
+// background, added to retries, so that other mails need not wait for it.
+func classifyNew(ctx context.Context, cfg config, dbs map[sisyphus.Maildir]*bolt.DB, path string, retries *sync.WaitGroup) {
+	d, folder, key, ok := locate(cfg.Maildirs, path)
+	if !ok {
+		return
+	}
+
+	m := sisyphus.Mail{
+		Key:     key,
+		Folder:  folder,
+		DryRun:  cfg.DryRun,
+		Options: cfg.options(d),
+	}
+
+	attemptNew(ctx, cfg, &m, dbs[d], d, 1, classifyBackoff, retries)
+}
+
+// attemptNew makes the given attempt at classifying a new mail, each of which
+// gives up after the configured timeout. Once the mail has failed like
+// described by retryable, it is attempted again after wait, twice as long as
+// before, until classifyAttempts is reached. A panic while classifying, e.g.
+// on a malformed mail, is logged and recovered from, so that a single mail
+// cannot stop the classification of all others.
+func attemptNew(ctx context.Context, cfg config, m *sisyphus.Mail, db *bolt.DB, d sisyphus.Maildir, attempt int, wait time.Duration, retries *sync.WaitGroup) {
+	defer func() {
+		if r := recover(); r != nil {
+			classificationErrors.Inc()
+			log.WithFields(log.Fields{
+				"panic": r,
+				"mail":  m.Key,
+				"dir":   string(d),
+				"stack": string(debug.Stack()),
+			}).Error("Panic while classifying mail")
+		}
+	}()
+
+	timeout, cancel := context.WithTimeout(ctx, cfg.ClassifyTimeout)
+	result, err := m.ClassifyContext(timeout, db, d)
+	cancel()
+	if retryable(err) && attempt < classifyAttempts && ctx.Err() == nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"mail": m.Key,
+			"wait": wait,
+		}).Debug("Cannot classify mail yet, trying again")
+
+		retries.Add(1)
+		go func() {
+			defer retries.Done()
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			attemptNew(ctx, cfg, m, db, d, attempt+1, 2*wait, retries)
+		}()
+		return
+	}
+	if err == context.DeadlineExceeded {
+		classificationErrors.Inc()
+		log.WithFields(log.Fields{
+			"mail":    m.Key,
+			"timeout": cfg.ClassifyTimeout,
+		}).Warning("Skip mail taking too long to classify")
+		return
+	}
+	if err != nil {
+		classificationErrors.Inc()
+		log.WithFields(log.Fields{
+			"err":  err,
+			"mail": m.Key,
+		}).Error("Classify mail")
+		return
+	}
+
+	switch {
+	case result.Skipped:
+	case result.Junk:
+		mailsClassified.WithLabelValues("junk").Inc()
+		notify(cfg.WebhookURL, d, m.Key, result)
+	default:
+		mailsClassified.WithLabelValues("good").Inc()
+	}
+}
+
+// watcher watches the folders of maildirs for new mails. It keeps track of
+// the watched directories in order to notice when one of them is removed,
+// which makes fsnotify drop its watch silently.
+type watcher struct {
+	*fsnotify.Watcher
+	maildirs []sisyphus.Maildir
+	// junk is the junk folder of the maildirs, which is not watched
+	junk string
+
+	mu   sync.Mutex
+	dirs map[string]bool // watched directories
+	lost map[string]bool // removed directories waiting to be recreated
+}
+
+// newWatcher creates a watcher for a slice of maildirs whose junk is moved to
+// the folder junk
+func newWatcher(maildirs []sisyphus.Maildir, junk string) (w *watcher, err error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return w, err
+	}
+
+	w = &watcher{
+		Watcher:  fsw,
+		maildirs: maildirs,
+		junk:     junk,
+		dirs:     make(map[string]bool),
+		lost:     make(map[string]bool),
+	}
+
+	return w, nil
+}
+
+// watch adds a watch for dir and all folders below it. As fsnotify does not
+// watch recursively, every folder is watched for new subfolders as well as
+// its "new" directory for new mails. The "cur" and "tmp" directories as well
+// as the Junk folder are left out.
+func (w *watcher) watch(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		switch info.Name() {
+		case "cur", "tmp":
+			return filepath.SkipDir
+		}
+		for _, d := range w.maildirs {
+			if isJunkFolder(d, w.junk, path) {
+				return filepath.SkipDir
+			}
+		}
+
+		err = w.Add(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"dir": path,
+			}).Error("Cannot watch directory")
+		} else {
+			path = filepath.Clean(path)
+			w.mu.Lock()
+			w.dirs[path] = true
+			if w.lost[path] {
+				delete(w.lost, path)
+				log.WithFields(log.Fields{
+					"dir": path,
+				}).Info("Directory recreated, watching it again")
+			}
+			w.mu.Unlock()
+		}
+
+		if info.Name() == "new" {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+}
+
+// removed handles the removal or renaming of path. If it is a watched
+// directory, it is remembered as lost. Folders are watched again by their
+// parent's watch as soon as they are recreated; a maildir itself has no
+// watched parent and is polled for instead.
+func (w *watcher) removed(path string) {
+	w.mu.Lock()
+	if !w.dirs[path] {
+		w.mu.Unlock()
+		return
+	}
+	delete(w.dirs, path)
+	w.lost[path] = true
+	w.mu.Unlock()
+
+	// a renamed directory keeps its watch under the old name
+	w.Remove(path)
+
+	log.WithFields(log.Fields{
+		"dir": path,
+	}).Warning("Watched directory removed, waiting for it to be recreated")
+
+	for _, val := range w.maildirs {
+		if filepath.Clean(string(val)) == path {
+			go w.await(path)
+		}
+	}
+}
+
+// await watches a removed maildir again once it has been recreated
+func (w *watcher) await(path string) {
+	for {
+		time.Sleep(retryInterval)
+
+		w.mu.Lock()
+		lost := w.lost[path]
+		w.mu.Unlock()
+		if !lost {
+			return
+		}
+
+		_, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		err = w.watch(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"dir": path,
+			}).Error("Cannot watch directory")
+		}
+	}
+}
+
+// newMailPaths returns the paths of the mails waiting in the "new" directory
+// of any folder of the configured maildirs, e.g. to classify those the
+// watcher has missed
+func newMailPaths(cfg config) (paths []string) {
+	for _, d := range cfg.Maildirs {
+		mails, err := newMails(d, cfg.Options.JunkFolder)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":     err,
+				"maildir": string(d),
+			}).Error("Cannot read new mails")
+			continue
+		}
+
+		for _, m := range mails {
+			paths = append(paths, filepath.Join(string(d), m.Folder, "new", m.Key))
+		}
+	}
+
+	return paths
+}
+
+// isJunkFolder reports whether path is the junk folder of maildir d
+func isJunkFolder(d sisyphus.Maildir, junk, path string) bool {
+	return filepath.Clean(path) == filepath.Join(string(d), junk)
+}
+
+// locate returns the maildir and folder a mail at path has been delivered to,
+// i.e. path is <maildir>/<folder>/new/<key>. It returns false if path is not
+// a new mail of one of the maildirs.
+func locate(maildirs []sisyphus.Maildir, path string) (d sisyphus.Maildir, folder, key string, ok bool) {
+	dir, key := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if filepath.Base(dir) != "new" {
+		return d, folder, key, false
+	}
+	dir = filepath.Dir(dir)
+
+	for _, val := range maildirs {
+		// paths are compared as a whole, so a maildir whose own path
+		// contains a directory called new is no different from any other
+		rel, err := filepath.Rel(filepath.Clean(string(val)), dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			rel = ""
+		}
+		// prefer the maildir closest to the mail if maildirs are nested
+		if ok && len(rel) >= len(folder) {
+			continue
+		}
+
+		d, folder, ok = val, rel, true
+	}
+
+	return d, folder, key, ok
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/carlostrub/sisyphus"
+)
+
+// webhookTimeout is the time a webhook has to answer, and webhookAttempts
+// how often a notification is attempted before it is dropped
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+)
+
+// webhookClient posts the notifications of junk to the webhook
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// junkEvent is the payload posted to the webhook whenever a mail is filed as
+// junk
+type junkEvent struct {
+	Maildir string `json:"maildir"`
+	Key     string `json:"key"`
+	// Score is the probability of the mail being junk, or null if none
+	// of its words have been learned
+	Score  *float64 `json:"score"`
+	Sender string   `json:"sender,omitempty"`
+}
+
+// notify posts the verdict on a junk mail to the webhook at url, if any, in
+// the background. Failed posts are attempted again a few times, then the
+// notification is dropped, so that the webhook never holds up filtering.
+func notify(url string, d sisyphus.Maildir, key string, c sisyphus.Classification) {
+	if url == "" {
+		return
+	}
+
+	e := junkEvent{
+		Maildir: string(d),
+		Key:     key,
+		Sender:  c.Sender,
+	}
+	if !math.IsNaN(c.Probability) {
+		e.Score = &c.Probability
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"mail": key,
+		}).Error("Cannot encode webhook notification")
+		return
+	}
+
+	go func() {
+		wait := time.Second
+		for i := 1; ; i++ {
+			err := post(url, payload)
+			if err == nil {
+				return
+			}
+			if i == webhookAttempts {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"mail": key,
+				}).Error("Cannot notify webhook, dropping notification")
+				return
+			}
+
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}()
+}
+
+// post posts a JSON payload to url
+func post(url string, payload []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package sisyphus
+
+import (
+	"io"
+	"strings"
+)
+
+// DefaultStopWords are common English words that appear in good and junk
+// mails alike and thus carry hardly any information.
+var DefaultStopWords = []string{
+	"a", "about", "above", "after", "again", "against", "all", "also", "am",
+	"an", "and", "any", "are", "as", "at", "be", "because", "been", "before",
+	"being", "below", "between", "both", "but", "by", "can", "could", "did",
+	"do", "does", "doing", "down", "during", "each", "few", "for", "from",
+	"further", "had", "has", "have", "having", "he", "her", "here", "hers",
+	"herself", "him", "himself", "his", "how", "i", "if", "in", "into", "is",
+	"it", "its", "itself", "just", "me", "more", "most", "my", "myself", "no",
+	"nor", "not", "now", "of", "off", "on", "once", "only", "or", "other",
+	"our", "ours", "ourselves", "out", "over", "own", "same", "she", "should",
+	"so", "some", "such", "than", "that", "the", "their", "theirs", "them",
+	"themselves", "then", "there", "these", "they", "this", "those", "through",
+	"to", "too", "under", "until", "up", "very", "was", "we", "were", "what",
+	"when", "where", "which", "while", "who", "whom", "why", "will", "with",
+	"would", "you", "your", "yours", "yourself", "yourselves",
+}
+
+// ReadStopWords reads a list of stop words from r, which holds one word per
+// line. Empty lines and lines starting with # are ignored.
+func ReadStopWords(r io.Reader) (words []string, err error) {
+	words, err = readLines(r)
+	for i, w := range words {
+		words[i] = strings.ToLower(w)
+	}
+
+	return words, err
+}
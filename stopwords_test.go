@@ -0,0 +1,20 @@
+package sisyphus_test
+
+import (
+	"strings"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stop words", func() {
+	Context("Read a list of stop words", func() {
+		It("lowercases them and skips empty lines and comments", func() {
+			words, err := ReadStopWords(strings.NewReader("# German\nUnd\n\noder\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(words).Should(Equal([]string{"und", "oder"}))
+		})
+	})
+})
@@ -0,0 +1,76 @@
+package sisyphus
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultUpstreamHeaders are the headers of upstream filters, e.g.
+// SpamAssassin or Rspamd, that are considered if no other headers are
+// configured.
+var DefaultUpstreamHeaders = []string{"X-Spam-Flag", "X-Spam-Status", "X-Spam", "X-Rspamd-Score"}
+
+// UpstreamScore is the score of an upstream filter from which on a mail
+// counts as junk. It matches the default required score of SpamAssassin.
+const UpstreamScore = 5.0
+
+// upstreamJunk and upstreamGood are the probabilities of being good that
+// the verdicts of upstream filters add to those of the words of a mail.
+const (
+	upstreamJunk = 0.01
+	upstreamGood = 0.99
+)
+
+// UpstreamVerdicts returns the verdicts of upstream filters found in the
+// configured headers of a loaded mail, true for junk. Headers starting with
+// "yes" or "no", such as "X-Spam-Flag: YES" or "X-Spam-Status: No,
+// score=1.2", are taken literally; numeric headers, such as
+// "X-Rspamd-Score: 7.3", are compared with UpstreamScore. Any other value is
+// ignored.
+func (m *Mail) UpstreamVerdicts() (junk []bool) {
+	for _, name := range m.upstreamHeaders() {
+		value := strings.ToLower(strings.TrimSpace(m.Header.Get(name)))
+		fields := strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ';' || unicode.IsSpace(r)
+		})
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "yes":
+			junk = append(junk, true)
+			continue
+		case "no":
+			junk = append(junk, false)
+			continue
+		}
+
+		score, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		junk = append(junk, score >= UpstreamScore)
+	}
+
+	return junk
+}
+
+// upstreamProbabilities returns the verdicts of upstream filters as
+// probabilities of the mail being good, if enabled
+func (m *Mail) upstreamProbabilities() (p []float64) {
+	if !m.Upstream {
+		return p
+	}
+
+	for _, junk := range m.UpstreamVerdicts() {
+		if junk {
+			p = append(p, upstreamJunk)
+		} else {
+			p = append(p, upstreamGood)
+		}
+	}
+
+	return p
+}
@@ -0,0 +1,55 @@
+package sisyphus_test
+
+import (
+	"net/mail"
+
+	. "github.com/carlostrub/sisyphus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream", func() {
+	Context("Read the verdicts of upstream filters", func() {
+		It("takes yes and no literally", func() {
+			m := &Mail{Header: mail.Header{
+				"X-Spam-Flag":   {"YES"},
+				"X-Spam-Status": {"No, score=1.2 required=5.0 tests=NONE"},
+			}}
+
+			Ω(m.UpstreamVerdicts()).Should(Equal([]bool{true, false}))
+		})
+
+		It("compares scores with the upstream score", func() {
+			m := &Mail{Header: mail.Header{
+				"X-Rspamd-Score": {"7.30"},
+			}}
+			Ω(m.UpstreamVerdicts()).Should(Equal([]bool{true}))
+
+			m.Header = mail.Header{
+				"X-Rspamd-Score": {"-0.10"},
+			}
+			Ω(m.UpstreamVerdicts()).Should(Equal([]bool{false}))
+		})
+
+		It("ignores missing and unknown values", func() {
+			m := &Mail{Header: mail.Header{
+				"X-Spam-Flag": {"maybe"},
+			}}
+
+			Ω(m.UpstreamVerdicts()).Should(BeEmpty())
+		})
+
+		It("only reads the configured headers", func() {
+			m := &Mail{
+				Header: mail.Header{
+					"X-Spam-Flag":     {"YES"},
+					"X-Custom-Filter": {"no"},
+				},
+				Options: Options{UpstreamHeaders: []string{"X-Custom-Filter"}},
+			}
+
+			Ω(m.UpstreamVerdicts()).Should(Equal([]bool{false}))
+		})
+	})
+})